@@ -9,12 +9,14 @@
 #include <cinttypes>
 #include <cmath>
 #include <cstdio>
+#include <cstdlib>
 #include <cstring>
 #include <fcntl.h>
 #include <fstream>
 #include <iostream>
 #include <regex>
 #include <sstream>
+#include <stdexcept>
 #include <string>
 #include <vector>
 
@@ -109,26 +111,15 @@ static inline int binding_memfd_create(const char *name, unsigned int flags) {
 #include <sys/stat.h>
 #endif
 #if defined(__unix__) || (defined(__APPLE__) && defined(__MACH__))
-#include <signal.h>
 #include <unistd.h>
 #elif defined(_WIN32)
 #define WIN32_LEAN_AND_MEAN
 #ifndef NOMINMAX
 #define NOMINMAX
 #endif
-#include <signal.h>
 #include <windows.h>
 #endif
 
-#if defined(__unix__) || (defined(__APPLE__) && defined(__MACH__)) ||          \
-    defined(_WIN32)
-void sigint_handler(int signo) {
-    if (signo == SIGINT) {
-        _exit(130);
-    }
-}
-#endif
-
 // Forward declarations
 // Note: load_binding_model is now provided by common.cpp via the patch
 
@@ -136,7 +127,8 @@ llama_token llama_sample_token_binding(
     struct llama_context *ctx, struct llama_context *ctx_guidance,
     struct llama_grammar *grammar, void *params_ptr,
     const std::vector<llama_token> &last_tokens,
-    std::vector<llama_token_data> &candidates, int idx = -1);
+    std::vector<llama_token_data> &candidates, int idx = -1,
+    float *mirostat_mu = NULL);
 
 int get_embeddings(void *params_ptr, void *state_pr, float *res_embeddings) {
     gpt_params *params_p = (gpt_params *)params_ptr;
@@ -219,11 +211,124 @@ int eval(void *params_ptr, void *state_pr, char *text) {
                       params_p->n_threads);
 }
 
+// compute the tokens that stay in the context when it overflows. Returns false
+// if generation has to stop instead.
+static bool overflow_history(void *state_pr, int policy, int window,
+                             int params_n_keep, int n_room,
+                             const std::vector<llama_token> &history,
+                             std::vector<llama_token> &out) {
+    const int n_past = (int)history.size();
+    // always keep the first token - BOS
+    const int n_keep = std::min(std::max(1, params_n_keep), n_past);
+
+    switch (policy) {
+    case LLAMA_BINDING_OVERFLOW_ERROR:
+        return false;
+    case LLAMA_BINDING_OVERFLOW_SLIDING_WINDOW: {
+        // keep the system prompt (n_keep) plus the most recent tokens, by
+        // default half of the room left after it
+        if (window <= 0) {
+            window = (n_room - n_keep) / 2;
+        }
+        const int n_recent =
+            std::max(0, std::min(window, std::min(n_past - n_keep,
+                                                  n_room - n_keep)));
+        out.assign(history.begin(), history.begin() + n_keep);
+        out.insert(out.end(), history.end() - n_recent, history.end());
+    } break;
+    case LLAMA_BINDING_OVERFLOW_HOOK: {
+        // let the Go side rewrite the history in place, it can only drop
+        // tokens
+        out = history;
+        const int n = contextOverflowHook(state_pr, out.data(), n_past, n_past);
+        if (n < 0 || n > n_past) {
+            return false;
+        }
+        out.resize(n);
+    } break;
+    default: {
+        // take half of the last (n_ctx - n_keep) tokens
+        const int n_left = n_past - n_keep;
+        out.assign(history.begin(), history.begin() + n_keep);
+        out.insert(out.end(), history.end() - n_left / 2, history.end());
+    } break;
+    }
+
+    return (int)out.size() <= n_room;
+}
+
+static int *copy_tokens(const std::vector<llama_token> &tokens, int *n_out) {
+    int *out = (int *)malloc(std::max<size_t>(1, tokens.size()) * sizeof(int));
+    if (out != NULL) {
+        std::copy(tokens.begin(), tokens.end(), out);
+    }
+    *n_out = (int)tokens.size();
+    return out;
+}
+
+// fills cp with everything llama_predict needs to carry on from the top of its
+// loop, returns false if an allocation failed
+static bool save_checkpoint(llama_context *ctx, llama_binding_checkpoint *cp,
+                            const std::vector<llama_token> &embd_inp,
+                            const std::vector<llama_token> &ctx_tokens,
+                            const std::vector<llama_token> &last_tokens,
+                            const std::vector<llama_token> &sampled,
+                            const std::vector<llama_token> &embd,
+                            const std::string &output) {
+    cp->prompt_tokens = copy_tokens(embd_inp, &cp->n_prompt_tokens);
+    cp->ctx_tokens = copy_tokens(ctx_tokens, &cp->n_ctx_tokens);
+    cp->last_tokens = copy_tokens(last_tokens, &cp->n_last_tokens);
+    cp->sampled_tokens = copy_tokens(sampled, &cp->n_sampled_tokens);
+    cp->pending_tokens = copy_tokens(embd, &cp->n_pending_tokens);
+    cp->output = strdup(output.c_str());
+    // the state is kept at its full size, which is what resuming checks,
+    // even when the KV cache does not fill it
+    cp->state_size = llama_get_state_size(ctx);
+    cp->state = calloc(1, cp->state_size);
+    if (cp->state != NULL) {
+        llama_copy_state_data(ctx, (uint8_t *)cp->state);
+    }
+
+    return cp->prompt_tokens != NULL && cp->ctx_tokens != NULL &&
+           cp->last_tokens != NULL && cp->sampled_tokens != NULL &&
+           cp->pending_tokens != NULL && cp->output != NULL &&
+           cp->state != NULL;
+}
+
+// releases what llama_predict allocates on every path out of it, the
+// checkpoint is only kept when the prediction was suspended
+struct predict_resources {
+    llama_context *ctx_guidance = NULL;
+    llama_grammar *grammar = NULL;
+    llama_binding_checkpoint *checkpoint = NULL;
+    bool keep_checkpoint = false;
+
+    ~predict_resources() {
+        if (grammar != NULL) {
+            llama_grammar_free(grammar);
+        }
+        if (ctx_guidance != NULL) {
+            llama_free(ctx_guidance);
+        }
+        if (checkpoint != NULL && !keep_checkpoint) {
+            llama_binding_free_checkpoint(checkpoint);
+        }
+    }
+};
+
 int llama_predict(void *params_ptr, void *state_pr, char *result,
-                  size_t result_size, bool debug) {
+                  size_t result_size, bool debug, void *prompt_cache_ptr,
+                  int overflow_policy, int overflow_window,
+                  const void *checkpoint_in_ptr, void *checkpoint_out_ptr) {
     gpt_params *params_p = (gpt_params *)params_ptr;
     llama_binding_state *state = (llama_binding_state *)state_pr;
     llama_context *ctx = state->ctx;
+    llama_binding_prompt_cache *prompt_cache =
+        (llama_binding_prompt_cache *)prompt_cache_ptr;
+    const llama_binding_checkpoint *checkpoint_in =
+        (const llama_binding_checkpoint *)checkpoint_in_ptr;
+    llama_binding_checkpoint *checkpoint_out =
+        (llama_binding_checkpoint *)checkpoint_out_ptr;
 
     gpt_params params = *params_p;
     const int n_ctx = llama_n_ctx(ctx);
@@ -261,17 +366,33 @@ int llama_predict(void *params_ptr, void *state_pr, char *result,
                 __func__);
         params.n_ctx = 8;
     }
+    predict_resources resources;
+    resources.checkpoint = checkpoint_out;
     llama_context *ctx_guidance = NULL;
 
     if (params.cfg_scale > 1.f) {
         struct llama_context_params lparams =
             llama_context_params_from_gpt_params(params);
         ctx_guidance = llama_new_context_with_model(state->model, lparams);
+        resources.ctx_guidance = ctx_guidance;
     }
 
     std::string path_session = params.path_prompt_cache;
     std::vector<llama_token> session_tokens;
 
+    if (checkpoint_in != NULL) {
+        // a resumed generation restores its own state instead
+        path_session.clear();
+        prompt_cache = NULL;
+
+        if (checkpoint_in->n_last_tokens != n_ctx ||
+            checkpoint_in->state_size != llama_get_state_size(ctx)) {
+            fprintf(stderr, "%s: error: checkpoint does not match the context\n",
+                    __func__);
+            return 1;
+        }
+    }
+
     if (!path_session.empty()) {
         if (debug) {
             fprintf(stderr, "%s: attempting to load saved session from '%s'\n",
@@ -306,11 +427,29 @@ int llama_predict(void *params_ptr, void *state_pr, char *result,
                         __func__);
             }
         }
+    } else if (prompt_cache != NULL && prompt_cache->state_in != NULL) {
+        // restore a state from the in-memory prompt cache, the tokens it was
+        // saved with are then matched against the prompt like a session file
+        llama_set_state_data(ctx, (uint8_t *)prompt_cache->state_in);
+        session_tokens.assign(prompt_cache->tokens_in,
+                              prompt_cache->tokens_in +
+                                  prompt_cache->n_tokens_in);
+        if (debug) {
+            fprintf(stderr,
+                    "%s: restored a cached prompt prefix of %d tokens\n",
+                    __func__, (int)session_tokens.size());
+        }
     }
+    bool cache_prompt =
+        path_session.empty() && prompt_cache != NULL && prompt_cache->store;
     const bool add_bos = llama_vocab_type(ctx) == LLAMA_VOCAB_TYPE_SPM;
 
     std::vector<llama_token> embd_inp;
-    if (!params.prompt.empty() || session_tokens.empty()) {
+    if (checkpoint_in != NULL) {
+        embd_inp.assign(checkpoint_in->prompt_tokens,
+                        checkpoint_in->prompt_tokens +
+                            checkpoint_in->n_prompt_tokens);
+    } else if (!params.prompt.empty() || session_tokens.empty()) {
         embd_inp = tokenize_abi_safe(ctx, params.prompt, add_bos);
     } else {
         embd_inp = session_tokens;
@@ -421,6 +560,7 @@ int llama_predict(void *params_ptr, void *state_pr, char *result,
             parsed_grammar.c_rules());
         grammar = llama_grammar_init(grammar_rules.data(), grammar_rules.size(),
                                      parsed_grammar.symbol_ids.at("root"));
+        resources.grammar = grammar;
     }
 
     // TODO: replace with ring-buffer
@@ -428,9 +568,14 @@ int llama_predict(void *params_ptr, void *state_pr, char *result,
     std::fill(last_tokens.begin(), last_tokens.end(), 0);
 
     bool is_antiprompt = false;
+    bool context_full = false;
+    bool suspended = false;
+    bool interrupted = false;
     bool input_echo = true;
     bool need_to_save_session =
         !path_session.empty() && n_matching_session_tokens < embd_inp.size();
+    bool need_to_cache_prompt =
+        cache_prompt && n_matching_session_tokens < embd_inp.size();
 
     int n_past = 0;
     int n_remain = params.n_predict;
@@ -442,6 +587,12 @@ int llama_predict(void *params_ptr, void *state_pr, char *result,
     std::vector<int> output_tokens;
     std::ostringstream output_ss;
 
+    // the tokens currently held in the context, one for each of n_past
+    std::vector<llama_token> ctx_tokens;
+    // every sampled token, so that a checkpoint can replay the grammar
+    std::vector<llama_token> sampled;
+    float mirostat_mu = 2.0f * params.mirostat_tau;
+
     // the first thing we will do is to output the prompt, so set color
     // accordingly
 
@@ -453,18 +604,74 @@ int llama_predict(void *params_ptr, void *state_pr, char *result,
 
     std::string res = "";
 
-    {
-        const std::vector<llama_token> tmp = {
-            llama_token_bos(ctx),
-        };
-        llama_eval(ctx, tmp.data(), tmp.size(), 0, params.n_threads);
-        llama_reset_timings(ctx);
-    }
+    if (checkpoint_in != NULL) {
+        // the saved state holds the KV cache and the RNG
+        llama_set_state_data(ctx, (uint8_t *)checkpoint_in->state);
+
+        n_past = checkpoint_in->n_past;
+        n_remain = checkpoint_in->n_remain;
+        n_consumed = checkpoint_in->n_consumed;
+        mirostat_mu = checkpoint_in->mirostat_mu;
+        ctx_tokens.assign(checkpoint_in->ctx_tokens,
+                          checkpoint_in->ctx_tokens +
+                              checkpoint_in->n_ctx_tokens);
+        last_tokens.assign(checkpoint_in->last_tokens,
+                           checkpoint_in->last_tokens +
+                               checkpoint_in->n_last_tokens);
+        sampled.assign(checkpoint_in->sampled_tokens,
+                       checkpoint_in->sampled_tokens +
+                           checkpoint_in->n_sampled_tokens);
+        embd.assign(checkpoint_in->pending_tokens,
+                    checkpoint_in->pending_tokens +
+                        checkpoint_in->n_pending_tokens);
+        res = checkpoint_in->output;
+
+        if (grammar != NULL) {
+            for (llama_token id : sampled) {
+                llama_grammar_accept_token(ctx, grammar, id);
+            }
+        }
+    } else {
+        {
+            const std::vector<llama_token> tmp = {
+                llama_token_bos(ctx),
+            };
+            llama_eval(ctx, tmp.data(), tmp.size(), 0, params.n_threads);
+            llama_reset_timings(ctx);
+        }
 
-    // set the seed before actually predicting
-    llama_set_rng_seed(ctx, params.seed);
+        // set the seed before actually predicting
+        llama_set_rng_seed(ctx, params.seed);
+    }
 
     while (n_remain != 0) {
+        const int control = predictControl(state_pr);
+        if (control == LLAMA_BINDING_CONTROL_INTERRUPT) {
+            interrupted = true;
+            break;
+        }
+
+        // suspend before evaluating the pending tokens, guidance contexts are
+        // not part of the checkpoint so they can not be suspended
+        if (checkpoint_out != NULL && ctx_guidance == NULL &&
+            control == LLAMA_BINDING_CONTROL_SUSPEND) {
+            checkpoint_out->n_past = n_past;
+            // a negative count generates until the end of text, however far
+            // it went down
+            checkpoint_out->n_remain = std::max(n_remain, -1);
+            checkpoint_out->n_consumed = n_consumed;
+            checkpoint_out->mirostat_mu = mirostat_mu;
+            if (!save_checkpoint(ctx, checkpoint_out, embd_inp, ctx_tokens,
+                                 last_tokens, sampled, embd, res)) {
+                fprintf(stderr, "%s: error: failed to save checkpoint\n",
+                        __func__);
+                return 1;
+            }
+            suspended = true;
+            resources.keep_checkpoint = true;
+            break;
+        }
+
         // predict
         if (embd.size() > 0) {
             // Note: n_ctx - 4 here is to match the logic for commandline prompt
@@ -480,27 +687,44 @@ int llama_predict(void *params_ptr, void *state_pr, char *result,
                 embd.resize(max_embd_size);
             }
             // infinite text generation via context swapping
-            // if we run out of context:
-            // - take the n_keep first tokens from the original prompt (via
+            // if we run out of context, the overflow policy decides which
+            // tokens stay in the context:
+            // - the tokens shared with the current context are kept (via
             // n_past)
-            // - take half of the last (n_ctx - n_keep) tokens and recompute the
-            // logits in batches
+            // - the remaining ones are recomputed in batches
             if (n_past + (int)embd.size() + std::max<int>(0, guidance_offset) >
                 n_ctx) {
-                const int n_left = n_past - params.n_keep;
+                const int n_room = n_ctx - (int)embd.size() -
+                                   std::max<int>(0, guidance_offset);
+                std::vector<llama_token> new_history;
+                if (!overflow_history(state_pr, overflow_policy,
+                                      overflow_window, params.n_keep, n_room,
+                                      ctx_tokens, new_history)) {
+                    context_full = true;
+                    break;
+                }
+
+                size_t n_common = 0;
+                while (n_common < new_history.size() &&
+                       n_common < ctx_tokens.size() &&
+                       new_history[n_common] == ctx_tokens[n_common]) {
+                    n_common++;
+                }
+
+                const int n_past_before = n_past;
+                n_past = (int)n_common;
+                n_past_guidance = std::max(1, n_past + guidance_offset);
+                ctx_tokens.resize(n_common);
 
-                // always keep the first token - BOS
-                n_past = std::max(1, params.n_keep);
-                n_past_guidance = std::max(1, params.n_keep + guidance_offset);
+                embd.insert(embd.begin(), new_history.begin() + n_common,
+                            new_history.end());
 
-                // insert n_left/2 tokens at the start of embd from last_tokens
-                embd.insert(embd.begin(),
-                            last_tokens.begin() + n_ctx - n_left / 2 -
-                                embd.size(),
-                            last_tokens.end() - embd.size());
+                contextShiftCallback(state_pr, overflow_policy, n_past_before,
+                                     n_past_before - (int)new_history.size());
 
                 // stop saving session if we run out of context
                 path_session.clear();
+                cache_prompt = false;
             }
 
             // try to reuse a matching prefix from the loaded session instead of
@@ -513,6 +737,7 @@ int llama_predict(void *params_ptr, void *state_pr, char *result,
                         break;
                     }
 
+                    ctx_tokens.push_back(embd[i]);
                     n_past++;
                     n_session_consumed++;
 
@@ -582,10 +807,12 @@ int llama_predict(void *params_ptr, void *state_pr, char *result,
                     fprintf(stderr, "%s : failed to eval\n", __func__);
                     return 1;
                 }
+                ctx_tokens.insert(ctx_tokens.end(), embd.begin() + i,
+                                  embd.begin() + i + n_eval);
                 n_past += n_eval;
             }
 
-            if (embd.size() > 0 && !path_session.empty()) {
+            if (embd.size() > 0 && (!path_session.empty() || cache_prompt)) {
                 session_tokens.insert(session_tokens.end(), embd.begin(),
                                       embd.end());
                 n_session_consumed = session_tokens.size();
@@ -606,13 +833,36 @@ int llama_predict(void *params_ptr, void *state_pr, char *result,
                                         session_tokens.size());
             }
 
+            // hand a copy of the evaluated prompt back to the prompt cache
+            if (cache_prompt && need_to_cache_prompt) {
+                need_to_cache_prompt = false;
+                const size_t state_size = llama_get_state_size(ctx);
+                uint8_t *state_mem = (uint8_t *)malloc(state_size);
+                int *tokens_mem =
+                    (int *)malloc(session_tokens.size() * sizeof(int));
+                if (state_mem != NULL && tokens_mem != NULL) {
+                    prompt_cache->state_out_size =
+                        llama_copy_state_data(ctx, state_mem);
+                    prompt_cache->state_out = state_mem;
+                    std::copy(session_tokens.begin(), session_tokens.end(),
+                              tokens_mem);
+                    prompt_cache->tokens_out = tokens_mem;
+                    prompt_cache->n_tokens_out = (int)session_tokens.size();
+                } else {
+                    free(state_mem);
+                    free(tokens_mem);
+                }
+            }
+
             const llama_token id = llama_sample_token_binding(
-                ctx, ctx_guidance, grammar, params_p, last_tokens, candidates);
+                ctx, ctx_guidance, grammar, params_p, last_tokens, candidates,
+                -1, &mirostat_mu);
             // const llama_token id = llama_sample_token(ctx, ctx_guidance,
             // grammar, params, last_tokens, candidates);
 
             last_tokens.erase(last_tokens.begin());
             last_tokens.push_back(id);
+            sampled.push_back(id);
 
             // add it to the context
             embd.push_back(id);
@@ -715,26 +965,60 @@ int llama_predict(void *params_ptr, void *state_pr, char *result,
     }
 
 end:
-#if defined(_WIN32)
-    signal(SIGINT, SIG_DFL);
-#endif
-
     if (debug) {
         llama_print_timings(ctx);
         llama_reset_timings(ctx);
     }
-    if (grammar != NULL) {
-        llama_grammar_free(grammar);
-    }
 
     // Safe copy with bounds checking
     if (result_size > 0) {
         strncpy(result, res.c_str(), result_size - 1);
         result[result_size - 1] = '\0'; // Ensure null termination
     }
+    if (context_full) {
+        return LLAMA_BINDING_ERR_CONTEXT_FULL;
+    }
+    if (suspended) {
+        return LLAMA_BINDING_SUSPENDED;
+    }
+    if (interrupted) {
+        return LLAMA_BINDING_INTERRUPTED;
+    }
     return 0;
 }
 
+int llama_binding_memfd_create(const char *name) {
+#if defined(__linux__)
+    return binding_memfd_create(name, MFD_CLOEXEC);
+#else
+    (void)name;
+    return -1;
+#endif
+}
+
+void llama_binding_free_checkpoint(void *checkpoint_ptr) {
+    llama_binding_checkpoint *cp = (llama_binding_checkpoint *)checkpoint_ptr;
+    free(cp->prompt_tokens);
+    free(cp->ctx_tokens);
+    free(cp->last_tokens);
+    free(cp->sampled_tokens);
+    free(cp->pending_tokens);
+    free(cp->state);
+    free(cp->output);
+    memset(cp, 0, sizeof(*cp));
+}
+
+void llama_binding_free_prompt_cache_out(void *prompt_cache_ptr) {
+    llama_binding_prompt_cache *prompt_cache =
+        (llama_binding_prompt_cache *)prompt_cache_ptr;
+    free(prompt_cache->state_out);
+    free(prompt_cache->tokens_out);
+    prompt_cache->state_out = NULL;
+    prompt_cache->state_out_size = 0;
+    prompt_cache->tokens_out = NULL;
+    prompt_cache->n_tokens_out = 0;
+}
+
 // this is a bit of a hack now - ideally this should be in the predict function
 // and be transparent to the caller, however this now maps 1:1 (mostly) the
 // upstream implementation Note: both model have to be loaded with perplexity
@@ -1049,6 +1333,293 @@ int llama_tokenize_string(void *params_ptr, void *state_pr, int *result) {
                           add_bos);
 }
 
+// A session is an additional context on top of an already loaded model. It
+// keeps track of the tokens it has evaluated so that generation can continue
+// from where the previous call stopped, and so that its state can be cloned
+// into another context without re-evaluating the shared prefix.
+struct llama_binding_session {
+    llama_model *model;
+    llama_context *ctx;
+    llama_context_params ctx_params;
+    std::vector<llama_token> tokens;
+};
+
+void *llama_binding_new_session(void *state_pr, int n_ctx, int n_seed,
+                                bool memory_f16, bool embeddings, int n_batch,
+                                float rope_freq_base, float rope_freq_scale,
+                                bool perplexity) {
+    llama_binding_state *state = (llama_binding_state *)state_pr;
+
+    gpt_params lparams;
+    lparams.n_ctx = n_ctx;
+    lparams.seed = n_seed;
+    lparams.memory_f16 = memory_f16;
+    lparams.embedding = embeddings;
+    lparams.perplexity = perplexity;
+    lparams.n_batch = n_batch;
+    lparams.rope_freq_base = rope_freq_base != 0.0f ? rope_freq_base : 10000.0f;
+    lparams.rope_freq_scale =
+        rope_freq_scale != 0.0f ? rope_freq_scale : 1.0f;
+
+    llama_binding_session *session = new llama_binding_session;
+    session->model = state->model;
+    session->ctx_params = llama_context_params_from_gpt_params(lparams);
+    session->ctx =
+        llama_new_context_with_model(session->model, session->ctx_params);
+    if (session->ctx == NULL) {
+        fprintf(stderr, "%s: error: failed to create context for session\n",
+                __func__);
+        delete session;
+        return nullptr;
+    }
+
+    return session;
+}
+
+void *llama_binding_fork_session(void *session_pr) {
+    llama_binding_session *src = (llama_binding_session *)session_pr;
+
+    llama_binding_session *dst = new llama_binding_session;
+    dst->model = src->model;
+    dst->ctx_params = src->ctx_params;
+    dst->ctx = llama_new_context_with_model(dst->model, dst->ctx_params);
+    if (dst->ctx == NULL) {
+        fprintf(stderr, "%s: error: failed to create context for fork\n",
+                __func__);
+        delete dst;
+        return nullptr;
+    }
+
+    // copy rng, logits, embeddings and the kv cache into the new context
+    const size_t state_size = llama_get_state_size(src->ctx);
+    std::vector<uint8_t> state_mem(state_size);
+    const size_t n_copied = llama_copy_state_data(src->ctx, state_mem.data());
+    if (n_copied > state_size) {
+        fprintf(stderr, "%s: error: state larger than expected (%zu > %zu)\n",
+                __func__, n_copied, state_size);
+        llama_free(dst->ctx);
+        delete dst;
+        return nullptr;
+    }
+    llama_set_state_data(dst->ctx, state_mem.data());
+    dst->tokens = src->tokens;
+
+    return dst;
+}
+
+void llama_binding_free_session(void *session_pr) {
+    if (session_pr == nullptr) {
+        return;
+    }
+    llama_binding_session *session = (llama_binding_session *)session_pr;
+    if (session->ctx != nullptr) {
+        llama_free(session->ctx);
+        session->ctx = nullptr;
+    }
+    // the model is owned by the llama_binding_state the session was created
+    // from, so it is not freed here
+    delete session;
+}
+
+int llama_session_n_past(void *session_pr) {
+    llama_binding_session *session = (llama_binding_session *)session_pr;
+    return (int)session->tokens.size();
+}
+
+// evaluate the prompt of params on top of the tokens already in the session
+static int session_eval_prompt(llama_binding_session *session,
+                               const gpt_params &params) {
+    llama_context *ctx = session->ctx;
+    const int n_ctx = llama_n_ctx(ctx);
+
+    if (params.prompt.empty()) {
+        return 0;
+    }
+
+    // only the very first chunk of a session starts with a BOS token
+    const bool add_bos = session->tokens.empty() &&
+                         llama_vocab_type(ctx) == LLAMA_VOCAB_TYPE_SPM;
+    std::vector<llama_token> embd =
+        tokenize_abi_safe(ctx, params.prompt, add_bos);
+
+    if ((int)(session->tokens.size() + embd.size()) > n_ctx - 4) {
+        fprintf(stderr,
+                "%s: error: session is too long (%d + %d tokens, max %d)\n",
+                __func__, (int)session->tokens.size(), (int)embd.size(),
+                n_ctx - 4);
+        return 1;
+    }
+
+    for (int i = 0; i < (int)embd.size(); i += params.n_batch) {
+        int n_eval = std::min((int)embd.size() - i, params.n_batch);
+        if (llama_eval(ctx, &embd[i], n_eval, (int)session->tokens.size(),
+                       params.n_threads)) {
+            fprintf(stderr, "%s : failed to eval\n", __func__);
+            return 1;
+        }
+        session->tokens.insert(session->tokens.end(), embd.begin() + i,
+                               embd.begin() + i + n_eval);
+    }
+
+    return 0;
+}
+
+int llama_session_eval(void *params_ptr, void *session_pr) {
+    gpt_params *params_p = (gpt_params *)params_ptr;
+    llama_binding_session *session = (llama_binding_session *)session_pr;
+
+    return session_eval_prompt(session, *params_p);
+}
+
+int llama_session_predict(void *params_ptr, void *session_pr, char *result,
+                          size_t result_size, bool debug) {
+    gpt_params *params_p = (gpt_params *)params_ptr;
+    llama_binding_session *session = (llama_binding_session *)session_pr;
+    llama_context *ctx = session->ctx;
+
+    gpt_params params = *params_p;
+    const int n_ctx = llama_n_ctx(ctx);
+
+    if (session_eval_prompt(session, params) != 0) {
+        return 1;
+    }
+
+    if (session->tokens.empty()) {
+        fprintf(stderr, "%s: error: nothing to continue from\n", __func__);
+        return 1;
+    }
+
+    struct llama_grammar *grammar = NULL;
+    grammar_parser::parse_state parsed_grammar;
+    if (!params.grammar.empty()) {
+        parsed_grammar = grammar_parser::parse(params.grammar.c_str());
+        if (parsed_grammar.rules.empty()) {
+            return 1;
+        }
+        std::vector<const llama_grammar_element *> grammar_rules(
+            parsed_grammar.c_rules());
+        grammar = llama_grammar_init(grammar_rules.data(), grammar_rules.size(),
+                                     parsed_grammar.symbol_ids.at("root"));
+    }
+
+    // repetition penalties look at the tail of the session history
+    std::vector<llama_token> last_tokens(n_ctx);
+    std::fill(last_tokens.begin(), last_tokens.end(), 0);
+    {
+        const size_t n = std::min(session->tokens.size(), last_tokens.size());
+        std::copy(session->tokens.end() - n, session->tokens.end(),
+                  last_tokens.end() - n);
+    }
+
+    if (params.seed != LLAMA_DEFAULT_SEED) {
+        llama_set_rng_seed(ctx, params.seed);
+    }
+
+    const int n_vocab = llama_n_vocab(ctx);
+    std::vector<llama_token_data> candidates;
+    candidates.reserve(n_vocab);
+
+    std::string res = "";
+    int n_remain = params.n_predict;
+
+    while (n_remain != 0) {
+        if ((int)session->tokens.size() >= n_ctx - 4) {
+            if (debug) {
+                fprintf(stderr, "%s: session context is full\n", __func__);
+            }
+            break;
+        }
+
+        const llama_token id = llama_sample_token_binding(
+            ctx, NULL, grammar, params_p, last_tokens, candidates);
+
+        last_tokens.erase(last_tokens.begin());
+        last_tokens.push_back(id);
+        --n_remain;
+
+        if (id == llama_token_eos(ctx)) {
+            break;
+        }
+
+        std::string token_str = token_to_piece_abi_safe(ctx, id);
+        if (debug) {
+            printf("%s", token_str.c_str());
+        }
+        res += token_str;
+
+        if (llama_eval(ctx, &id, 1, (int)session->tokens.size(),
+                       params.n_threads)) {
+            fprintf(stderr, "%s : failed to eval\n", __func__);
+            if (grammar != NULL) {
+                llama_grammar_free(grammar);
+            }
+            return 1;
+        }
+        session->tokens.push_back(id);
+
+        if (!tokenCallback(session_pr, const_cast<char *>(token_str.c_str()))) {
+            break;
+        }
+
+        bool is_antiprompt = false;
+        for (std::string &antiprompt : params.antiprompt) {
+            if (res.size() >= antiprompt.size() &&
+                res.compare(res.size() - antiprompt.size(), antiprompt.size(),
+                            antiprompt) == 0) {
+                is_antiprompt = true;
+                break;
+            }
+        }
+        if (is_antiprompt) {
+            break;
+        }
+    }
+
+    if (grammar != NULL) {
+        llama_grammar_free(grammar);
+    }
+
+    if (result_size > 0) {
+        strncpy(result, res.c_str(), result_size - 1);
+        result[result_size - 1] = '\0';
+    }
+    return 0;
+}
+
+// tokenize text the same way llama_predict tokenizes its prompt
+int llama_binding_tokenize_prompt(void *state_pr, const char *text, int *result,
+                                  int n_max) {
+    llama_binding_state *state = (llama_binding_state *)state_pr;
+    llama_context *ctx = state->ctx;
+
+    const bool add_bos = llama_vocab_type(ctx) == LLAMA_VOCAB_TYPE_SPM;
+
+    return llama_tokenize(ctx, text, strlen(text), result, n_max, add_bos);
+}
+
+size_t llama_binding_state_size(void *state_pr) {
+    llama_binding_state *state = (llama_binding_state *)state_pr;
+    return llama_get_state_size(state->ctx);
+}
+
+int llama_binding_n_ctx(void *state_pr) {
+    llama_binding_state *state = (llama_binding_state *)state_pr;
+    return llama_n_ctx(state->ctx);
+}
+
+int llama_binding_n_vocab(void *state_pr) {
+    llama_binding_state *state = (llama_binding_state *)state_pr;
+    return llama_n_vocab(state->ctx);
+}
+
+bool llama_binding_gpu_offload(void) {
+#ifdef BINDING_GPU_OFFLOAD
+    return true;
+#else
+    return false;
+#endif
+}
+
 std::vector<std::string> create_vector(const char **strings, int count) {
     std::vector<std::string> *vec = new std::vector<std::string>;
     for (int i = 0; i < count; i++) {
@@ -1199,16 +1770,34 @@ void *llama_allocate_params(
     return params;
 }
 
+// Reports loading progress to loadProgressCallback. When it answers 0 the
+// exception unwinds the llama.cpp loader, which frees the partially loaded
+// model and returns NULL.
+static void go_load_progress(float progress, void *user_data) {
+    if (!loadProgressCallback((uintptr_t)user_data, progress)) {
+        throw std::runtime_error("model loading cancelled");
+    }
+}
+
+static void set_load_progress(llama_context_params &params,
+                              uintptr_t progress) {
+    if (progress != 0) {
+        params.progress_callback = go_load_progress;
+        params.progress_callback_user_data = (void *)progress;
+    }
+}
+
 void *load_model(const char *fname, int n_ctx, int n_seed, bool memory_f16,
                  bool mlock, bool embeddings, bool mmap, bool low_vram,
                  int n_gpu_layers, int n_batch, const char *maingpu,
                  const char *tensorsplit, bool numa, float rope_freq_base,
                  float rope_freq_scale, bool mul_mat_q, const char *lora,
-                 const char *lora_base, bool perplexity) {
+                 const char *lora_base, bool perplexity, uintptr_t progress) {
     return load_binding_model(
         fname, n_ctx, n_seed, memory_f16, mlock, embeddings, mmap, low_vram,
         n_gpu_layers, n_batch, maingpu, tensorsplit, numa, rope_freq_base,
-        rope_freq_scale, mul_mat_q, lora, lora_base, perplexity);
+        rope_freq_scale, mul_mat_q, lora, lora_base, perplexity,
+        progress != 0 ? go_load_progress : NULL, (void *)progress);
 }
 
 void *load_binding_model_from_memory(
@@ -1216,7 +1805,8 @@ void *load_binding_model_from_memory(
     bool memory_f16, bool mlock, bool embeddings, bool mmap, bool low_vram,
     int n_gpu_layers, int n_batch, const char *maingpu, const char *tensorsplit,
     bool numa, float rope_freq_base, float rope_freq_scale, bool mul_mat_q,
-    const char *lora, const char *lora_base, bool perplexity) {
+    const char *lora, const char *lora_base, bool perplexity,
+    uintptr_t progress) {
     // Create gpt_params without model path
     gpt_params *lparams = new gpt_params;
 
@@ -1276,6 +1866,7 @@ void *load_binding_model_from_memory(
     // Create context params from gpt_params
     struct llama_context_params ctx_params =
         llama_context_params_from_gpt_params(*lparams);
+    set_load_progress(ctx_params, progress);
 
     // Load model from memory buffer
     fprintf(stderr, "%s: loading model from memory buffer (size: %zu bytes)\n",
@@ -1343,12 +1934,13 @@ void *load_model_from_memory(const void *buffer, size_t buffer_size, int n_ctx,
                              const char *tensorsplit, bool numa,
                              float rope_freq_base, float rope_freq_scale,
                              bool mul_mat_q, const char *lora,
-                             const char *lora_base, bool perplexity) {
+                             const char *lora_base, bool perplexity,
+                             uintptr_t progress) {
     return load_binding_model_from_memory(
         buffer, buffer_size, n_ctx, n_seed, memory_f16, mlock, embeddings, mmap,
         low_vram, n_gpu_layers, n_batch, maingpu, tensorsplit, numa,
         rope_freq_base, rope_freq_scale, mul_mat_q, lora, lora_base,
-        perplexity);
+        perplexity, progress);
 }
 
 // Zero-copy mmap wrapper
@@ -1359,7 +1951,8 @@ void *load_model_from_mmap(const void *addr, size_t size, int n_ctx, int n_seed,
                            const char *tensorsplit, bool numa,
                            float rope_freq_base, float rope_freq_scale,
                            bool mul_mat_q, const char *lora,
-                           const char *lora_base, bool perplexity) {
+                           const char *lora_base, bool perplexity,
+                           uintptr_t progress) {
     // Force mmap mode for zero-copy
     mmap = true;
 
@@ -1422,6 +2015,7 @@ void *load_model_from_mmap(const void *addr, size_t size, int n_ctx, int n_seed,
     // Create context params from gpt_params
     struct llama_context_params ctx_params =
         llama_context_params_from_gpt_params(*lparams);
+    set_load_progress(ctx_params, progress);
 
     // Load model using zero-copy mmap
     fprintf(
@@ -1485,6 +2079,106 @@ void *load_model_from_mmap(const void *addr, size_t size, int n_ctx, int n_seed,
     return state;
 }
 
+static size_t go_read_at(void *user_data, void *buffer, size_t offset,
+                         size_t size) {
+    return dataSourceReadAt((uintptr_t)user_data, buffer, offset, size);
+}
+
+void *load_model_from_source(uintptr_t source, size_t size, int n_ctx,
+                             int n_seed, bool memory_f16, bool mlock,
+                             bool embeddings, bool low_vram, int n_gpu_layers,
+                             int n_batch, const char *maingpu,
+                             const char *tensorsplit, bool numa,
+                             float rope_freq_base, float rope_freq_scale,
+                             bool mul_mat_q, const char *lora,
+                             const char *lora_base, bool perplexity,
+                             uintptr_t progress) {
+    gpt_params lparams;
+
+    lparams.n_ctx = n_ctx;
+    lparams.seed = n_seed;
+    lparams.memory_f16 = memory_f16;
+    lparams.embedding = embeddings;
+    lparams.use_mlock = mlock;
+    lparams.n_gpu_layers = n_gpu_layers;
+    lparams.perplexity = perplexity;
+    // tensor data is copied out of the source, there is nothing to map
+    lparams.use_mmap = false;
+    lparams.mul_mat_q = mul_mat_q;
+
+    lparams.low_vram = low_vram;
+    lparams.rope_freq_base =
+        rope_freq_base != 0.0f ? rope_freq_base : 10000.0f;
+    lparams.rope_freq_scale =
+        rope_freq_scale != 0.0f ? rope_freq_scale : 1.0f;
+
+    if (maingpu[0] != '\0') {
+        lparams.main_gpu = std::stoi(maingpu);
+    }
+
+    if (tensorsplit[0] != '\0') {
+        std::string arg_next = tensorsplit;
+        // split string by , and /
+        const std::regex regex{R"([,/]+)"};
+        std::sregex_token_iterator it{arg_next.begin(), arg_next.end(), regex,
+                                      -1};
+        std::vector<std::string> split_arg{it, {}};
+        GGML_ASSERT(split_arg.size() <= LLAMA_MAX_DEVICES);
+
+        for (size_t i = 0; i < LLAMA_MAX_DEVICES; ++i) {
+            if (i < split_arg.size()) {
+                lparams.tensor_split[i] = std::stof(split_arg[i]);
+            } else {
+                lparams.tensor_split[i] = 0.0f;
+            }
+        }
+    }
+
+    lparams.n_batch = n_batch;
+
+    llama_backend_init(numa);
+
+    struct llama_context_params ctx_params =
+        llama_context_params_from_gpt_params(lparams);
+    set_load_progress(ctx_params, progress);
+
+    llama_callback_source data_source(go_read_at, (void *)source, size);
+    llama_model *model = llama_load_model_from_source(
+        llama_data_source_read_at, &data_source, data_source.size(),
+        ctx_params);
+    if (model == nullptr) {
+        fprintf(stderr, "%s: error: failed loading model from data source\n",
+                __func__);
+        return nullptr;
+    }
+
+    llama_context *ctx = llama_new_context_with_model(model, ctx_params);
+    if (ctx == NULL) {
+        fprintf(stderr, "%s: error: failed to create context for model\n",
+                __func__);
+        llama_free_model(model);
+        return nullptr;
+    }
+
+    if (lora[0] != '\0') {
+        int err = llama_model_apply_lora_from_file(
+            model, lora, lora_base[0] != '\0' ? lora_base : NULL,
+            lparams.n_threads);
+        if (err != 0) {
+            fprintf(stderr, "%s: error: failed to apply lora adapter\n",
+                    __func__);
+            llama_free(ctx);
+            llama_free_model(model);
+            return nullptr;
+        }
+    }
+
+    llama_binding_state *state = new llama_binding_state;
+    state->model = model;
+    state->ctx = ctx;
+    return state;
+}
+
 // The load_binding_model implementation is now provided by the patched
 // common.cpp We just need to make sure our code uses the correct structure type
 
@@ -1494,7 +2188,8 @@ llama_sample_token_binding(struct llama_context *ctx,
                            struct llama_context *ctx_guidance,
                            struct llama_grammar *grammar, void *params_ptr,
                            const std::vector<llama_token> &last_tokens,
-                           std::vector<llama_token_data> &candidates, int idx) {
+                           std::vector<llama_token_data> &candidates, int idx,
+                           float *mirostat_mu) {
 
     gpt_params *g_params = (gpt_params *)params_ptr;
     struct gpt_params params = *g_params;
@@ -1573,18 +2268,20 @@ llama_sample_token_binding(struct llama_context *ctx,
         // Greedy sampling
         id = llama_sample_token_greedy(ctx, &cur_p);
     } else {
+        // callers that do not track mu themselves share a global one
+        static float mirostat_mu_v1 = 2.0f * mirostat_tau;
+        static float mirostat_mu_v2 = 2.0f * mirostat_tau;
         if (mirostat == 1) {
-            static float mirostat_mu = 2.0f * mirostat_tau;
             const int mirostat_m = 100;
             llama_sample_temperature(ctx, &cur_p, temp);
-            id = llama_sample_token_mirostat(ctx, &cur_p, mirostat_tau,
-                                             mirostat_eta, mirostat_m,
-                                             &mirostat_mu);
+            id = llama_sample_token_mirostat(
+                ctx, &cur_p, mirostat_tau, mirostat_eta, mirostat_m,
+                mirostat_mu != NULL ? mirostat_mu : &mirostat_mu_v1);
         } else if (mirostat == 2) {
-            static float mirostat_mu = 2.0f * mirostat_tau;
             llama_sample_temperature(ctx, &cur_p, temp);
-            id = llama_sample_token_mirostat_v2(ctx, &cur_p, mirostat_tau,
-                                                mirostat_eta, &mirostat_mu);
+            id = llama_sample_token_mirostat_v2(
+                ctx, &cur_p, mirostat_tau, mirostat_eta,
+                mirostat_mu != NULL ? mirostat_mu : &mirostat_mu_v2);
         } else {
             // Temperature sampling
             llama_sample_top_k(ctx, &cur_p, top_k, 1);
@@ -1,3 +1,6 @@
+#ifndef BINDING_H
+#define BINDING_H
+
 #ifdef __cplusplus
 #include <string>
 #include <vector>
@@ -5,6 +8,8 @@ extern "C" {
 #endif
 
 #include <stdbool.h>
+#include <stddef.h>
+#include <stdint.h>
 
 // Forward declaration for llama_load_model_from_buffer
 // NOTE: Currently not implemented in llama.cpp, using temporary file workaround
@@ -15,6 +20,41 @@ extern "C" {
 
 extern unsigned char tokenCallback(void *, char *);
 
+extern void contextShiftCallback(void *, int, int, int);
+
+extern int contextOverflowHook(void *, int *, int, int);
+
+extern int predictControl(void *);
+
+extern size_t dataSourceReadAt(uintptr_t, void *, size_t, size_t);
+
+extern int loadProgressCallback(uintptr_t, float);
+
+// What predictControl asks a running llama_predict to do
+enum llama_binding_control {
+    LLAMA_BINDING_CONTROL_CONTINUE = 0,
+    // save a checkpoint and return LLAMA_BINDING_SUSPENDED
+    LLAMA_BINDING_CONTROL_SUSPEND = 1,
+    // stop and return LLAMA_BINDING_INTERRUPTED with the output so far
+    LLAMA_BINDING_CONTROL_INTERRUPT = 2,
+};
+
+// What llama_predict does when the context is full
+enum llama_binding_overflow_policy {
+    // keep n_keep tokens and recompute half of the rest
+    LLAMA_BINDING_OVERFLOW_SHIFT_HALF = 0,
+    // stop and return LLAMA_BINDING_ERR_CONTEXT_FULL
+    LLAMA_BINDING_OVERFLOW_ERROR = 1,
+    // keep n_keep tokens and recompute the most recent overflow_window ones
+    LLAMA_BINDING_OVERFLOW_SLIDING_WINDOW = 2,
+    // let contextOverflowHook rewrite the tokens in the context
+    LLAMA_BINDING_OVERFLOW_HOOK = 3,
+};
+
+#define LLAMA_BINDING_ERR_CONTEXT_FULL 2
+#define LLAMA_BINDING_SUSPENDED 3
+#define LLAMA_BINDING_INTERRUPTED 4
+
 int load_state(void *ctx, char *statefile, char *modes);
 
 int eval(void *params_ptr, void *ctx, char *text);
@@ -26,7 +66,8 @@ void *load_model(const char *fname, int n_ctx, int n_seed, bool memory_f16,
                  int n_gpu, int n_batch, const char *maingpu,
                  const char *tensorsplit, bool numa, float rope_freq_base,
                  float rope_freq_scale, bool mul_mat_q, const char *lora,
-                 const char *lora_base, bool perplexity);
+                 const char *lora_base, bool perplexity,
+                 uintptr_t progress);
 
 void *load_model_from_memory(const void *buffer, size_t buffer_size, int n_ctx,
                              int n_seed, bool memory_f16, bool mlock,
@@ -35,7 +76,8 @@ void *load_model_from_memory(const void *buffer, size_t buffer_size, int n_ctx,
                              const char *tensorsplit, bool numa,
                              float rope_freq_base, float rope_freq_scale,
                              bool mul_mat_q, const char *lora,
-                             const char *lora_base, bool perplexity);
+                             const char *lora_base, bool perplexity,
+                             uintptr_t progress);
 
 // Zero-copy mmap loading - addr must remain valid for the model lifetime
 void *load_model_from_mmap(const void *addr, size_t size, int n_ctx,
@@ -45,7 +87,20 @@ void *load_model_from_mmap(const void *addr, size_t size, int n_ctx,
                            const char *tensorsplit, bool numa,
                            float rope_freq_base, float rope_freq_scale,
                            bool mul_mat_q, const char *lora,
-                           const char *lora_base, bool perplexity);
+                           const char *lora_base, bool perplexity,
+                           uintptr_t progress);
+
+// Loads a model read on demand through dataSourceReadAt, source is passed
+// back to it as the first argument
+void *load_model_from_source(uintptr_t source, size_t size, int n_ctx,
+                             int n_seed, bool memory_f16, bool mlock,
+                             bool embeddings, bool low_vram, int n_gpu,
+                             int n_batch, const char *maingpu,
+                             const char *tensorsplit, bool numa,
+                             float rope_freq_base, float rope_freq_scale,
+                             bool mul_mat_q, const char *lora,
+                             const char *lora_base, bool perplexity,
+                             uintptr_t progress);
 
 int get_embeddings(void *params_ptr, void *state_pr, float *res_embeddings);
 
@@ -75,8 +130,95 @@ void llama_binding_free_model(void *state);
 
 int llama_tokenize_string(void *params_ptr, void *state_pr, int *result);
 
+int llama_binding_tokenize_prompt(void *state_pr, const char *text, int *result,
+                                  int n_max);
+
+// Size of the state copied by llama_copy_state_data, of the context and of
+// the vocabulary of the model
+size_t llama_binding_state_size(void *state_pr);
+
+int llama_binding_n_ctx(void *state_pr);
+
+int llama_binding_n_vocab(void *state_pr);
+
+// Whether the binding was built with a GPU backend that layers are offloaded
+// to
+bool llama_binding_gpu_offload(void);
+
+// In-memory prompt cache exchanged with llama_predict. When state_in is set,
+// it is restored before the prompt is evaluated and tokens_in are reused like
+// the tokens of a session file. After the prompt has been evaluated, a copy of
+// the state and of the prompt tokens is returned in state_out/tokens_out if
+// store is set; it must be released with llama_binding_free_prompt_cache_out.
+typedef struct llama_binding_prompt_cache {
+    bool store;
+    const int *tokens_in;
+    int n_tokens_in;
+    const void *state_in;
+    size_t state_in_size;
+    int *tokens_out;
+    int n_tokens_out;
+    void *state_out;
+    size_t state_out_size;
+} llama_binding_prompt_cache;
+
+// State of a suspended llama_predict, taken right before the pending tokens
+// are evaluated. Checkpoints returned by llama_predict are allocated on the C
+// side and must be released with llama_binding_free_checkpoint.
+typedef struct llama_binding_checkpoint {
+    int n_past;
+    int n_remain;
+    int n_consumed;
+    float mirostat_mu;
+    // tokens of the prompt
+    int *prompt_tokens;
+    int n_prompt_tokens;
+    // tokens held in the context, one for each of n_past
+    int *ctx_tokens;
+    int n_ctx_tokens;
+    // repetition penalty window, n_ctx tokens
+    int *last_tokens;
+    int n_last_tokens;
+    // every sampled token, replayed to restore the grammar
+    int *sampled_tokens;
+    int n_sampled_tokens;
+    // tokens waiting to be evaluated
+    int *pending_tokens;
+    int n_pending_tokens;
+    // llama_copy_state_data, which includes the RNG
+    void *state;
+    size_t state_size;
+    char *output;
+} llama_binding_checkpoint;
+
 int llama_predict(void *params_ptr, void *state_pr, char *result,
-                  size_t result_size, bool debug);
+                  size_t result_size, bool debug, void *prompt_cache,
+                  int overflow_policy, int overflow_window,
+                  const void *checkpoint_in, void *checkpoint_out);
+
+void llama_binding_free_prompt_cache_out(void *prompt_cache);
+
+void llama_binding_free_checkpoint(void *checkpoint);
+
+// Creates an anonymous shared memory file with memfd_create, returns -1 where
+// it is not supported
+int llama_binding_memfd_create(const char *name);
+
+void *llama_binding_new_session(void *state_pr, int n_ctx, int n_seed,
+                                bool memory_f16, bool embeddings, int n_batch,
+                                float rope_freq_base, float rope_freq_scale,
+                                bool perplexity);
+
+void *llama_binding_fork_session(void *session_pr);
+
+void llama_binding_free_session(void *session_pr);
+
+int llama_session_n_past(void *session_pr);
+
+int llama_session_eval(void *params_ptr, void *session_pr);
+
+int llama_session_predict(void *params_ptr, void *session_pr, char *result,
+                          size_t result_size, bool debug);
 
 #ifdef __cplusplus
 }
@@ -84,3 +226,5 @@ int llama_predict(void *params_ptr, void *state_pr, char *result,
 std::vector<std::string> create_vector(const char **strings, int count);
 void delete_vector(std::vector<std::string> *vec);
 #endif
+
+#endif // BINDING_H
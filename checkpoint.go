@@ -0,0 +1,308 @@
+package llama
+
+// #include "binding.h"
+// #include <stdlib.h>
+import "C"
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"unsafe"
+)
+
+const (
+	checkpointMagic   = "LLCK"
+	checkpointVersion = 1
+)
+
+// ErrCheckpointMismatch is returned by Resume when the checkpoint was saved by
+// a different model, or by the same model loaded with different context
+// options.
+var ErrCheckpointMismatch = errors.New("checkpoint was saved by a different model")
+
+// ErrInvalidCheckpoint is returned by Resume when the checkpoint is damaged
+// or does not fit the context of the model.
+var ErrInvalidCheckpoint = errors.New("invalid checkpoint")
+
+// ErrSuspended is returned by Predict when the prediction was suspended.
+// PredictWithResult returns the Checkpoint to resume it with instead.
+var ErrSuspended = errors.New("prediction was suspended")
+
+// GenerationCheckpoint holds everything needed to carry on a suspended
+// prediction: the KV cache and RNG of the context, the mirostat state, the
+// repetition penalty window, the tokens accepted by the grammar and the text
+// generated so far. It can be serialized with MarshalBinary and resumed by
+// another process that loaded the same model.
+type GenerationCheckpoint struct {
+	fingerprint string
+	prompt      string
+	output      string
+
+	nPast      int32
+	nRemain    int32
+	nConsumed  int32
+	mirostatMu float32
+
+	promptTokens  []int32
+	ctxTokens     []int32
+	lastTokens    []int32
+	sampledTokens []int32
+	pendingTokens []int32
+
+	state []byte
+}
+
+// Suspend asks the prediction running on the model to stop before its next
+// evaluation. The prediction then returns the text generated so far, with a
+// Checkpoint that can be passed to Resume. It returns false if no prediction
+// is running, the model is closed or the prediction uses a negative prompt,
+// which can not be suspended.
+func (l *LLama) Suspend() bool {
+	done, err := l.use()
+	if err != nil {
+		return false
+	}
+	defer done()
+
+	h := getPredictHooks(l.state)
+	if h == nil || h.guided {
+		return false
+	}
+	h.suspend.Store(true)
+	return true
+}
+
+// Resume carries on a suspended prediction. The options should be the ones
+// the prediction was started with: with the same seed the resumed prediction
+// generates exactly what the uninterrupted one would have.
+func (l *LLama) Resume(checkpoint *GenerationCheckpoint, opts ...PredictOption) (*PredictResult, error) {
+	if checkpoint.fingerprint != l.fingerprint {
+		return nil, ErrCheckpointMismatch
+	}
+	return l.predict(checkpoint.prompt, checkpoint, NewPredictOptions(opts...))
+}
+
+// Interrupt stops the prediction running on the model before its next
+// evaluation. The prediction returns the text generated so far with a
+// StopReason of StopInterrupted, and the model can be used again right away.
+// It returns false if no prediction is running or the model is closed.
+//
+// The binding installs no signal handler, so Interrupt is the way to stop a
+// generation on Ctrl-C from a goroutine receiving from signal.Notify.
+func (l *LLama) Interrupt() bool {
+	done, err := l.use()
+	if err != nil {
+		return false
+	}
+	defer done()
+
+	h := getPredictHooks(l.state)
+	if h == nil {
+		return false
+	}
+	h.interrupt.Store(true)
+	return true
+}
+
+// validate checks that the checkpoint fits the context of the model, so that
+// a damaged or forged one never reaches llama_set_state_data.
+func (c *GenerationCheckpoint) validate(state unsafe.Pointer) error {
+	stateSize := int(C.llama_binding_state_size(state))
+	nCtx := int(C.llama_binding_n_ctx(state))
+	nVocab := int32(C.llama_binding_n_vocab(state))
+
+	switch {
+	case len(c.state) != stateSize:
+		return fmt.Errorf("%w: state is %d bytes, not %d", ErrInvalidCheckpoint, len(c.state), stateSize)
+	case c.nPast < 0 || int(c.nPast) > nCtx || int(c.nPast) != len(c.ctxTokens):
+		return fmt.Errorf("%w: %d tokens past with %d in a context of %d", ErrInvalidCheckpoint, c.nPast, len(c.ctxTokens), nCtx)
+	case c.nConsumed < 0 || int(c.nConsumed) > len(c.promptTokens):
+		return fmt.Errorf("%w: %d of %d prompt tokens consumed", ErrInvalidCheckpoint, c.nConsumed, len(c.promptTokens))
+	case c.nRemain < -1:
+		return fmt.Errorf("%w: %d tokens remain", ErrInvalidCheckpoint, c.nRemain)
+	case len(c.lastTokens) != nCtx:
+		return fmt.Errorf("%w: %d last tokens in a context of %d", ErrInvalidCheckpoint, len(c.lastTokens), nCtx)
+	}
+	for _, tokens := range [][]int32{c.promptTokens, c.ctxTokens, c.lastTokens, c.sampledTokens, c.pendingTokens} {
+		for _, t := range tokens {
+			if t < 0 || t >= nVocab {
+				return fmt.Errorf("%w: token %d is not in the vocabulary of %d", ErrInvalidCheckpoint, t, nVocab)
+			}
+		}
+	}
+	return nil
+}
+
+//export predictControl
+func predictControl(statePtr unsafe.Pointer) C.int {
+	h := getPredictHooks(statePtr)
+	if h == nil {
+		return C.LLAMA_BINDING_CONTROL_CONTINUE
+	}
+	if h.interrupt.Load() {
+		return C.LLAMA_BINDING_CONTROL_INTERRUPT
+	}
+	if h.suspend.Load() {
+		return C.LLAMA_BINDING_CONTROL_SUSPEND
+	}
+	return C.LLAMA_BINDING_CONTROL_CONTINUE
+}
+
+// toC builds the C view of the checkpoint, pointing to its pinned slices.
+// The returned struct must be freed once llama_predict returns.
+func (c *GenerationCheckpoint) toC(pin *runtime.Pinner) *C.llama_binding_checkpoint {
+	cp := (*C.llama_binding_checkpoint)(C.calloc(1, C.sizeof_llama_binding_checkpoint))
+	cp.n_past = C.int(c.nPast)
+	cp.n_remain = C.int(c.nRemain)
+	cp.n_consumed = C.int(c.nConsumed)
+	cp.mirostat_mu = C.float(c.mirostatMu)
+	cp.prompt_tokens, cp.n_prompt_tokens = pinTokens(pin, c.promptTokens)
+	cp.ctx_tokens, cp.n_ctx_tokens = pinTokens(pin, c.ctxTokens)
+	cp.last_tokens, cp.n_last_tokens = pinTokens(pin, c.lastTokens)
+	cp.sampled_tokens, cp.n_sampled_tokens = pinTokens(pin, c.sampledTokens)
+	cp.pending_tokens, cp.n_pending_tokens = pinTokens(pin, c.pendingTokens)
+
+	// the output is read as a C string, so it needs its terminator
+	output := append([]byte(c.output), 0)
+	pin.Pin(&output[0])
+	cp.output = (*C.char)(unsafe.Pointer(&output[0]))
+
+	pin.Pin(&c.state[0])
+	cp.state = unsafe.Pointer(&c.state[0])
+	cp.state_size = C.size_t(len(c.state))
+	return cp
+}
+
+func pinTokens(pin *runtime.Pinner, tokens []int32) (*C.int, C.int) {
+	if len(tokens) == 0 {
+		return nil, 0
+	}
+	pin.Pin(&tokens[0])
+	return (*C.int)(unsafe.Pointer(&tokens[0])), C.int(len(tokens))
+}
+
+func checkpointFromC(cp *C.llama_binding_checkpoint, fingerprint, prompt string) *GenerationCheckpoint {
+	return &GenerationCheckpoint{
+		fingerprint:   fingerprint,
+		prompt:        prompt,
+		output:        C.GoString(cp.output),
+		nPast:         int32(cp.n_past),
+		nRemain:       int32(cp.n_remain),
+		nConsumed:     int32(cp.n_consumed),
+		mirostatMu:    float32(cp.mirostat_mu),
+		promptTokens:  goTokens(cp.prompt_tokens, cp.n_prompt_tokens),
+		ctxTokens:     goTokens(cp.ctx_tokens, cp.n_ctx_tokens),
+		lastTokens:    goTokens(cp.last_tokens, cp.n_last_tokens),
+		sampledTokens: goTokens(cp.sampled_tokens, cp.n_sampled_tokens),
+		pendingTokens: goTokens(cp.pending_tokens, cp.n_pending_tokens),
+		state:         C.GoBytes(cp.state, C.int(cp.state_size)),
+	}
+}
+
+func goTokens(tokens *C.int, n C.int) []int32 {
+	if n == 0 {
+		return nil
+	}
+	return append([]int32(nil), unsafe.Slice((*int32)(unsafe.Pointer(tokens)), int(n))...)
+}
+
+// MarshalBinary encodes the checkpoint so that it can be stored or sent to
+// another process.
+func (c *GenerationCheckpoint) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(checkpointMagic)
+
+	w := func(v any) {
+		binary.Write(&buf, binary.LittleEndian, v)
+	}
+	w(uint32(checkpointVersion))
+	for _, s := range []string{c.fingerprint, c.prompt, c.output} {
+		w(uint32(len(s)))
+		buf.WriteString(s)
+	}
+	w([]int32{c.nPast, c.nRemain, c.nConsumed})
+	w(c.mirostatMu)
+	for _, tokens := range [][]int32{c.promptTokens, c.ctxTokens, c.lastTokens, c.sampledTokens, c.pendingTokens} {
+		w(uint32(len(tokens)))
+		w(tokens)
+	}
+	w(uint64(len(c.state)))
+	buf.Write(c.state)
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a checkpoint encoded with MarshalBinary.
+func (c *GenerationCheckpoint) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+
+	magic := make([]byte, len(checkpointMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != checkpointMagic {
+		return fmt.Errorf("not a generation checkpoint")
+	}
+
+	var version uint32
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
+		return fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	if version != checkpointVersion {
+		return fmt.Errorf("unsupported checkpoint version %d", version)
+	}
+
+	var out GenerationCheckpoint
+	for _, s := range []*string{&out.fingerprint, &out.prompt, &out.output} {
+		b, err := readCheckpointBytes[uint32](r)
+		if err != nil {
+			return err
+		}
+		*s = string(b)
+	}
+
+	counters := make([]int32, 3)
+	if err := binary.Read(r, binary.LittleEndian, counters); err != nil {
+		return fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	out.nPast, out.nRemain, out.nConsumed = counters[0], counters[1], counters[2]
+	if err := binary.Read(r, binary.LittleEndian, &out.mirostatMu); err != nil {
+		return fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+
+	for _, tokens := range []*[]int32{&out.promptTokens, &out.ctxTokens, &out.lastTokens, &out.sampledTokens, &out.pendingTokens} {
+		var n uint32
+		if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+			return fmt.Errorf("failed to read checkpoint: %w", err)
+		}
+		if int64(n)*4 > int64(r.Len()) {
+			return fmt.Errorf("checkpoint is truncated")
+		}
+		*tokens = make([]int32, n)
+		if err := binary.Read(r, binary.LittleEndian, *tokens); err != nil {
+			return fmt.Errorf("failed to read checkpoint: %w", err)
+		}
+	}
+
+	state, err := readCheckpointBytes[uint64](r)
+	if err != nil {
+		return err
+	}
+	out.state = state
+
+	*c = out
+	return nil
+}
+
+func readCheckpointBytes[T uint32 | uint64](r *bytes.Reader) ([]byte, error) {
+	var n T
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return nil, fmt.Errorf("failed to read checkpoint: %w", err)
+	}
+	if uint64(n) > uint64(r.Len()) {
+		return nil, fmt.Errorf("checkpoint is truncated")
+	}
+	b := make([]byte, n)
+	io.ReadFull(r, b)
+	return b, nil
+}
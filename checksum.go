@@ -0,0 +1,312 @@
+package llama
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-skynet/go-llama.cpp/pack"
+)
+
+// ChecksumExt is appended to the name of a model for the file holding its
+// SHA-256, as written by sha256sum.
+const ChecksumExt = ".sha256"
+
+// ErrChecksumMismatch is returned when a model does not have the SHA-256 set
+// with SetExpectedSHA256 or written next to it.
+var ErrChecksumMismatch = pack.ErrChecksum
+
+var (
+	errChecksumCanceled = errors.New("checksum canceled")
+	errNoChecksumFile   = errors.New("SetVerifySHA256File only applies to models loaded from files, see SetExpectedSHA256")
+	errShardChecksum    = errors.New("a model split in shards has no single SHA-256, see SetVerifySHA256File")
+)
+
+// expectedChecksum returns the SHA-256 the model at path must have, set with
+// SetExpectedSHA256 or else read from the file next to it when mo asks for
+// it, or nil when there is none.
+func expectedChecksum(mo ModelOptions, path string) ([]byte, error) {
+	text := mo.ExpectedSHA256
+	if text == "" && mo.VerifySHA256File && path != "" {
+		b, err := os.ReadFile(path + ChecksumExt)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(string(b))
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("%s is empty", path+ChecksumExt)
+		}
+		// sha256sum starts the line with a backslash for escaped names
+		text = strings.TrimPrefix(fields[0], `\`)
+	}
+	if text == "" {
+		return nil, nil
+	}
+	sum, err := hex.DecodeString(text)
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 %q", text)
+	}
+	return sum, nil
+}
+
+// checksumCheck hashes a model in the background while it is loaded.
+type checksumCheck struct {
+	stop atomic.Bool
+	done chan struct{}
+	err  error
+}
+
+// startChecksum starts hashing the model read from model, and calls done
+// with the result once it is compared to expected.
+func startChecksum(expected []byte, model io.Reader, done func(err error)) *checksumCheck {
+	c := &checksumCheck{done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		h := sha256.New()
+		if _, err := io.Copy(h, stopReader{model, &c.stop}); err != nil {
+			c.err = fmt.Errorf("failed to hash the model: %w", err)
+		} else if sum := h.Sum(nil); !bytes.Equal(sum, expected) {
+			c.err = fmt.Errorf("%w: SHA-256 is %x, expected %x", ErrChecksumMismatch, sum, expected)
+		}
+		if done != nil {
+			done(c.err)
+		}
+	}()
+	return c
+}
+
+// startReaderChecksum starts verifying the model read from model, which is
+// not a file, when mo expects a SHA-256, and returns nil otherwise.
+func startReaderChecksum(mo ModelOptions, model io.Reader) (*checksumCheck, error) {
+	if mo.VerifySHA256File {
+		return nil, errNoChecksumFile
+	}
+	expected, err := expectedChecksum(mo, "")
+	if expected == nil || err != nil {
+		return nil, err
+	}
+	return startChecksum(expected, loadReader(mo, model), nil), nil
+}
+
+// startFileChecksum starts verifying the model file at path when mo expects
+// a SHA-256 for it, and returns nil otherwise or when the file was verified
+// already and has not changed since.
+func startFileChecksum(mo ModelOptions, path string) (*checksumCheck, error) {
+	expected, err := expectedChecksum(mo, path)
+	if expected == nil || err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		// loading reports the file as missing
+		return nil, nil
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if sum := cachedChecksum(path, info); sum != nil {
+		f.Close()
+		if !bytes.Equal(sum, expected) {
+			return nil, fmt.Errorf("%w: SHA-256 is %x, expected %x", ErrChecksumMismatch, sum, expected)
+		}
+		return nil, nil
+	}
+	return startChecksum(expected, loadReader(mo, bufio.NewReaderSize(f, 1<<20)), func(err error) {
+		f.Close()
+		if err == nil {
+			storeChecksum(path, info, expected)
+		}
+	}), nil
+}
+
+// startShardChecksums starts verifying every shard of a model against the
+// SHA-256 next to it when mo asks for it. A split model has no single SHA-256
+// to set with SetExpectedSHA256.
+func startShardChecksums(mo ModelOptions, paths []string) (checksumChecks, error) {
+	if mo.ExpectedSHA256 != "" {
+		return nil, errShardChecksum
+	}
+	var checks checksumChecks
+	for i, path := range paths {
+		check, err := startFileChecksum(mo, path)
+		if err != nil {
+			checks.cancel()
+			return nil, fmt.Errorf("shard %d: %w", i+1, err)
+		}
+		checks = append(checks, check)
+	}
+	return checks, nil
+}
+
+// wait returns the result of the check, nil without one.
+func (c *checksumCheck) wait() error {
+	if c == nil {
+		return nil
+	}
+	<-c.done
+	return c.err
+}
+
+// cancel stops the check and waits for it to return.
+func (c *checksumCheck) cancel() {
+	if c == nil {
+		return
+	}
+	c.stop.Store(true)
+	<-c.done
+}
+
+// checker is a check running while a model loads, or several.
+type checker interface {
+	wait() error
+	cancel()
+}
+
+// checksumChecks are the checks of the shards a model is loaded from.
+type checksumChecks []*checksumCheck
+
+func (cs checksumChecks) wait() error {
+	var errs []error
+	for i, c := range cs {
+		if err := c.wait(); err != nil {
+			if len(cs) > 1 {
+				err = fmt.Errorf("shard %d: %w", i+1, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (cs checksumChecks) cancel() {
+	for _, c := range cs {
+		c.cancel()
+	}
+}
+
+type stopReader struct {
+	r    io.Reader
+	stop *atomic.Bool
+}
+
+func (s stopReader) Read(p []byte) (int, error) {
+	if s.stop.Load() {
+		return 0, errChecksumCanceled
+	}
+	return s.r.Read(p)
+}
+
+// The SHA-256 of verified model files is cached in the user cache directory,
+// one file per model path holding its size, modification time and hash, so
+// that a model is not hashed again every time it is loaded. A file that is
+// modified keeping both its size and modification time is not hashed again.
+func checksumCachePath(path string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return ""
+	}
+	key := sha256.Sum256([]byte(abs))
+	return filepath.Join(dir, "go-llama.cpp", "sha256", hex.EncodeToString(key[:]))
+}
+
+// cachedChecksum returns the SHA-256 verified for the file at path, if it
+// has not changed since.
+func cachedChecksum(path string, info os.FileInfo) []byte {
+	cachePath := checksumCachePath(path)
+	if cachePath == "" {
+		return nil
+	}
+	b, err := os.ReadFile(cachePath)
+	if err != nil {
+		return nil
+	}
+	var size, mtime int64
+	var text string
+	if _, err := fmt.Sscanf(string(b), "%d %d %s", &size, &mtime, &text); err != nil {
+		return nil
+	}
+	if size != info.Size() || mtime != info.ModTime().UnixNano() {
+		return nil
+	}
+	sum, err := hex.DecodeString(text)
+	if err != nil || len(sum) != sha256.Size {
+		return nil
+	}
+	return sum
+}
+
+// storeChecksum records sum as verified for the file at path, as it was
+// described by info, unless it changed while it was hashed. Failing to is
+// not an error, the file is hashed again next time.
+func storeChecksum(path string, info os.FileInfo, sum []byte) {
+	cachePath := checksumCachePath(path)
+	if cachePath == "" {
+		return
+	}
+	if now, err := os.Stat(path); err != nil || now.Size() != info.Size() || !now.ModTime().Equal(info.ModTime()) {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0o755); err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(cachePath), ".*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, werr := fmt.Fprintf(tmp, "%d %d %x\n", info.Size(), info.ModTime().UnixNano(), sum)
+	if err := tmp.Close(); err != nil || werr != nil {
+		return
+	}
+	os.Rename(tmp.Name(), cachePath)
+}
+
+// failedLoadCheckWait is how long a failed load waits for the check to
+// explain it before canceling it, hashing a large model takes as long as
+// reading it.
+const failedLoadCheckWait = time.Second
+
+// checkFailedLoad returns the error of a load that failed along with the
+// result of the check if it finishes soon enough, which may explain it.
+func checkFailedLoad(c checker, err error) error {
+	if errors.Is(err, ErrLoadCanceled) {
+		c.cancel()
+		return err
+	}
+
+	result := make(chan error, 1)
+	go func() { result <- c.wait() }()
+	timer := time.NewTimer(failedLoadCheckWait)
+	defer timer.Stop()
+
+	var cerr error
+	select {
+	case cerr = <-result:
+	case <-timer.C:
+		c.cancel()
+		cerr = <-result
+	}
+	if cerr != nil && !errors.Is(cerr, errChecksumCanceled) {
+		return fmt.Errorf("%w - %w", err, cerr)
+	}
+	return err
+}
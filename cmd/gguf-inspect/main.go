@@ -0,0 +1,181 @@
+// Command gguf-inspect prints the metadata, tensors and layout of GGUF model
+// files, and checks their integrity.
+//
+//	gguf-inspect [-q] [-tensors] [-array-limit n] model.gguf...
+//
+// It exits with status 1 when a file can not be read or fails validation,
+// printing one diagnostic per problem, so that it can gate model uploads.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/go-skynet/go-llama.cpp/gguf"
+)
+
+func main() {
+	var quiet, tensors bool
+	var arrayLimit int
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags.BoolVar(&quiet, "q", false, "only validate, printing nothing but problems")
+	flags.BoolVar(&tensors, "tensors", false, "print every tensor")
+	flags.IntVar(&arrayLimit, "array-limit", 8, "number of array elements to print, -1 for all")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s [flags] model.gguf...\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, path := range flags.Args() {
+		f, err := gguf.Open(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			failed = true
+			continue
+		}
+		if !quiet {
+			inspect(os.Stdout, path, f, tensors, arrayLimit)
+		}
+		for _, problem := range f.Validate() {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, problem)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func inspect(w io.Writer, path string, f *gguf.File, tensors bool, arrayLimit int) {
+	fmt.Fprintf(w, "%s: GGUF version %d, %s\n", path, f.Version, f.ByteOrder)
+
+	fmt.Fprintf(w, "\nmetadata (%d keys):\n", len(f.KV))
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, kv := range f.KV {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\n", kv.Key, typeName(kv), formatValue(kv.Value, arrayLimit))
+	}
+	tw.Flush()
+
+	var params int64
+	var dataSize int64
+	type mix struct {
+		count int
+		size  int64
+	}
+	types := map[gguf.GGMLType]*mix{}
+	for _, t := range f.Tensors {
+		size, _ := t.Size()
+		params += max(t.Elements(), 0)
+		dataSize += size
+		if types[t.Type] == nil {
+			types[t.Type] = &mix{}
+		}
+		types[t.Type].count++
+		types[t.Type].size += size
+	}
+
+	fmt.Fprintf(w, "\ntensors: %d, parameters: %s\n", len(f.Tensors), formatCount(params))
+	fmt.Fprintln(w, "quantization mix:")
+	order := make([]gguf.GGMLType, 0, len(types))
+	for typ := range types {
+		order = append(order, typ)
+	}
+	sort.Slice(order, func(i, j int) bool { return types[order[i]].size > types[order[j]].size })
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	for _, typ := range order {
+		m := types[typ]
+		share := 0.0
+		if dataSize > 0 {
+			share = 100 * float64(m.size) / float64(dataSize)
+		}
+		fmt.Fprintf(tw, "  %s\t%d tensors\t%s\t%.1f%%\t\n", typ, m.count, formatBytes(m.size), share)
+	}
+	tw.Flush()
+
+	if tensors {
+		fmt.Fprintln(w, "\ntensor table:")
+		tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "  name\ttype\tshape\toffset\tsize")
+		for _, t := range f.Tensors {
+			size, err := t.Size()
+			sizeText := formatBytes(size)
+			if err != nil {
+				sizeText = "?"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%v\t%d\t%s\n", t.Name, t.Type, t.Shape, f.DataOffset+int64(t.Offset), sizeText)
+		}
+		tw.Flush()
+	}
+
+	fmt.Fprintln(w, "\nlayout:")
+	tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "  header\t0 - %d\t%s\n", f.DataOffset, formatBytes(f.DataOffset))
+	fmt.Fprintf(tw, "  tensor data\t%d - %d\t%s\n", f.DataOffset, f.Size, formatBytes(f.Size-f.DataOffset))
+	fmt.Fprintf(tw, "  alignment\t%d\t\n", f.Alignment)
+	fmt.Fprintf(tw, "  padding and unused\t\t%s\n", formatBytes(f.Size-f.DataOffset-dataSize))
+	tw.Flush()
+}
+
+func typeName(kv gguf.KV) string {
+	if a, ok := kv.Value.(gguf.Array); ok {
+		return fmt.Sprintf("[%d]%s", len(a.Values), a.Type)
+	}
+	return kv.Type.String()
+}
+
+func formatValue(v any, arrayLimit int) string {
+	switch v := v.(type) {
+	case string:
+		s := []rune(fmt.Sprintf("%q", v))
+		if arrayLimit >= 0 && len(s) > 80 {
+			return string(s[:77]) + "..."
+		}
+		return string(s)
+	case gguf.Array:
+		values := v.Values
+		more := ""
+		if arrayLimit >= 0 && len(values) > arrayLimit {
+			values, more = values[:arrayLimit], fmt.Sprintf(" ... %d more", len(v.Values)-arrayLimit)
+		}
+		parts := make([]string, len(values))
+		for i, elem := range values {
+			parts[i] = formatValue(elem, arrayLimit)
+		}
+		return "[" + strings.Join(parts, " ") + more + "]"
+	}
+	return fmt.Sprint(v)
+}
+
+func formatCount(n int64) string {
+	switch {
+	case n >= 1e9:
+		return fmt.Sprintf("%.2fB", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.2fM", float64(n)/1e6)
+	}
+	return fmt.Sprint(n)
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.2f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.2f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.2f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
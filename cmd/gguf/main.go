@@ -0,0 +1,223 @@
+// Command gguf edits the metadata of GGUF model files without touching
+// their tensors, and signs them.
+//
+//	gguf edit [-o output] [-set key=[type:]value]... [-set-file key=path]... [-delete key]... model.gguf
+//	gguf keygen name
+//	gguf sign -key name.key model.gguf...
+//	gguf verify -pub name.pub... model.gguf...
+//
+// Values set on an existing key keep its type unless a type prefix such as
+// uint32: is given, new keys are strings by default. Without -o the model
+// is replaced in place.
+//
+// keygen writes a new ed25519 key pair to name.key and name.pub. sign writes
+// the signature of every model next to it, with .sig appended to its name,
+// to be checked by SetRequireSignature or verify.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-skynet/go-llama.cpp/gguf"
+)
+
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ", ") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "edit":
+		err = edit(os.Args[2:])
+	case "keygen":
+		err = keygen(os.Args[2:])
+	case "sign":
+		err = sign(os.Args[2:])
+	case "verify":
+		err = verify(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "gguf: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gguf edit [-o output] [-set key=[type:]value]... [-set-file key=path]... [-delete key]... model.gguf")
+	fmt.Fprintln(os.Stderr, "       gguf keygen name")
+	fmt.Fprintln(os.Stderr, "       gguf sign -key name.key model.gguf...")
+	fmt.Fprintln(os.Stderr, "       gguf verify -pub name.pub... model.gguf...")
+	os.Exit(2)
+}
+
+func edit(args []string) error {
+	var sets, setFiles, deletes stringList
+	var output string
+
+	flags := flag.NewFlagSet("gguf edit", flag.ExitOnError)
+	flags.Var(&sets, "set", "set `key=[type:]value`, can be repeated")
+	flags.Var(&setFiles, "set-file", "set `key=path` to the content of a file as a string, for example a chat template")
+	flags.Var(&deletes, "delete", "delete `key`, can be repeated")
+	flags.StringVar(&output, "o", "", "write the edited model to `path` instead of replacing it")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	path := flags.Arg(0)
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	f, err := gguf.Read(src, info.Size())
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	for _, key := range deletes {
+		if !f.Delete(key) {
+			return fmt.Errorf("%s is not set", key)
+		}
+	}
+	for _, set := range sets {
+		key, value, ok := strings.Cut(set, "=")
+		if !ok {
+			return fmt.Errorf("invalid -set %q, expected key=value", set)
+		}
+		typ, v, err := parseValue(f, key, value)
+		if err != nil {
+			return err
+		}
+		if err := f.Set(key, typ, v); err != nil {
+			return err
+		}
+	}
+	for _, set := range setFiles {
+		key, file, ok := strings.Cut(set, "=")
+		if !ok {
+			return fmt.Errorf("invalid -set-file %q, expected key=path", set)
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := f.Set(key, gguf.TypeString, string(data)); err != nil {
+			return err
+		}
+	}
+
+	if output == "" {
+		output = path
+	}
+	// write next to the output and rename, so that a failure leaves it as is
+	tmp, err := os.CreateTemp(filepath.Dir(output), "."+filepath.Base(output)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := gguf.Rewrite(tmp, src, f); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), output)
+}
+
+var valueTypes = map[string]gguf.ValueType{}
+
+func init() {
+	for t := gguf.TypeUint8; t <= gguf.TypeFloat64; t++ {
+		if t != gguf.TypeArray {
+			valueTypes[t.String()] = t
+		}
+	}
+}
+
+// parseValue parses the value of a -set flag, typed by its prefix, by the
+// current value of key or as a string.
+func parseValue(f *gguf.File, key, value string) (gguf.ValueType, any, error) {
+	typ := gguf.TypeString
+	name, rest, _ := strings.Cut(value, ":")
+	if t, ok := valueTypes[name]; ok {
+		typ, value = t, rest
+	} else if kv, ok := f.Lookup(key); ok {
+		if kv.Type == gguf.TypeArray {
+			return 0, nil, fmt.Errorf("%s is an array, which can not be set", key)
+		}
+		typ = kv.Type
+	}
+
+	var v any
+	var err error
+	switch typ {
+	case gguf.TypeString:
+		v = value
+	case gguf.TypeBool:
+		v, err = strconv.ParseBool(value)
+	case gguf.TypeFloat32:
+		var x float64
+		x, err = strconv.ParseFloat(value, 32)
+		v = float32(x)
+	case gguf.TypeFloat64:
+		v, err = strconv.ParseFloat(value, 64)
+	case gguf.TypeUint8:
+		var x uint64
+		x, err = strconv.ParseUint(value, 0, 8)
+		v = uint8(x)
+	case gguf.TypeUint16:
+		var x uint64
+		x, err = strconv.ParseUint(value, 0, 16)
+		v = uint16(x)
+	case gguf.TypeUint32:
+		var x uint64
+		x, err = strconv.ParseUint(value, 0, 32)
+		v = uint32(x)
+	case gguf.TypeUint64:
+		v, err = strconv.ParseUint(value, 0, 64)
+	case gguf.TypeInt8:
+		var x int64
+		x, err = strconv.ParseInt(value, 0, 8)
+		v = int8(x)
+	case gguf.TypeInt16:
+		var x int64
+		x, err = strconv.ParseInt(value, 0, 16)
+		v = int16(x)
+	case gguf.TypeInt32:
+		var x int64
+		x, err = strconv.ParseInt(value, 0, 32)
+		v = int32(x)
+	case gguf.TypeInt64:
+		v, err = strconv.ParseInt(value, 0, 64)
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid %s value for %s: %w", typ, key, err)
+	}
+	return typ, v, nil
+}
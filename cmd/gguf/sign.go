@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/go-skynet/go-llama.cpp/pack"
+)
+
+// keygen writes a new signing key pair to name.key and name.pub.
+func keygen(args []string) error {
+	flags := flag.NewFlagSet("gguf keygen", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	name := flags.Arg(0)
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(name + ".key"); err == nil {
+		return fmt.Errorf("%s.key exists already", name)
+	}
+	if err := pack.WritePrivateKey(name+".key", priv); err != nil {
+		return err
+	}
+	if err := pack.WritePublicKey(name+".pub", pub); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %s.key and %s.pub\n", name, name)
+	return nil
+}
+
+// sign writes the signatures of models next to them.
+func sign(args []string) error {
+	var keyPath string
+	flags := flag.NewFlagSet("gguf sign", flag.ExitOnError)
+	flags.StringVar(&keyPath, "key", "", "sign with the private key in `file`")
+	flags.Parse(args)
+	if flags.NArg() == 0 || keyPath == "" {
+		usage()
+	}
+	key, err := pack.ReadPrivateKey(keyPath)
+	if err != nil {
+		return err
+	}
+
+	for _, path := range flags.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		sig, err := pack.Sign(key, bufio.NewReaderSize(f, 1<<20))
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if err := pack.WriteSignature(path+pack.SignatureExt, sig); err != nil {
+			return err
+		}
+		fmt.Printf("wrote %s%s\n", path, pack.SignatureExt)
+	}
+	return nil
+}
+
+// verify checks the signatures next to models.
+func verify(args []string) error {
+	var pubPaths stringList
+	flags := flag.NewFlagSet("gguf verify", flag.ExitOnError)
+	flags.Var(&pubPaths, "pub", "trust the public key in `file`, can be repeated")
+	flags.Parse(args)
+	if flags.NArg() == 0 || len(pubPaths) == 0 {
+		usage()
+	}
+	var keys []ed25519.PublicKey
+	for _, path := range pubPaths {
+		key, err := pack.ReadPublicKey(path)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+
+	failed := false
+	for _, path := range flags.Args() {
+		err := verifyFile(path, keys)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			failed = true
+			continue
+		}
+		fmt.Printf("%s: signature verified\n", path)
+	}
+	if failed {
+		os.Exit(1)
+	}
+	return nil
+}
+
+func verifyFile(path string, keys []ed25519.PublicKey) error {
+	sig, err := pack.ReadSignature(path + pack.SignatureExt)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pack.VerifySignature(bufio.NewReaderSize(f, 1<<20), sig, keys...)
+}
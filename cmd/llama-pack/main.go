@@ -0,0 +1,260 @@
+// Command llama-pack appends GGUF models to an executable, to be loaded by
+// LoadSelfContainedModel and LoadEmbeddedModel, or checks the models appended
+// to one.
+//
+//	llama-pack [-o output] [-z] [-key keyfile] executable [name=]model.gguf...
+//	llama-pack -check [-key keyfile] executable
+//	llama-pack -encrypt -key keyfile [-o output] model.gguf
+//
+// Models are named after their file without the .gguf extension unless a
+// name is given. The first one is loaded by LoadSelfContainedModel. With -z
+// the models are compressed, trading load time for a smaller executable.
+// With -key they are encrypted with the AES key written in hex in keyfile,
+// to be loaded with SetModelKey. The signature of a model written by gguf
+// sign next to it is packed with it. Without -o the executable is modified
+// in place.
+//
+// With -encrypt a model is encrypted to its own file, model.gguf.enc by
+// default, to be loaded with NewFromEncrypted.
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-skynet/go-llama.cpp/gguf"
+	"github.com/go-skynet/go-llama.cpp/pack"
+)
+
+func main() {
+	var output, keyFile string
+	var check, compress, encrypt bool
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	flags.StringVar(&output, "o", "", "write the packed executable to `path` instead of modifying it")
+	flags.BoolVar(&check, "check", false, "check the models appended to the executable")
+	flags.BoolVar(&compress, "z", false, "compress the models")
+	flags.StringVar(&keyFile, "key", "", "encrypt the models with the AES key written in hex in `keyfile`")
+	flags.BoolVar(&encrypt, "encrypt", false, "encrypt a model to its own file")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s [-o output] [-z] [-key keyfile] executable [name=]model.gguf...\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "       %s -check [-key keyfile] executable\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "       %s -encrypt -key keyfile [-o output] model.gguf\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+
+	var key []byte
+	if keyFile != "" {
+		var err error
+		if key, err = readKey(keyFile); err != nil {
+			fmt.Fprintf(os.Stderr, "llama-pack: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var err error
+	switch {
+	case check && !encrypt && flags.NArg() == 1:
+		err = checkPacked(flags.Arg(0), key)
+	case encrypt && !check && key != nil && flags.NArg() == 1:
+		if output == "" {
+			output = flags.Arg(0) + ".enc"
+		}
+		err = encryptModel(flags.Arg(0), output, key)
+	case !check && !encrypt && flags.NArg() >= 2:
+		if output == "" {
+			output = flags.Arg(0)
+		}
+		err = packModels(flags.Arg(0), flags.Args()[1:], output, compress, key)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "llama-pack: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func readKey(path string) ([]byte, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(string(bytes.TrimSpace(text)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: key is not in hex: %w", path, err)
+	}
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, fmt.Errorf("%s: key is %d bytes, not 16, 24 or 32", path, len(key))
+	}
+	return key, nil
+}
+
+// openModel opens the model at path once it passes validation.
+func openModel(path string) (*os.File, error) {
+	f, err := gguf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if problems := f.Validate(); len(problems) > 0 {
+		return nil, fmt.Errorf("%s: %w", path, problems[0])
+	}
+	return os.Open(path)
+}
+
+// replaceFile writes output with write, to a temporary file next to it that
+// is renamed once complete, so that a failure leaves output as it was.
+func replaceFile(output string, perm os.FileMode, write func(f *os.File) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(output), "."+filepath.Base(output)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if err := write(tmp); err != nil {
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), output)
+}
+
+func packModels(exePath string, args []string, output string, compress bool, key []byte) error {
+	var models []pack.Model
+	for _, arg := range args {
+		name, modelPath, ok := strings.Cut(arg, "=")
+		if !ok {
+			modelPath = arg
+			name = strings.TrimSuffix(filepath.Base(modelPath), ".gguf")
+		}
+		model, err := openModel(modelPath)
+		if err != nil {
+			return err
+		}
+		defer model.Close()
+		var sig []byte
+		if _, err := os.Stat(modelPath + pack.SignatureExt); err == nil {
+			if sig, err = pack.ReadSignature(modelPath + pack.SignatureExt); err != nil {
+				return err
+			}
+		}
+		models = append(models, pack.Model{Name: name, Data: model, Compress: compress, Key: key, Signature: sig})
+	}
+
+	exe, err := os.Open(exePath)
+	if err != nil {
+		return err
+	}
+	defer exe.Close()
+	info, err := exe.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := pack.ReadEntries(exe, info.Size()); err == nil {
+		return fmt.Errorf("%s has models appended already", exePath)
+	}
+
+	var entries []pack.Entry
+	err = replaceFile(output, info.Mode().Perm(), func(f *os.File) error {
+		if _, err := io.Copy(f, exe); err != nil {
+			return err
+		}
+		entries, err = pack.Append(f, models...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		fmt.Printf("packed %s: %s\n", e.Name, describe(e))
+	}
+	return nil
+}
+
+func encryptModel(modelPath, output string, key []byte) error {
+	model, err := openModel(modelPath)
+	if err != nil {
+		return err
+	}
+	defer model.Close()
+
+	var n int64
+	err = replaceFile(output, 0o600, func(f *os.File) error {
+		n, err = pack.Encrypt(f, model, key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("encrypted %s to %s: %d bytes\n", modelPath, output, n)
+	return nil
+}
+
+func describe(e pack.Entry) string {
+	s := fmt.Sprintf("%d bytes", e.ModelSize)
+	switch {
+	case e.Compressed && e.Encrypted:
+		s += fmt.Sprintf(" compressed and encrypted to %d", e.Size)
+	case e.Compressed:
+		s += fmt.Sprintf(" compressed to %d", e.Size)
+	case e.Encrypted:
+		s += fmt.Sprintf(" encrypted to %d", e.Size)
+	}
+	s += fmt.Sprintf(" at offset %d", e.Offset)
+	if !e.Legacy {
+		s += fmt.Sprintf(", sha256 %x", e.SHA256)
+	}
+	if e.Signature != nil {
+		s += ", signed"
+	}
+	return s
+}
+
+func checkPacked(exePath string, key []byte) error {
+	exe, err := os.Open(exePath)
+	if err != nil {
+		return err
+	}
+	defer exe.Close()
+	info, err := exe.Stat()
+	if err != nil {
+		return err
+	}
+
+	entries, err := pack.ReadEntries(exe, info.Size())
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		switch {
+		case e.Legacy:
+			fmt.Printf("%s: legacy model of %s, without checksum\n", e.Name, describe(e))
+			continue
+		case e.Encrypted && key == nil:
+			fmt.Printf("%s: %s, not verified without its key\n", e.Name, describe(e))
+			continue
+		}
+		model, err := e.OpenWithKey(exe, key)
+		if err != nil {
+			return err
+		}
+		if err := e.Verify(model); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %s verified\n", e.Name, describe(e))
+	}
+	return nil
+}
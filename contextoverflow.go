@@ -0,0 +1,121 @@
+package llama
+
+// #include "binding.h"
+import "C"
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// ContextOverflowPolicy decides what Predict does once the generated text no
+// longer fits in the context.
+type ContextOverflowPolicy int
+
+const (
+	// ContextShiftHalf keeps the first NKeep tokens and recomputes the most
+	// recent half of the rest. This is the default.
+	ContextShiftHalf ContextOverflowPolicy = C.LLAMA_BINDING_OVERFLOW_SHIFT_HALF
+	// ContextError stops the prediction and returns ErrContextFull together
+	// with the text generated so far.
+	ContextError ContextOverflowPolicy = C.LLAMA_BINDING_OVERFLOW_ERROR
+	// ContextSlidingWindow keeps the first NKeep tokens, usually the system
+	// prompt, plus the number of most recent tokens set with
+	// SetContextWindow, half of the rest of the context by default.
+	ContextSlidingWindow ContextOverflowPolicy = C.LLAMA_BINDING_OVERFLOW_SLIDING_WINDOW
+	// ContextHook lets the function set with SetContextOverflowHook rewrite
+	// the tokens in the context.
+	ContextHook ContextOverflowPolicy = C.LLAMA_BINDING_OVERFLOW_HOOK
+)
+
+// ErrContextFull is returned by Predict when the context is full and the
+// overflow policy does not allow dropping tokens.
+var ErrContextFull = errors.New("context is full")
+
+// ContextShift describes one time the context overflowed and tokens were
+// dropped from it.
+type ContextShift struct {
+	Policy ContextOverflowPolicy
+	// Number of tokens in the context before the shift
+	NPast int
+	// Number of tokens dropped from the context
+	NDiscarded int
+}
+
+// predictHooks holds what a running prediction needs when the C code calls
+// back into Go about the context.
+type predictHooks struct {
+	overflowHook  func(history []int32) []int32
+	shiftCallback func(ContextShift)
+	shifts        []ContextShift
+	// the prediction evaluates a negative prompt, which Suspend can not save
+	guided bool
+	// set by Suspend and Interrupt, checked before every evaluation
+	suspend   atomic.Bool
+	interrupt atomic.Bool
+}
+
+var (
+	hm    sync.RWMutex
+	hooks = map[uintptr]*predictHooks{}
+)
+
+func setPredictHooks(statePtr unsafe.Pointer, h *predictHooks) {
+	hm.Lock()
+	defer hm.Unlock()
+
+	if h == nil {
+		delete(hooks, uintptr(statePtr))
+	} else {
+		hooks[uintptr(statePtr)] = h
+	}
+}
+
+func getPredictHooks(statePtr unsafe.Pointer) *predictHooks {
+	hm.RLock()
+	defer hm.RUnlock()
+
+	return hooks[uintptr(statePtr)]
+}
+
+//export contextShiftCallback
+func contextShiftCallback(statePtr unsafe.Pointer, policy, nPast, nDiscarded C.int) {
+	h := getPredictHooks(statePtr)
+	if h == nil {
+		return
+	}
+
+	shift := ContextShift{
+		Policy:     ContextOverflowPolicy(policy),
+		NPast:      int(nPast),
+		NDiscarded: int(nDiscarded),
+	}
+	h.shifts = append(h.shifts, shift)
+	if h.shiftCallback != nil {
+		h.shiftCallback(shift)
+	}
+}
+
+// contextOverflowHook passes the nTokens tokens of the context to the hook
+// and writes the history it returns back in place. It returns the new number
+// of tokens, or -1 to stop the prediction when the hook gives up or returns
+// more than nMax tokens.
+//
+//export contextOverflowHook
+func contextOverflowHook(statePtr unsafe.Pointer, tokens *C.int, nTokens, nMax C.int) C.int {
+	h := getPredictHooks(statePtr)
+	if h == nil || h.overflowHook == nil {
+		return -1
+	}
+
+	buf := unsafe.Slice((*int32)(unsafe.Pointer(tokens)), int(nMax))
+	history := make([]int32, int(nTokens))
+	copy(history, buf)
+
+	rewritten := h.overflowHook(history)
+	if rewritten == nil || len(rewritten) > len(buf) {
+		return -1
+	}
+	return C.int(copy(buf, rewritten))
+}
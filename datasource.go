@@ -0,0 +1,170 @@
+package llama
+
+// #include "binding.h"
+// #include <stdlib.h>
+import "C"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"runtime/cgo"
+	"sync"
+	"unsafe"
+)
+
+// NewFromReaderAt loads a model of size bytes read from r. llama.cpp reads the
+// metadata first and then every tensor straight into its final buffer, so the
+// model is never held in memory twice. r is only used while loading, and
+// the error it returns, if any, is returned. Like with New, a LoRA adapter set
+// with SetLoraAdapter is read from its file.
+func NewFromReaderAt(r io.ReaderAt, size int64, opts ...ModelOption) (*LLama, error) {
+	mo := NewModelOptions(opts...)
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid model size %d", size)
+	}
+	if err := checkSignature(mo, io.NewSectionReader(r, 0, size), ""); err != nil {
+		return nil, err
+	}
+	check, err := startReaderChecksum(mo, io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	return newFromReaderAt(r, size, mo, checksumChecks{check})
+}
+
+// newFromReaderAt loads the model like NewFromReaderAt, and fails unless
+// checks, which run while it loads, succeed.
+func newFromReaderAt(r io.ReaderAt, size int64, mo ModelOptions, checks checksumChecks) (*LLama, error) {
+	MulMatQ := true
+
+	if mo.MulMatQ != nil {
+		MulMatQ = *mo.MulMatQ
+	}
+
+	mainGPU := C.CString(mo.MainGPU)
+	defer C.free(unsafe.Pointer(mainGPU))
+	tensorSplit := C.CString(mo.TensorSplit)
+	defer C.free(unsafe.Pointer(tensorSplit))
+	loraBase := C.CString(mo.LoraBase)
+	defer C.free(unsafe.Pointer(loraBase))
+	loraAdapter := C.CString(mo.LoraAdapter)
+	defer C.free(unsafe.Pointer(loraAdapter))
+
+	ds := &dataSource{r: r}
+	source := cgo.NewHandle(ds)
+	defer source.Delete()
+
+	progress := newLoadProgress(mo.LoadProgress)
+	defer progress.free()
+
+	result := C.load_model_from_source(C.uintptr_t(source), C.size_t(size),
+		C.int(mo.ContextSize), C.int(mo.Seed),
+		C.bool(mo.F16Memory), C.bool(mo.MLock), C.bool(mo.Embeddings), C.bool(mo.LowVRAM),
+		C.int(mo.NGPULayers), C.int(mo.NBatch), mainGPU, tensorSplit, C.bool(mo.NUMA),
+		C.float(mo.FreqRopeBase), C.float(mo.FreqRopeScale),
+		C.bool(MulMatQ), loraAdapter, loraBase, C.bool(mo.Perplexity), progress.arg(),
+	)
+
+	if result == nil {
+		err := fmt.Errorf("failed loading model from reader")
+		if ds.err != nil {
+			err = fmt.Errorf("failed loading model from reader: %w", ds.err)
+		}
+		return nil, checkFailedLoad(checks, progress.err(err))
+	}
+	if err := checks.wait(); err != nil {
+		C.llama_binding_free_model(result)
+		return nil, err
+	}
+
+	ll := &LLama{
+		state:       result,
+		contextSize: mo.ContextSize,
+		embeddings:  mo.Embeddings,
+		options:     mo,
+		fingerprint: modelFingerprint(contentFingerprint(r, size), mo),
+	}
+	if mo.PrefixCacheBudget > 0 {
+		ll.prefixCache = newPrefixCache(mo.PrefixCacheBudget, mo.PrefixCacheMinMatch)
+	}
+	return ll.track("a reader"), nil
+}
+
+// NewFromFS loads the model stored as name in fsys, for example a model
+// embedded with //go:embed. The file must support random access, either as an
+// io.ReaderAt like the files of embed.FS and os.DirFS, or as an io.Seeker.
+// Like New, it loads every shard of a model split with gguf-split.
+func NewFromFS(fsys fs.FS, name string, opts ...ModelOption) (*LLama, error) {
+	if shards := shardNames(name); shards != nil {
+		return newFromFSShards(fsys, shards, opts...)
+	}
+
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open model: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat model: %w", err)
+	}
+
+	r, err := readerAt(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", name, err)
+	}
+
+	return NewFromReaderAt(r, info.Size(), opts...)
+}
+
+func readerAt(f fs.File) (io.ReaderAt, error) {
+	switch r := f.(type) {
+	case io.ReaderAt:
+		return r, nil
+	case io.ReadSeeker:
+		return &seekReaderAt{r: r}, nil
+	}
+	return nil, errors.New("file does not support random access")
+}
+
+// seekReaderAt implements io.ReaderAt on top of a file that can only seek.
+type seekReaderAt struct {
+	mu sync.Mutex
+	r  io.ReadSeeker
+}
+
+func (s *seekReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(s.r, p)
+}
+
+// dataSource is the reader a model is loaded from, along with the first
+// error it returned, which llama.cpp can not report.
+type dataSource struct {
+	r   io.ReaderAt
+	err error
+}
+
+// dataSourceReadAt serves the reads of a model loaded with NewFromReaderAt,
+// straight into the buffer given by llama.cpp.
+//
+//export dataSourceReadAt
+func dataSourceReadAt(source C.uintptr_t, dst unsafe.Pointer, offset, size C.size_t) C.size_t {
+	ds := cgo.Handle(source).Value().(*dataSource)
+	buf := unsafe.Slice((*byte)(dst), int(size))
+	n, err := ds.r.ReadAt(buf, int64(offset))
+	if n < len(buf) && ds.err == nil {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		ds.err = fmt.Errorf("failed to read %d bytes at offset %d: %w", len(buf), offset, err)
+	}
+	return C.size_t(n)
+}
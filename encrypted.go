@@ -0,0 +1,105 @@
+package llama
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"unsafe"
+
+	"github.com/go-skynet/go-llama.cpp/pack"
+)
+
+// NewFromEncrypted loads the model at path encrypted with key, an AES key of
+// 16, 24 or 32 bytes, as written by pack.Encrypt or llama-pack -encrypt. The
+// model is decrypted straight into locked memory outside of the Go heap,
+// which is never swapped out and is zeroed when the model is freed. A wrong
+// key or a tampered file fail with pack.ErrAuthentication. A signature
+// required with SetRequireSignature is read next to the file and checked
+// against the decrypted model.
+func NewFromEncrypted(path string, key []byte, opts ...ModelOption) (*LLama, error) {
+	if mo := NewModelOptions(opts...); len(mo.SignatureKeys) > 0 && mo.Signature == nil {
+		sig, err := pack.ReadSignature(path + pack.SignatureExt)
+		if err != nil {
+			return nil, fmt.Errorf("failed loading model from %s - %w", path, err)
+		}
+		opts = append(opts, SetSignature(sig))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open encrypted model: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat encrypted model: %w", err)
+	}
+
+	model, size, err := pack.Decrypt(f, info.Size(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt model %s: %w", path, err)
+	}
+	ll, err := loadLocked(model, size, nil, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt model %s: %w", path, err)
+	}
+	return ll, nil
+}
+
+// loadEncryptedModel decrypts the model of entry with the key set by
+// SetModelKey into locked memory, like NewFromEncrypted.
+func loadEncryptedModel(file *os.File, entry pack.Entry, opts []ModelOption) (*LLama, error) {
+	key := NewModelOptions(opts...).ModelKey
+	if key == nil {
+		return nil, fmt.Errorf("model %s is encrypted, set its key with SetModelKey", entry.Name)
+	}
+	fmt.Printf("Found encrypted self-contained model %s of size %d MB, decrypting...\n", entry.Name, entry.ModelSize/(1024*1024))
+
+	model, err := entry.OpenWithKey(file, key)
+	if err != nil {
+		return nil, err
+	}
+	verify := func(data []byte) error { return entry.Verify(bytes.NewReader(data)) }
+	return loadLocked(model, entry.ModelSize, verify, opts)
+}
+
+// loadLocked reads the model of the given size from r into locked memory,
+// checks it with verify if set and loads it without copying. The model owns
+// the memory, which is zeroed when it is freed.
+func loadLocked(r io.Reader, size int64, verify func([]byte) error, opts []ModelOption) (*LLama, error) {
+	if size <= 0 || int64(int(size)) != size {
+		return nil, fmt.Errorf("invalid model size %d", size)
+	}
+	data, err := allocLocked(int(size))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(r, data); err != nil {
+		freeLocked(data)
+		return nil, err
+	}
+	// the model must end with the data
+	if n, err := r.Read(make([]byte, 1)); n != 0 || (err != nil && err != io.EOF) {
+		freeLocked(data)
+		if err == nil {
+			err = fmt.Errorf("model is larger than %d bytes", size)
+		}
+		return nil, err
+	}
+	if verify != nil {
+		if err := verify(data); err != nil {
+			freeLocked(data)
+			return nil, err
+		}
+	}
+
+	ll, err := NewFromMMap(uintptr(unsafe.Pointer(unsafe.SliceData(data))), len(data), opts...)
+	if err != nil {
+		freeLocked(data)
+		return nil, err
+	}
+	// The model owns the memory and zeroes it when closed
+	ll.unmap = func() error { return freeLocked(data) }
+	return ll, nil
+}
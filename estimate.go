@@ -0,0 +1,187 @@
+package llama
+
+// #include "binding.h"
+import "C"
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-skynet/go-llama.cpp/gguf"
+)
+
+// MemoryEstimate is the memory a model takes once loaded with given options,
+// in bytes.
+type MemoryEstimate struct {
+	// Tensor data of the model. With mmap it is mapped from the file and
+	// only counts towards the RSS once it has been read.
+	Weights int64
+	// Part of Weights that SetGPULayers offloads to the GPU. It only leaves
+	// RAM when SupportsGPUOffload is true.
+	Offloaded int64
+	// K and V cache for ContextSize tokens with the F16Memory option used
+	KVCache int64
+	// K and V cache with and without EnableF16Memory
+	KVCacheF16, KVCacheF32 int64
+	// Scratch buffer for the intermediate results of evaluating a batch
+	Compute int64
+	// Logits and embeddings of the last evaluation
+	Output int64
+}
+
+// Total is the memory the model takes in RAM.
+func (e MemoryEstimate) Total() int64 {
+	total := e.Weights + e.KVCache + e.Compute + e.Output
+	if SupportsGPUOffload() {
+		total -= e.Offloaded
+	}
+	return total
+}
+
+// SupportsGPUOffload reports whether the binding was built with a GPU backend,
+// without one SetGPULayers has no effect.
+func SupportsGPUOffload() bool {
+	return bool(C.llama_binding_gpu_offload())
+}
+
+const (
+	// allocated with every context for the graph and tensor descriptors
+	computeOverhead = 2 << 20
+	kvCacheOverhead = 2 << 20
+)
+
+// EstimateMemory estimates the memory the model at path takes when loaded
+// with opts, reading only its GGUF header and tensor table. The compute
+// buffer is sized for its peak, the actual use may be a little smaller.
+func EstimateMemory(path string, opts ...ModelOption) (MemoryEstimate, error) {
+	paths := shardNames(path)
+	if paths == nil {
+		paths = []string{path}
+	}
+
+	var headers []*gguf.File
+	for _, p := range paths {
+		h, err := gguf.Open(p)
+		if err != nil {
+			return MemoryEstimate{}, fmt.Errorf("failed to read %s: %w", p, err)
+		}
+		headers = append(headers, h)
+	}
+
+	return estimateMemory(headers, NewModelOptions(opts...))
+}
+
+// tensorSizes returns the bytes taken by each tensor of f, up to the next
+// tensor so that alignment padding is included.
+func tensorSizes(f *gguf.File) map[string]int64 {
+	tensors := append([]gguf.TensorInfo(nil), f.Tensors...)
+	sort.Slice(tensors, func(i, j int) bool { return tensors[i].Offset < tensors[j].Offset })
+
+	sizes := make(map[string]int64, len(tensors))
+	end := f.Size - f.DataOffset
+	for i := len(tensors) - 1; i >= 0; i-- {
+		start := min(int64(tensors[i].Offset), end)
+		sizes[tensors[i].Name] = end - start
+		end = start
+	}
+	return sizes
+}
+
+func estimateMemory(headers []*gguf.File, mo ModelOptions) (MemoryEstimate, error) {
+	h := headers[0]
+	arch := h.Architecture()
+	if arch == "" {
+		return MemoryEstimate{}, fmt.Errorf("model has no general.architecture")
+	}
+	hparam := func(name string) (int64, error) {
+		key := arch + "." + name
+		v, ok := h.Int(key)
+		if !ok || v <= 0 {
+			return 0, fmt.Errorf("model has no valid %s", key)
+		}
+		return v, nil
+	}
+
+	nLayer, err := hparam("block_count")
+	if err != nil {
+		return MemoryEstimate{}, err
+	}
+	nEmbd, err := hparam("embedding_length")
+	if err != nil {
+		return MemoryEstimate{}, err
+	}
+	nFF, err := hparam("feed_forward_length")
+	if err != nil {
+		return MemoryEstimate{}, err
+	}
+	nHead, err := hparam("attention.head_count")
+	if err != nil {
+		return MemoryEstimate{}, err
+	}
+	nHeadKV, err := hparam("attention.head_count_kv")
+	if err != nil {
+		nHeadKV = nHead
+	}
+	if nHead%nHeadKV != 0 {
+		return MemoryEstimate{}, fmt.Errorf("%d attention heads can not be grouped by %d", nHead, nHeadKV)
+	}
+
+	var e MemoryEstimate
+	nVocab := int64(0)
+	for _, shard := range headers {
+		sizes := tensorSizes(shard)
+		for _, t := range shard.Tensors {
+			size := sizes[t.Name]
+			e.Weights += size
+			if offloadedTensor(t.Name, nLayer, int64(mo.NGPULayers)) {
+				e.Offloaded += size
+			}
+			if t.Name == "token_embd.weight" && len(t.Shape) == 2 {
+				nVocab = int64(t.Shape[1])
+			}
+		}
+	}
+	if nVocab == 0 {
+		return MemoryEstimate{}, fmt.Errorf("model has no token embeddings")
+	}
+
+	nCtx := int64(mo.ContextSize)
+	nBatch := min(int64(mo.NBatch), nCtx)
+	kvElems := 2 * nLayer * nCtx * (nEmbd / (nHead / nHeadKV))
+	e.KVCacheF16 = 2*kvElems + kvCacheOverhead
+	e.KVCacheF32 = 4*kvElems + kvCacheOverhead
+	e.KVCache = e.KVCacheF32
+	if mo.F16Memory {
+		e.KVCache = e.KVCacheF16
+	}
+
+	// the peak of the graph is either the attention scores, the feed forward
+	// or the logits of the whole batch, each next to a few embeddings
+	peak := max(nHead*nCtx+3*nEmbd, 3*nFF+2*nEmbd, nVocab+2*nEmbd)
+	e.Compute = 4*nBatch*peak + computeOverhead
+
+	e.Output = 4 * nVocab
+	if mo.Perplexity {
+		e.Output *= nCtx
+	}
+	if mo.Embeddings {
+		e.Output += 4 * nEmbd
+	}
+	return e, nil
+}
+
+// offloadedTensor reports whether llama.cpp puts the tensor named name on the
+// GPU when nGPU layers are offloaded: the last nGPU blocks, and the output
+// once every block is.
+func offloadedTensor(name string, nLayer, nGPU int64) bool {
+	if nGPU <= 0 {
+		return false
+	}
+	if rest, ok := strings.CutPrefix(name, "blk."); ok {
+		n, _, _ := strings.Cut(rest, ".")
+		i, err := strconv.ParseInt(n, 10, 64)
+		return err == nil && i >= nLayer-nGPU
+	}
+	return nGPU > nLayer && strings.HasPrefix(name, "output")
+}
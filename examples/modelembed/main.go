@@ -2,10 +2,11 @@ package main
 
 import (
 	"bufio"
-	_ "embed"
+	"embed"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"runtime"
 	"strings"
@@ -14,7 +15,9 @@ import (
 )
 
 //go:embed models/model.gguf
-var embeddedModel []byte
+var embeddedModel embed.FS
+
+const embeddedModelName = "models/model.gguf"
 
 var (
 	threads   = 4
@@ -46,22 +49,23 @@ func main() {
 	// モデルのロード
 	var l *llama.LLama
 	if useEmbedded {
-		if len(embeddedModel) == 0 {
+		info, err := fs.Stat(embeddedModel, embeddedModelName)
+		if err != nil || info.Size() == 0 {
 			fmt.Println("Error: No embedded model found. Please build with a model file.")
 			os.Exit(1)
 		}
 
-		fmt.Printf("Loading embedded model from memory (%d MB)...\n", len(embeddedModel)/(1024*1024))
-		l, err = llama.NewFromMemory(embeddedModel,
+		fmt.Printf("Loading embedded model (%d MB)...\n", info.Size()/(1024*1024))
+		l, err = llama.NewFromFS(embeddedModel, embeddedModelName,
 			llama.EnableF16Memory,
 			llama.SetContext(128),
 			llama.EnableEmbeddings,
 			llama.SetGPULayers(gpulayers))
 		if err != nil {
-			fmt.Println("Loading the model from memory failed:", err.Error())
+			fmt.Println("Loading the embedded model failed:", err.Error())
 			os.Exit(1)
 		}
-		fmt.Printf("Model loaded successfully from memory.\n")
+		fmt.Printf("Embedded model loaded successfully.\n")
 	} else {
 		fmt.Printf("Loading model from file: %s\n", model)
 		l, err = llama.New(model,
@@ -0,0 +1,426 @@
+// Package fetch downloads models into a local cache where they are stored by
+// their SHA-256. Interrupted downloads are resumed with HTTP range requests,
+// and models are only stored once their size and SHA-256 are verified.
+// Processes sharing a cache take a lock on the models they download, so that
+// each is only downloaded once.
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-skynet/go-llama.cpp/pack"
+)
+
+const (
+	modelExt    = ".gguf"
+	partialExt  = ".partial"
+	lockExt     = ".lock"
+	checksumExt = ".sha256"
+)
+
+// ErrChecksum is returned when a download does not have the size or SHA-256
+// of its source, the same error as llama.ErrChecksumMismatch.
+var ErrChecksum = pack.ErrChecksum
+
+// Source describes a model to fetch.
+type Source struct {
+	// URL of the model: http, https or file for local copies
+	URL string
+	// SHA-256 of the model in hex, which it is stored under
+	SHA256 string
+	// Size of the model in bytes, 0 when it is unknown
+	Size int64
+}
+
+// Cache is a directory of models named after their SHA-256.
+type Cache struct {
+	dir        string
+	client     *http.Client
+	mirrors    []string
+	retries    int
+	retryDelay time.Duration
+}
+
+// NewCache creates a cache in dir, creating the directory if needed.
+func NewCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create model cache directory: %w", err)
+	}
+	return &Cache{dir: dir, client: http.DefaultClient, retries: 5, retryDelay: time.Second}, nil
+}
+
+// SetClient sets the HTTP client downloads are made with, by default
+// http.DefaultClient.
+func (c *Cache) SetClient(client *http.Client) {
+	c.client = client
+}
+
+// SetMirrors sets base URLs that are tried in order before the URL of a
+// source, with the path of the source appended to them: with the mirror
+// file:///srv/models, https://example.com/llama/model.gguf is first looked
+// for at /srv/models/llama/model.gguf.
+func (c *Cache) SetMirrors(mirrors ...string) {
+	c.mirrors = mirrors
+}
+
+// SetRetries sets how many times a download failing without progress is
+// retried, waiting delay in between, before the next URL is tried. Failures
+// after some progress are retried at once. The default is 5 retries a
+// second apart.
+func (c *Cache) SetRetries(n int, delay time.Duration) {
+	c.retries = n
+	c.retryDelay = delay
+}
+
+// Path returns where the model with the given SHA-256 is stored, once it is
+// fetched.
+func (c *Cache) Path(sha256 string) string {
+	return filepath.Join(c.dir, strings.ToLower(sha256)+modelExt)
+}
+
+// Fetch returns the path of the model described by src in the cache,
+// downloading it first if it is not there. The file next to it with
+// ".sha256" appended to its name holds its SHA-256, as written by sha256sum,
+// for llama.SetVerifySHA256File.
+func (c *Cache) Fetch(ctx context.Context, src Source) (string, error) {
+	sum, err := hex.DecodeString(src.SHA256)
+	if err != nil || len(sum) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 %q", src.SHA256)
+	}
+	path := c.Path(src.SHA256)
+	if c.cached(path, src.Size) {
+		return path, nil
+	}
+	urls, err := c.urls(src.URL)
+	if err != nil {
+		return "", err
+	}
+
+	lock, err := os.OpenFile(path+lockExt, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return "", fmt.Errorf("failed to open model cache lock: %w", err)
+	}
+	defer lock.Close()
+	if err := lockFile(ctx, lock); err != nil {
+		return "", fmt.Errorf("failed to lock model cache entry: %w", err)
+	}
+	defer unlockFile(lock)
+	// another process may have fetched it meanwhile
+	if c.cached(path, src.Size) {
+		return path, nil
+	}
+
+	var errs []error
+	for _, u := range urls {
+		err := c.download(ctx, u, path, sum, src.Size)
+		if err == nil {
+			return path, nil
+		}
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		errs = append(errs, err)
+	}
+	return "", fmt.Errorf("failed to fetch %s: %w", src.URL, errors.Join(errs...))
+}
+
+// lockPollInterval is how often lockFile tries again to take a lock held by
+// another process.
+const lockPollInterval = 100 * time.Millisecond
+
+// lockFile takes an exclusive lock on f, waiting while another process holds
+// it, for example while it downloads the same model, until ctx is done.
+func lockFile(ctx context.Context, f *os.File) error {
+	for {
+		ok, err := tryLockFile(f)
+		if ok || err != nil {
+			return err
+		}
+		select {
+		case <-time.After(lockPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// cached reports whether the model at path is in the cache. Models are only
+// stored once verified.
+func (c *Cache) cached(path string, size int64) bool {
+	info, err := os.Stat(path)
+	return err == nil && (size == 0 || info.Size() == size)
+}
+
+// urls returns the URLs the model at source is fetched from: the mirrors,
+// then source.
+func (c *Cache) urls(source string) ([]*url.URL, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid model URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file" {
+		return nil, fmt.Errorf("unsupported model URL %s", source)
+	}
+	var urls []*url.URL
+	for _, mirror := range c.mirrors {
+		m, err := url.Parse(mirror)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mirror URL: %w", err)
+		}
+		m = m.JoinPath(u.Path)
+		m.RawQuery = u.RawQuery
+		urls = append(urls, m)
+	}
+	return append(urls, u), nil
+}
+
+// download fetches the model from u into a partial file next to path,
+// resuming what was downloaded already, and renames it to path once it is
+// verified.
+func (c *Cache) download(ctx context.Context, u *url.URL, path string, sum []byte, size int64) error {
+	partial := path + partialExt
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	d := &partialFile{f: f, h: sha256.New(), size: size}
+	if d.offset, err = io.Copy(d.h, f); err != nil {
+		return fmt.Errorf("failed to read partial download: %w", err)
+	}
+	if size > 0 && d.offset > size {
+		if err := d.restart(); err != nil {
+			return err
+		}
+	}
+
+	for failures := 0; size == 0 || d.offset < size; {
+		written := d.written
+		retry, err := c.get(ctx, u, d)
+		if err == nil && (size == 0 || d.offset >= size) {
+			break
+		}
+		if err == nil {
+			retry, err = true, fmt.Errorf("%s: connection closed after %d of %d bytes", u.Redacted(), d.offset, size)
+		}
+		if !retry || ctx.Err() != nil {
+			return err
+		}
+		if d.written > written {
+			failures = 0
+			continue
+		}
+		if failures++; failures > c.retries {
+			return err
+		}
+		select {
+		case <-time.After(c.retryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if size > 0 && d.offset != size {
+		os.Remove(partial)
+		return fmt.Errorf("%w: %s is %d bytes, expected %d", ErrChecksum, u.Redacted(), d.offset, size)
+	}
+	if got := d.h.Sum(nil); !bytes.Equal(got, sum) {
+		os.Remove(partial)
+		return fmt.Errorf("%w: SHA-256 of %s is %x, expected %x", ErrChecksum, u.Redacted(), got, sum)
+	}
+	line := fmt.Sprintf("%x  %s\n", sum, filepath.Base(path))
+	if err := os.WriteFile(path+checksumExt, []byte(line), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(partial, path)
+}
+
+// get downloads the rest of the model from u into d, and reports whether a
+// failure may be retried.
+func (c *Cache) get(ctx context.Context, u *url.URL, d *partialFile) (retry bool, err error) {
+	if u.Scheme == "file" {
+		return false, d.copyFile(filePath(u))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	if d.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.offset))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	total := int64(-1)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// the whole model, the server does not do ranges
+		if err := d.restart(); err != nil {
+			return false, err
+		}
+		total = resp.ContentLength
+	case http.StatusPartialContent:
+		start, t, ok := parseContentRange(resp.Header.Get("Content-Range"))
+		if !ok || start != d.offset {
+			// start over rather than guess
+			if err := d.restart(); err != nil {
+				return false, err
+			}
+			return true, fmt.Errorf("%s: unexpected range %q", u.Redacted(), resp.Header.Get("Content-Range"))
+		}
+		total = t
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the model may be complete already
+		if _, t, ok := parseContentRange(resp.Header.Get("Content-Range")); ok && t == d.offset {
+			return false, nil
+		}
+		if err := d.restart(); err != nil {
+			return false, err
+		}
+		return true, fmt.Errorf("%s: %s", u.Redacted(), resp.Status)
+	default:
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests,
+			fmt.Errorf("%s: %s", u.Redacted(), resp.Status)
+	}
+	if d.size > 0 && total >= 0 && total != d.size {
+		return false, fmt.Errorf("%w: %s is %d bytes, expected %d", ErrChecksum, u.Redacted(), total, d.size)
+	}
+
+	if _, err := io.Copy(d, resp.Body); err != nil {
+		return !errors.Is(err, errTooLarge), fmt.Errorf("%s: %w", u.Redacted(), err)
+	}
+	if total >= 0 && d.offset < total {
+		return true, fmt.Errorf("%s: connection closed after %d of %d bytes", u.Redacted(), d.offset, total)
+	}
+	return false, nil
+}
+
+// parseContentRange parses the Content-Range header of a response to a
+// range request, "bytes start-end/total" or "bytes */total", with a start of
+// -1 for the latter and a total of -1 when it is unknown.
+func parseContentRange(header string) (start, total int64, ok bool) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return 0, 0, false
+	}
+	rng, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return 0, 0, false
+	}
+	total = -1
+	if size != "*" {
+		var err error
+		if total, err = strconv.ParseInt(size, 10, 64); err != nil {
+			return 0, 0, false
+		}
+	}
+	if rng == "*" {
+		return -1, total, true
+	}
+	first, _, ok := strings.Cut(rng, "-")
+	if !ok {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, total, true
+}
+
+// filePath returns the local path of a file URL.
+func filePath(u *url.URL) string {
+	path := u.Path
+	// file:///C:/models/model.gguf
+	if runtime.GOOS == "windows" && len(path) >= 3 && path[0] == '/' && path[2] == ':' {
+		path = path[1:]
+	}
+	return filepath.FromSlash(path)
+}
+
+var errTooLarge = errors.New("model is larger than expected")
+
+// partialFile is a model being downloaded, hashed as it is written.
+type partialFile struct {
+	f    *os.File
+	h    hash.Hash
+	size int64
+	// size of the partial file, and bytes written to it by this process
+	offset  int64
+	written int64
+}
+
+func (d *partialFile) Write(p []byte) (int, error) {
+	if d.size > 0 && d.offset+int64(len(p)) > d.size {
+		return 0, fmt.Errorf("%w: %w", ErrChecksum, errTooLarge)
+	}
+	n, err := d.f.Write(p)
+	d.h.Write(p[:n])
+	d.offset += int64(n)
+	d.written += int64(n)
+	return n, err
+}
+
+// restart discards what was downloaded.
+func (d *partialFile) restart() error {
+	if err := d.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := d.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	d.h.Reset()
+	d.offset = 0
+	return nil
+}
+
+// copyFile copies the rest of the model from the local file at path.
+func (d *partialFile) copyFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	if d.size > 0 && info.Size() != d.size {
+		return fmt.Errorf("%w: %s is %d bytes, expected %d", ErrChecksum, path, info.Size(), d.size)
+	}
+	if info.Size() < d.offset {
+		if err := d.restart(); err != nil {
+			return err
+		}
+	}
+	if _, err := src.Seek(d.offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(d, src); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", path, err)
+	}
+	return nil
+}
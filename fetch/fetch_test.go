@@ -0,0 +1,215 @@
+package fetch_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-skynet/go-llama.cpp/fetch"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Model cache", func() {
+	model := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(model)
+	sum := fmt.Sprintf("%x", sha256.Sum256(model))
+
+	var (
+		cache    *fetch.Cache
+		requests atomic.Int32
+		mu       sync.Mutex
+		ranges   []string
+	)
+
+	// serve serves model in responses of at most chunk bytes, dropping the
+	// connection after that, with ranges when withRanges is true
+	serve := func(chunk int, withRanges bool) *httptest.Server {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			mu.Lock()
+			ranges = append(ranges, r.Header.Get("Range"))
+			mu.Unlock()
+
+			start, status := 0, http.StatusOK
+			if rng := r.Header.Get("Range"); rng != "" && withRanges {
+				fmt.Sscanf(rng, "bytes=%d-", &start)
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(model)-1, len(model)))
+				status = http.StatusPartialContent
+			}
+			w.Header().Set("Content-Length", strconv.Itoa(len(model)-start))
+			w.WriteHeader(status)
+			end := min(start+chunk, len(model))
+			w.Write(model[start:end])
+			if end < len(model) {
+				w.(http.Flusher).Flush()
+				conn, _, err := w.(http.Hijacker).Hijack()
+				Expect(err).ToNot(HaveOccurred())
+				conn.Close()
+			}
+		}))
+		DeferCleanup(server.Close)
+		return server
+	}
+
+	BeforeEach(func() {
+		var err error
+		cache, err = fetch.NewCache(filepath.Join(GinkgoT().TempDir(), "models"))
+		Expect(err).ToNot(HaveOccurred())
+		cache.SetRetries(2, time.Millisecond)
+		requests.Store(0)
+		ranges = nil
+	})
+
+	It("resumes dropped downloads", func() {
+		server := serve(100<<10, true)
+
+		path, err := cache.Fetch(context.Background(), fetch.Source{URL: server.URL + "/model.gguf", SHA256: sum, Size: int64(len(model))})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(path).To(Equal(cache.Path(sum)))
+		Expect(os.ReadFile(path)).To(Equal(model))
+		Expect(os.ReadFile(path + ".sha256")).To(Equal([]byte(sum + "  " + sum + ".gguf\n")))
+		Expect(path + ".partial").ToNot(BeAnExistingFile())
+		Expect(requests.Load()).To(BeNumerically("==", 11))
+		Expect(ranges[:2]).To(Equal([]string{"", "bytes=102400-"}))
+
+		// the model is served from the cache from now on
+		path, err = cache.Fetch(context.Background(), fetch.Source{URL: server.URL + "/model.gguf", SHA256: sum})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(path).To(Equal(cache.Path(sum)))
+		Expect(requests.Load()).To(BeNumerically("==", 11))
+	})
+
+	It("resumes downloads left by another process", func() {
+		server := serve(len(model), true)
+		Expect(os.WriteFile(cache.Path(sum)+".partial", model[:1000], 0o644)).To(Succeed())
+
+		path, err := cache.Fetch(context.Background(), fetch.Source{URL: server.URL + "/model.gguf", SHA256: sum})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.ReadFile(path)).To(Equal(model))
+		Expect(ranges).To(Equal([]string{"bytes=1000-"}))
+	})
+
+	It("starts over with servers without ranges", func() {
+		server := serve(len(model), false)
+		Expect(os.WriteFile(cache.Path(sum)+".partial", []byte("garbage"), 0o644)).To(Succeed())
+
+		path, err := cache.Fetch(context.Background(), fetch.Source{URL: server.URL + "/model.gguf", SHA256: sum})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.ReadFile(path)).To(Equal(model))
+	})
+
+	It("rejects models with the wrong size or SHA-256", func() {
+		server := serve(len(model), true)
+		wrong := fmt.Sprintf("%x", sha256.Sum256(nil))
+
+		_, err := cache.Fetch(context.Background(), fetch.Source{URL: server.URL + "/model.gguf", SHA256: wrong})
+		Expect(err).To(MatchError(fetch.ErrChecksum))
+		Expect(cache.Path(wrong)).ToNot(BeAnExistingFile())
+		Expect(cache.Path(wrong) + ".partial").ToNot(BeAnExistingFile())
+
+		_, err = cache.Fetch(context.Background(), fetch.Source{URL: server.URL + "/model.gguf", SHA256: sum, Size: 1000})
+		Expect(err).To(MatchError(fetch.ErrChecksum))
+		Expect(cache.Path(sum)).ToNot(BeAnExistingFile())
+
+		_, err = cache.Fetch(context.Background(), fetch.Source{URL: server.URL + "/model.gguf", SHA256: "not hex"})
+		Expect(err).To(MatchError(ContainSubstring("invalid SHA-256")))
+	})
+
+	It("gives up on failing servers", func() {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		defer server.Close()
+
+		_, err := cache.Fetch(context.Background(), fetch.Source{URL: server.URL + "/model.gguf", SHA256: sum})
+		Expect(err).To(MatchError(ContainSubstring("503")))
+		Expect(requests.Load()).To(BeNumerically("==", 3))
+
+		requests.Store(0)
+		server.Config.Handler = http.NotFoundHandler()
+		_, err = cache.Fetch(context.Background(), fetch.Source{URL: server.URL + "/model.gguf", SHA256: sum})
+		Expect(err).To(MatchError(ContainSubstring("404")))
+	})
+
+	It("fetches from mirrors and local files", func() {
+		server := serve(len(model), true)
+		mirror := GinkgoT().TempDir()
+		local := filepath.Join(GinkgoT().TempDir(), "model.gguf")
+		Expect(os.WriteFile(local, model, 0o644)).To(Succeed())
+
+		path, err := cache.Fetch(context.Background(), fetch.Source{URL: (&url.URL{Scheme: "file", Path: filepath.ToSlash(local)}).String(), SHA256: sum})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.ReadFile(path)).To(Equal(model))
+		Expect(os.Remove(path)).To(Succeed())
+
+		// the mirror does not have the model yet
+		cache.SetMirrors((&url.URL{Scheme: "file", Path: filepath.ToSlash(mirror)}).String())
+		_, err = cache.Fetch(context.Background(), fetch.Source{URL: server.URL + "/llama/model.gguf", SHA256: sum})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(requests.Load()).To(BeNumerically("==", 1))
+		Expect(os.Remove(path)).To(Succeed())
+
+		Expect(os.MkdirAll(filepath.Join(mirror, "llama"), 0o755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(mirror, "llama", "model.gguf"), model, 0o644)).To(Succeed())
+		_, err = cache.Fetch(context.Background(), fetch.Source{URL: server.URL + "/llama/model.gguf", SHA256: sum})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(os.ReadFile(path)).To(Equal(model))
+		Expect(requests.Load()).To(BeNumerically("==", 1))
+	})
+
+	It("downloads models fetched concurrently once", func() {
+		server := serve(len(model), true)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				path, err := cache.Fetch(context.Background(), fetch.Source{URL: server.URL + "/model.gguf", SHA256: sum})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(os.ReadFile(path)).To(Equal(model))
+			}()
+		}
+		wg.Wait()
+		Expect(requests.Load()).To(BeNumerically("==", 1))
+	})
+
+	It("stops waiting for another download when the context is done", func() {
+		release := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			<-release
+			w.Write(model)
+		}))
+		DeferCleanup(server.Close)
+		src := fetch.Source{URL: server.URL + "/model.gguf", SHA256: sum}
+
+		done := make(chan error)
+		go func() {
+			_, err := cache.Fetch(context.Background(), src)
+			done <- err
+		}()
+		Eventually(requests.Load).Should(BeNumerically("==", 1))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		_, err := cache.Fetch(ctx, src)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+
+		close(release)
+		Expect(<-done).To(Succeed())
+	})
+})
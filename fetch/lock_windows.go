@@ -0,0 +1,62 @@
+//go:build windows
+// +build windows
+
+package fetch
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+	procLockFileEx   = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx = modkernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x01
+	lockfileExclusiveLock   = 0x02
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// tryLockFile takes an exclusive advisory lock on f if it is available, and
+// reports false instead of blocking otherwise
+func tryLockFile(f *os.File) (bool, error) {
+	var overlapped syscall.Overlapped
+	ret, _, err := procLockFileEx.Call(
+		f.Fd(),
+		lockfileExclusiveLock|lockfileFailImmediately,
+		0,
+		0xFFFFFFFF,
+		0xFFFFFFFF,
+		uintptr(unsafe.Pointer(&overlapped)),
+	)
+	if ret == 0 {
+		if err == errorLockViolation {
+			return false, nil
+		}
+		return false, fmt.Errorf("LockFileEx failed: %v", err)
+	}
+	return true, nil
+}
+
+// unlockFile releases a lock taken with tryLockFile
+func unlockFile(f *os.File) error {
+	var overlapped syscall.Overlapped
+	ret, _, err := procUnlockFileEx.Call(
+		f.Fd(),
+		0,
+		0xFFFFFFFF,
+		0xFFFFFFFF,
+		uintptr(unsafe.Pointer(&overlapped)),
+	)
+	if ret == 0 {
+		return fmt.Errorf("UnlockFileEx failed: %v", err)
+	}
+	return nil
+}
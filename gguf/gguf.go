@@ -0,0 +1,204 @@
+// Package gguf reads GGUF model files in pure Go, without cgo or loading the
+// model: the header, the metadata key-values and the tensor info table.
+//
+// GGUF versions 1 to 3 are supported, including big endian version 3 files.
+// Every length and count read from the file is checked against its size, so
+// truncated or malicious files fail with an error instead of allocating
+// unbounded memory.
+package gguf
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Magic is the first 4 bytes of a GGUF file, "GGUF" read as a little endian
+// uint32.
+const Magic = 0x46554747
+
+// DefaultAlignment is the alignment of the tensor data when the file does
+// not set general.alignment.
+const DefaultAlignment = 32
+
+// MaxDims is the maximum number of dimensions of a tensor.
+const MaxDims = 4
+
+var (
+	// ErrNotGGUF is returned when the file does not start with Magic.
+	ErrNotGGUF = errors.New("not a GGUF file")
+	// ErrUnsupportedVersion is returned for GGUF versions other than 1 to 3.
+	ErrUnsupportedVersion = errors.New("unsupported GGUF version")
+	// ErrTruncated is returned when the header goes past the end of the file.
+	ErrTruncated = errors.New("GGUF file is truncated")
+)
+
+// ValueType is the type of a metadata value.
+type ValueType uint32
+
+const (
+	TypeUint8 ValueType = iota
+	TypeInt8
+	TypeUint16
+	TypeInt16
+	TypeUint32
+	TypeInt32
+	TypeFloat32
+	TypeBool
+	TypeString
+	TypeArray
+	TypeUint64
+	TypeInt64
+	TypeFloat64
+)
+
+var valueTypeNames = [...]string{
+	TypeUint8:   "uint8",
+	TypeInt8:    "int8",
+	TypeUint16:  "uint16",
+	TypeInt16:   "int16",
+	TypeUint32:  "uint32",
+	TypeInt32:   "int32",
+	TypeFloat32: "float32",
+	TypeBool:    "bool",
+	TypeString:  "string",
+	TypeArray:   "array",
+	TypeUint64:  "uint64",
+	TypeInt64:   "int64",
+	TypeFloat64: "float64",
+}
+
+func (t ValueType) String() string {
+	if int(t) < len(valueTypeNames) {
+		return valueTypeNames[t]
+	}
+	return fmt.Sprintf("ValueType(%d)", uint32(t))
+}
+
+// size is the encoded size of a scalar value, 0 for strings and arrays.
+func (t ValueType) size() int64 {
+	switch t {
+	case TypeUint8, TypeInt8, TypeBool:
+		return 1
+	case TypeUint16, TypeInt16:
+		return 2
+	case TypeUint32, TypeInt32, TypeFloat32:
+		return 4
+	case TypeUint64, TypeInt64, TypeFloat64:
+		return 8
+	}
+	return 0
+}
+
+// Array is a metadata value of type TypeArray. Values holds Go values of the
+// element type, as described by KV.
+type Array struct {
+	Type   ValueType
+	Values []any
+}
+
+// KV is a metadata key-value. Value is a uint8, int8, uint16, int16, uint32,
+// int32, float32, bool, string, uint64, int64, float64 or Array, following
+// Type.
+type KV struct {
+	Key   string
+	Type  ValueType
+	Value any
+}
+
+// GGMLType is the type of the elements of a tensor.
+type GGMLType uint32
+
+const (
+	GGMLTypeF32  GGMLType = 0
+	GGMLTypeF16  GGMLType = 1
+	GGMLTypeQ4_0 GGMLType = 2
+	GGMLTypeQ4_1 GGMLType = 3
+	GGMLTypeQ5_0 GGMLType = 6
+	GGMLTypeQ5_1 GGMLType = 7
+	GGMLTypeQ8_0 GGMLType = 8
+	GGMLTypeQ8_1 GGMLType = 9
+	GGMLTypeQ2_K GGMLType = 10
+	GGMLTypeQ3_K GGMLType = 11
+	GGMLTypeQ4_K GGMLType = 12
+	GGMLTypeQ5_K GGMLType = 13
+	GGMLTypeQ6_K GGMLType = 14
+	GGMLTypeQ8_K GGMLType = 15
+	GGMLTypeI8   GGMLType = 16
+	GGMLTypeI16  GGMLType = 17
+	GGMLTypeI32  GGMLType = 18
+)
+
+// ggmlTypeTraits is the number of elements in a block of each type, and the
+// bytes the block takes.
+var ggmlTypeTraits = map[GGMLType]struct {
+	name       string
+	blockElems int64
+	blockSize  int64
+}{
+	GGMLTypeF32:  {"F32", 1, 4},
+	GGMLTypeF16:  {"F16", 1, 2},
+	GGMLTypeQ4_0: {"Q4_0", 32, 18},
+	GGMLTypeQ4_1: {"Q4_1", 32, 20},
+	GGMLTypeQ5_0: {"Q5_0", 32, 22},
+	GGMLTypeQ5_1: {"Q5_1", 32, 24},
+	GGMLTypeQ8_0: {"Q8_0", 32, 34},
+	GGMLTypeQ8_1: {"Q8_1", 32, 40},
+	GGMLTypeQ2_K: {"Q2_K", 256, 84},
+	GGMLTypeQ3_K: {"Q3_K", 256, 110},
+	GGMLTypeQ4_K: {"Q4_K", 256, 144},
+	GGMLTypeQ5_K: {"Q5_K", 256, 176},
+	GGMLTypeQ6_K: {"Q6_K", 256, 210},
+	GGMLTypeQ8_K: {"Q8_K", 256, 292},
+	GGMLTypeI8:   {"I8", 1, 1},
+	GGMLTypeI16:  {"I16", 1, 2},
+	GGMLTypeI32:  {"I32", 1, 4},
+}
+
+func (t GGMLType) String() string {
+	if traits, ok := ggmlTypeTraits[t]; ok {
+		return traits.name
+	}
+	return fmt.Sprintf("GGMLType(%d)", uint32(t))
+}
+
+// TensorInfo describes a tensor of the file.
+type TensorInfo struct {
+	Name  string
+	Shape []uint64
+	Type  GGMLType
+	// Offset of the data of the tensor from File.DataOffset
+	Offset uint64
+}
+
+// Elements is the number of elements of the tensor, or -1 if it overflows.
+func (t TensorInfo) Elements() int64 {
+	n := int64(1)
+	for _, d := range t.Shape {
+		if d > math.MaxInt64 || (d != 0 && n > math.MaxInt64/int64(d)) {
+			return -1
+		}
+		n *= int64(d)
+	}
+	return n
+}
+
+// Size is the number of bytes taken by the data of the tensor.
+func (t TensorInfo) Size() (int64, error) {
+	traits, ok := ggmlTypeTraits[t.Type]
+	if !ok {
+		return 0, fmt.Errorf("tensor %s has an unknown type %d", t.Name, uint32(t.Type))
+	}
+	n := t.Elements()
+	if n < 0 {
+		return 0, fmt.Errorf("tensor %s is too large", t.Name)
+	}
+	if len(t.Shape) > 0 && t.Shape[0]%uint64(traits.blockElems) != 0 {
+		return 0, fmt.Errorf("tensor %s has %d columns, not a multiple of the %s block size", t.Name, t.Shape[0], traits.name)
+	}
+	blocks := n / traits.blockElems
+	if blocks > math.MaxInt64/traits.blockSize {
+		return 0, fmt.Errorf("tensor %s is too large", t.Name)
+	}
+	return blocks * traits.blockSize, nil
+}
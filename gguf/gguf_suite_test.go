@@ -0,0 +1,13 @@
+package gguf_test
+
+import (
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestGGUF(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "gguf test suite")
+}
@@ -0,0 +1,384 @@
+package gguf_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+
+	"github.com/go-skynet/go-llama.cpp/gguf"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// encoder writes GGUF headers by hand, to test the reader against the format
+// rather than against its own writer.
+type encoder struct {
+	bytes.Buffer
+	order   binary.ByteOrder
+	version uint32
+}
+
+func newEncoder(version uint32, order binary.ByteOrder, nTensors, nKV uint64) *encoder {
+	e := &encoder{order: order, version: version}
+	e.Write([]byte("GGUF"))
+	e.u32(version)
+	e.count(nTensors)
+	e.count(nKV)
+	return e
+}
+
+func (e *encoder) u32(v uint32) { binary.Write(e, e.order, v) }
+func (e *encoder) u64(v uint64) { binary.Write(e, e.order, v) }
+
+func (e *encoder) count(n uint64) {
+	if e.version == 1 {
+		e.u32(uint32(n))
+	} else {
+		e.u64(n)
+	}
+}
+
+func (e *encoder) str(s string) {
+	e.count(uint64(len(s)))
+	e.WriteString(s)
+}
+
+func (e *encoder) kv(key string, typ gguf.ValueType, value any) {
+	e.str(key)
+	e.u32(uint32(typ))
+	e.value(typ, value)
+}
+
+func (e *encoder) value(typ gguf.ValueType, value any) {
+	switch typ {
+	case gguf.TypeString:
+		e.str(value.(string))
+	case gguf.TypeArray:
+		a := value.(gguf.Array)
+		e.u32(uint32(a.Type))
+		e.count(uint64(len(a.Values)))
+		for _, v := range a.Values {
+			e.value(a.Type, v)
+		}
+	default:
+		binary.Write(e, e.order, value)
+	}
+}
+
+func (e *encoder) tensor(name string, shape []uint64, typ gguf.GGMLType, offset uint64) {
+	e.str(name)
+	e.u32(uint32(len(shape)))
+	for _, d := range shape {
+		e.count(d)
+	}
+	e.u32(uint32(typ))
+	e.u64(offset)
+}
+
+// pad aligns the end of the header and appends size bytes of tensor data.
+func (e *encoder) pad(size int) []byte {
+	e.Write(make([]byte, (32-e.Len()%32)%32+size))
+	return e.Bytes()
+}
+
+var kvs = []gguf.KV{
+	{Key: "general.architecture", Type: gguf.TypeString, Value: "llama"},
+	{Key: "u8", Type: gguf.TypeUint8, Value: uint8(200)},
+	{Key: "i8", Type: gguf.TypeInt8, Value: int8(-100)},
+	{Key: "u16", Type: gguf.TypeUint16, Value: uint16(60000)},
+	{Key: "i16", Type: gguf.TypeInt16, Value: int16(-30000)},
+	{Key: "u32", Type: gguf.TypeUint32, Value: uint32(4000000000)},
+	{Key: "i32", Type: gguf.TypeInt32, Value: int32(-2000000000)},
+	{Key: "f32", Type: gguf.TypeFloat32, Value: float32(0.5)},
+	{Key: "bool", Type: gguf.TypeBool, Value: true},
+	{Key: "u64", Type: gguf.TypeUint64, Value: uint64(math.MaxUint64)},
+	{Key: "i64", Type: gguf.TypeInt64, Value: int64(math.MinInt64)},
+	{Key: "f64", Type: gguf.TypeFloat64, Value: math.Pi},
+	{Key: "tokens", Type: gguf.TypeArray, Value: gguf.Array{Type: gguf.TypeString, Values: []any{"<s>", "</s>", ""}}},
+	{Key: "scores", Type: gguf.TypeArray, Value: gguf.Array{Type: gguf.TypeFloat32, Values: []any{float32(1), float32(-1)}}},
+	{Key: "nested", Type: gguf.TypeArray, Value: gguf.Array{Type: gguf.TypeArray, Values: []any{
+		gguf.Array{Type: gguf.TypeInt32, Values: []any{int32(1), int32(2)}},
+		gguf.Array{Type: gguf.TypeBool, Values: []any{}},
+	}}},
+}
+
+func encodeModel(version uint32, order binary.ByteOrder) []byte {
+	e := newEncoder(version, order, 2, uint64(len(kvs)))
+	for _, kv := range kvs {
+		e.kv(kv.Key, kv.Type, kv.Value)
+	}
+	e.tensor("token_embd.weight", []uint64{64, 3}, gguf.GGMLTypeF32, 0)
+	e.tensor("output.weight", []uint64{256, 3}, gguf.GGMLTypeQ4_K, 768)
+	return e.pad(768 + 3*144)
+}
+
+var _ = Describe("GGUF reader", func() {
+	DescribeTable("reads every value type and the tensor infos",
+		func(version uint32, order binary.ByteOrder) {
+			data := encodeModel(version, order)
+			f, err := gguf.Read(bytes.NewReader(data), int64(len(data)))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(f.Version).To(Equal(version))
+			Expect(f.ByteOrder).To(Equal(order))
+			Expect(f.KV).To(Equal(kvs))
+			Expect(f.Architecture()).To(Equal("llama"))
+			_, ok := f.Int("u64")
+			Expect(ok).To(BeFalse())
+			i, ok := f.Int("i32")
+			Expect(ok).To(BeTrue())
+			Expect(i).To(BeEquivalentTo(-2000000000))
+			x, ok := f.Float("f32")
+			Expect(ok).To(BeTrue())
+			Expect(x).To(Equal(0.5))
+			tokens, ok := f.Strings("tokens")
+			Expect(ok).To(BeTrue())
+			Expect(tokens).To(Equal([]string{"<s>", "</s>", ""}))
+
+			Expect(f.Tensors).To(HaveLen(2))
+			Expect(f.DataOffset % 32).To(BeZero())
+			output, ok := f.Tensor("output.weight")
+			Expect(ok).To(BeTrue())
+			Expect(output.Shape).To(Equal([]uint64{256, 3}))
+			Expect(output.Type).To(Equal(gguf.GGMLTypeQ4_K))
+			Expect(output.Offset).To(BeEquivalentTo(768))
+			Expect(output.Size()).To(BeEquivalentTo(3 * 144))
+			Expect(f.DataOffset + int64(output.Offset) + 3*144).To(BeEquivalentTo(len(data)))
+		},
+		Entry("version 1", uint32(1), binary.ByteOrder(binary.LittleEndian)),
+		Entry("version 2", uint32(2), binary.ByteOrder(binary.LittleEndian)),
+		Entry("version 3", uint32(3), binary.ByteOrder(binary.LittleEndian)),
+		Entry("big endian version 3", uint32(3), binary.ByteOrder(binary.BigEndian)),
+	)
+
+	It("honours general.alignment", func() {
+		e := newEncoder(3, binary.LittleEndian, 1, 1)
+		e.kv("general.alignment", gguf.TypeUint32, uint32(64))
+		e.tensor("a", []uint64{1}, gguf.GGMLTypeF32, 0)
+		e.Write(make([]byte, (64-e.Len()%64)%64+4))
+
+		f, err := gguf.Read(bytes.NewReader(e.Bytes()), int64(e.Len()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Alignment).To(BeEquivalentTo(64))
+		Expect(f.DataOffset % 64).To(BeZero())
+	})
+
+	It("fails on every truncation of a file", func() {
+		data := encodeModel(3, binary.LittleEndian)
+		f, err := gguf.Read(bytes.NewReader(data), int64(len(data)))
+		Expect(err).ToNot(HaveOccurred())
+
+		for n := 0; n < int(f.DataOffset); n++ {
+			_, err := gguf.Read(bytes.NewReader(data[:n]), int64(n))
+			Expect(err).To(HaveOccurred(), "truncated at %d", n)
+		}
+	})
+
+	It("refuses lengths larger than the file before allocating them", func() {
+		e := newEncoder(3, binary.LittleEndian, 0, 1)
+		e.str("tokens")
+		e.u32(uint32(gguf.TypeArray))
+		e.u32(uint32(gguf.TypeUint64))
+		e.u64(1 << 60)
+		_, err := gguf.Read(bytes.NewReader(e.Bytes()), int64(e.Len()))
+		Expect(err).To(MatchError(gguf.ErrTruncated))
+
+		e = newEncoder(3, binary.LittleEndian, 0, 1)
+		e.u64(math.MaxUint64)
+		_, err = gguf.Read(bytes.NewReader(e.Bytes()), int64(e.Len()))
+		Expect(err).To(MatchError(gguf.ErrTruncated))
+
+		e = newEncoder(3, binary.LittleEndian, math.MaxUint64, 0)
+		_, err = gguf.Read(bytes.NewReader(e.Bytes()), int64(e.Len()))
+		Expect(err).To(MatchError(gguf.ErrTruncated))
+	})
+
+	It("refuses malformed headers", func() {
+		_, err := gguf.Read(bytes.NewReader([]byte("GGML\x01\x00\x00\x00")), 8)
+		Expect(err).To(MatchError(gguf.ErrNotGGUF))
+
+		e := newEncoder(4, binary.LittleEndian, 0, 0)
+		_, err = gguf.Read(bytes.NewReader(e.Bytes()), int64(e.Len()))
+		Expect(err).To(MatchError(gguf.ErrUnsupportedVersion))
+
+		e = newEncoder(3, binary.LittleEndian, 0, 1)
+		e.str("key")
+		e.u32(42)
+		_, err = gguf.Read(bytes.NewReader(e.Bytes()), int64(e.Len()))
+		Expect(err).To(MatchError(ContainSubstring("unknown value type 42")))
+
+		e = newEncoder(3, binary.LittleEndian, 0, 1)
+		e.str("deep")
+		e.u32(uint32(gguf.TypeArray))
+		for i := 0; i < 16; i++ {
+			e.u32(uint32(gguf.TypeArray))
+			e.u64(1)
+		}
+		_, err = gguf.Read(bytes.NewReader(e.Bytes()), int64(e.Len()))
+		Expect(err).To(MatchError(ContainSubstring("nested")))
+
+		e = newEncoder(3, binary.LittleEndian, 1, 0)
+		e.tensor("a", []uint64{1, 1, 1, 1, 1}, gguf.GGMLTypeF32, 0)
+		_, err = gguf.Read(bytes.NewReader(e.Bytes()), int64(e.Len()))
+		Expect(err).To(MatchError(ContainSubstring("5 dimensions")))
+
+		e = newEncoder(3, binary.LittleEndian, 0, 2)
+		e.kv("key", gguf.TypeUint8, uint8(1))
+		e.kv("key", gguf.TypeUint8, uint8(2))
+		_, err = gguf.Read(bytes.NewReader(e.Bytes()), int64(e.Len()))
+		Expect(err).To(MatchError(ContainSubstring("duplicate key")))
+	})
+
+	It("sizes tensors", func() {
+		Expect(gguf.TensorInfo{Shape: []uint64{4096, 32000}, Type: gguf.GGMLTypeQ4_0}.Size()).To(BeEquivalentTo(4096 / 32 * 18 * 32000))
+		Expect(gguf.TensorInfo{Shape: []uint64{4096}, Type: gguf.GGMLTypeF16}.Size()).To(BeEquivalentTo(8192))
+
+		_, err := gguf.TensorInfo{Shape: []uint64{100}, Type: gguf.GGMLTypeQ8_0}.Size()
+		Expect(err).To(HaveOccurred())
+		_, err = gguf.TensorInfo{Shape: []uint64{1 << 40, 1 << 40}, Type: gguf.GGMLTypeF32}.Size()
+		Expect(err).To(HaveOccurred())
+		_, err = gguf.TensorInfo{Shape: []uint64{1}, Type: 99}.Size()
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+// encodeModelWithData is encodeModel with random tensor data.
+func encodeModelWithData(version uint32, order binary.ByteOrder) []byte {
+	data := encodeModel(version, order)
+	rand.New(rand.NewSource(1)).Read(data[len(data)-768-3*144:])
+	return data
+}
+
+// tensorData returns the bytes of every tensor of the file in data.
+func tensorData(data []byte) map[string][]byte {
+	f, err := gguf.Read(bytes.NewReader(data), int64(len(data)))
+	Expect(err).ToNot(HaveOccurred())
+
+	tensors := map[string][]byte{}
+	for _, t := range f.Tensors {
+		size, err := t.Size()
+		Expect(err).ToNot(HaveOccurred())
+		start := f.DataOffset + int64(t.Offset)
+		Expect(start % f.Alignment).To(BeZero())
+		tensors[t.Name] = data[start : start+size]
+	}
+	return tensors
+}
+
+var _ = Describe("GGUF writer", func() {
+	DescribeTable("rewrites files with edited metadata and identical tensors",
+		func(version uint32, order binary.ByteOrder, alignment uint32) {
+			data := encodeModelWithData(version, order)
+			f, err := gguf.Read(bytes.NewReader(data), int64(len(data)))
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(f.Set("general.architecture", gguf.TypeString, "mistral")).To(Succeed())
+			Expect(f.Set("tokenizer.chat_template", gguf.TypeString, "{{ messages }}")).To(Succeed())
+			Expect(f.Delete("i8")).To(BeTrue())
+			Expect(f.Delete("missing")).To(BeFalse())
+			Expect(f.Set("u8", gguf.TypeUint8, "x")).ToNot(Succeed())
+			if alignment != gguf.DefaultAlignment {
+				Expect(f.Set("general.alignment", gguf.TypeUint32, alignment)).To(Succeed())
+			}
+
+			var out bytes.Buffer
+			Expect(gguf.Rewrite(&out, bytes.NewReader(data), f)).To(Succeed())
+
+			edited, err := gguf.Read(bytes.NewReader(out.Bytes()), int64(out.Len()))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(edited.Version).To(Equal(version))
+			Expect(edited.ByteOrder).To(Equal(order))
+			Expect(edited.Alignment).To(BeEquivalentTo(alignment))
+			Expect(edited.KV).To(Equal(f.KV))
+			Expect(edited.Architecture()).To(Equal("mistral"))
+			_, ok := edited.Lookup("i8")
+			Expect(ok).To(BeFalse())
+			Expect(tensorData(out.Bytes())).To(Equal(tensorData(data)))
+		},
+		Entry("version 1", uint32(1), binary.ByteOrder(binary.LittleEndian), uint32(32)),
+		Entry("version 3", uint32(3), binary.ByteOrder(binary.LittleEndian), uint32(32)),
+		Entry("big endian version 3", uint32(3), binary.ByteOrder(binary.BigEndian), uint32(32)),
+		Entry("a new alignment", uint32(3), binary.ByteOrder(binary.LittleEndian), uint32(256)),
+	)
+
+	It("writes files from scratch", func() {
+		f := &gguf.File{Version: 3, ByteOrder: binary.LittleEndian}
+		Expect(f.Set("general.architecture", gguf.TypeString, "llama")).To(Succeed())
+		f.Tensors = []gguf.TensorInfo{
+			{Name: "a", Shape: []uint64{3}, Type: gguf.GGMLTypeF32},
+			{Name: "b", Shape: []uint64{5}, Type: gguf.GGMLTypeI8},
+		}
+		Expect(f.Layout()).To(Succeed())
+		Expect(f.Tensors[1].Offset).To(BeEquivalentTo(32))
+
+		var out bytes.Buffer
+		w, err := gguf.NewWriter(&out, f)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(w.WriteTensor(bytes.NewReader(make([]byte, 12)), 12)).To(Succeed())
+		Expect(w.Close()).To(MatchError(ContainSubstring("1 tensors were not written")))
+		Expect(w.WriteTensor(bytes.NewReader([]byte{1, 2}), 5)).To(MatchError(ContainSubstring("truncated")))
+
+		out.Reset()
+		w, err = gguf.NewWriter(&out, f)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(w.WriteTensor(bytes.NewReader(make([]byte, 40)), 40)).To(MatchError(ContainSubstring("overlaps")))
+		Expect(w.WriteTensor(bytes.NewReader(make([]byte, 12)), 12)).To(Succeed())
+		Expect(w.WriteTensor(bytes.NewReader([]byte{1, 2, 3, 4, 5}), 5)).To(Succeed())
+		Expect(w.Close()).To(Succeed())
+		Expect(out.Len() % 32).To(BeZero())
+		Expect(tensorData(out.Bytes())["b"]).To(Equal([]byte{1, 2, 3, 4, 5}))
+	})
+})
+
+var _ = Describe("GGUF validation", func() {
+	validate := func(e *encoder, dataSize int) []error {
+		data := e.pad(dataSize)
+		f, err := gguf.Read(bytes.NewReader(data), int64(len(data)))
+		Expect(err).ToNot(HaveOccurred())
+		return f.Validate()
+	}
+
+	It("accepts consistent files", func() {
+		data := encodeModel(3, binary.LittleEndian)
+		f, err := gguf.Read(bytes.NewReader(data), int64(len(data)))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(f.Validate()).To(BeEmpty())
+	})
+
+	It("reports tensors out of the file, misaligned, overlapping or of unknown types", func() {
+		e := newEncoder(3, binary.LittleEndian, 4, 1)
+		e.kv("general.architecture", gguf.TypeString, "llama")
+		e.tensor("a", []uint64{16}, gguf.GGMLTypeF32, 0)
+		e.tensor("b", []uint64{16}, gguf.GGMLTypeF32, 32)
+		e.tensor("c", []uint64{16}, gguf.GGMLTypeF32, 100)
+		e.tensor("d", []uint64{16}, 99, 128)
+		problems := validate(e, 96)
+
+		Expect(problems).To(HaveLen(4))
+		Expect(problems[0]).To(MatchError(ContainSubstring("tensor c at offset 100 is not aligned to 32")))
+		Expect(problems[1]).To(MatchError(ContainSubstring("tensor c of 64 bytes")))
+		Expect(problems[1]).To(MatchError(ContainSubstring("past the end of the file")))
+		Expect(problems[2]).To(MatchError(ContainSubstring("tensor d has an unknown type 99")))
+		Expect(problems[3]).To(MatchError(ContainSubstring("tensor b")))
+		Expect(problems[3]).To(MatchError(ContainSubstring("overlaps tensor a")))
+	})
+
+	It("reports vocabularies inconsistent with their declared size", func() {
+		e := newEncoder(3, binary.LittleEndian, 1, 6)
+		e.kv("general.architecture", gguf.TypeString, "llama")
+		e.kv("llama.vocab_size", gguf.TypeUint32, uint32(4))
+		e.kv("tokenizer.ggml.tokens", gguf.TypeArray, gguf.Array{Type: gguf.TypeString, Values: []any{"a", "b", "c"}})
+		e.kv("tokenizer.ggml.scores", gguf.TypeArray, gguf.Array{Type: gguf.TypeFloat32, Values: []any{float32(0), float32(0)}})
+		e.kv("tokenizer.ggml.eos_token_id", gguf.TypeUint32, uint32(3))
+		e.kv("tokenizer.ggml.bos_token_id", gguf.TypeUint32, uint32(0))
+		e.tensor("token_embd.weight", []uint64{8, 5}, gguf.GGMLTypeF32, 0)
+		problems := validate(e, 160)
+
+		Expect(problems).To(HaveLen(4))
+		Expect(problems[0]).To(MatchError("tokenizer.ggml.scores has 2 entries for 3 tokens"))
+		Expect(problems[1]).To(MatchError("llama.vocab_size is 4 but the tokenizer has 3 tokens"))
+		Expect(problems[2]).To(MatchError("tensor token_embd.weight has 5 rows but the tokenizer has 3 tokens"))
+		Expect(problems[3]).To(MatchError("tokenizer.ggml.eos_token_id is 3, outside of the 3 tokens"))
+	})
+})
@@ -0,0 +1,453 @@
+package gguf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+)
+
+// maxArrayDepth bounds the nesting of arrays in metadata values.
+const maxArrayDepth = 8
+
+// File is the header of a GGUF file.
+type File struct {
+	Version uint32
+	// Byte order of the file, big endian files exist since version 3
+	ByteOrder binary.ByteOrder
+	// Metadata in file order
+	KV      []KV
+	Tensors []TensorInfo
+	// Alignment of the tensor data, from general.alignment
+	Alignment int64
+	// Offset of the tensor data from the start of the file
+	DataOffset int64
+	// Size of the file
+	Size int64
+
+	kvIndex     map[string]int
+	tensorIndex map[string]int
+}
+
+// Open reads the header of the GGUF file at path.
+func Open(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return Read(f, info.Size())
+}
+
+// Read reads the header of the GGUF file of the given size from r.
+func Read(r io.ReaderAt, size int64) (*File, error) {
+	d := &decoder{
+		r:     bufio.NewReaderSize(io.NewSectionReader(r, 0, size), 1<<16),
+		size:  size,
+		order: binary.LittleEndian,
+	}
+
+	magic, err := d.u32()
+	if err != nil {
+		return nil, err
+	}
+	if magic != Magic {
+		return nil, fmt.Errorf("%w: magic number is %08x", ErrNotGGUF, magic)
+	}
+
+	f := &File{Alignment: DefaultAlignment, Size: size}
+	if f.Version, err = d.u32(); err != nil {
+		return nil, err
+	}
+	if f.Version&0xffff == 0 && f.Version != 0 {
+		// the version of a big endian file reads byte swapped
+		d.order = binary.BigEndian
+		f.Version = bits.ReverseBytes32(f.Version)
+	}
+	if f.Version < 1 || f.Version > 3 {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, f.Version)
+	}
+	f.ByteOrder = d.order
+	d.v1 = f.Version == 1
+
+	// every tensor info takes at least 4+4+4+8 bytes, every key-value 4+4+1
+	nTensors, err := d.count(20)
+	if err != nil {
+		return nil, err
+	}
+	nKV, err := d.count(9)
+	if err != nil {
+		return nil, err
+	}
+
+	f.KV = make([]KV, 0, nKV)
+	f.kvIndex = make(map[string]int, nKV)
+	for i := int64(0); i < nKV; i++ {
+		kv, err := d.kv()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := f.kvIndex[kv.Key]; ok {
+			return nil, fmt.Errorf("duplicate key %s", kv.Key)
+		}
+		f.kvIndex[kv.Key] = len(f.KV)
+		f.KV = append(f.KV, kv)
+	}
+
+	if kv, ok := f.Lookup("general.alignment"); ok {
+		a, ok := toInt(kv.Value)
+		if !ok || a <= 0 || a&(a-1) != 0 {
+			return nil, fmt.Errorf("invalid general.alignment %v", kv.Value)
+		}
+		f.Alignment = a
+	}
+
+	f.Tensors = make([]TensorInfo, 0, nTensors)
+	f.tensorIndex = make(map[string]int, nTensors)
+	for i := int64(0); i < nTensors; i++ {
+		t, err := d.tensorInfo()
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := f.tensorIndex[t.Name]; ok {
+			return nil, fmt.Errorf("duplicate tensor %s", t.Name)
+		}
+		f.tensorIndex[t.Name] = len(f.Tensors)
+		f.Tensors = append(f.Tensors, t)
+	}
+
+	f.DataOffset = (d.off + f.Alignment - 1) / f.Alignment * f.Alignment
+	if f.DataOffset > size {
+		if len(f.Tensors) > 0 {
+			return nil, fmt.Errorf("%w: tensor data is missing", ErrTruncated)
+		}
+		// a file without tensors may end without padding
+		f.DataOffset = size
+	}
+	return f, nil
+}
+
+// Lookup returns the metadata value of key.
+func (f *File) Lookup(key string) (KV, bool) {
+	i, ok := f.kvIndex[key]
+	if !ok {
+		return KV{}, false
+	}
+	return f.KV[i], true
+}
+
+// String returns the value of key if it is a string.
+func (f *File) String(key string) (string, bool) {
+	kv, ok := f.Lookup(key)
+	if !ok {
+		return "", false
+	}
+	s, ok := kv.Value.(string)
+	return s, ok
+}
+
+// Int returns the value of key if it is an integer that fits in an int64.
+func (f *File) Int(key string) (int64, bool) {
+	kv, ok := f.Lookup(key)
+	if !ok {
+		return 0, false
+	}
+	return toInt(kv.Value)
+}
+
+// Float returns the value of key if it is a floating point number.
+func (f *File) Float(key string) (float64, bool) {
+	kv, ok := f.Lookup(key)
+	if !ok {
+		return 0, false
+	}
+	switch v := kv.Value.(type) {
+	case float32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// Bool returns the value of key if it is a bool.
+func (f *File) Bool(key string) (bool, bool) {
+	kv, ok := f.Lookup(key)
+	if !ok {
+		return false, false
+	}
+	b, ok := kv.Value.(bool)
+	return b, ok
+}
+
+// Strings returns the value of key if it is an array of strings.
+func (f *File) Strings(key string) ([]string, bool) {
+	kv, ok := f.Lookup(key)
+	if !ok {
+		return nil, false
+	}
+	a, ok := kv.Value.(Array)
+	if !ok || a.Type != TypeString {
+		return nil, false
+	}
+	s := make([]string, len(a.Values))
+	for i, v := range a.Values {
+		s[i] = v.(string)
+	}
+	return s, true
+}
+
+// Architecture is the value of general.architecture.
+func (f *File) Architecture() string {
+	arch, _ := f.String("general.architecture")
+	return arch
+}
+
+// Tensor returns the tensor called name.
+func (f *File) Tensor(name string) (TensorInfo, bool) {
+	i, ok := f.tensorIndex[name]
+	if !ok {
+		return TensorInfo{}, false
+	}
+	return f.Tensors[i], true
+}
+
+func toInt(v any) (int64, bool) {
+	switch v := v.(type) {
+	case uint8:
+		return int64(v), true
+	case int8:
+		return int64(v), true
+	case uint16:
+		return int64(v), true
+	case int16:
+		return int64(v), true
+	case uint32:
+		return int64(v), true
+	case int32:
+		return int64(v), true
+	case uint64:
+		if v > math.MaxInt64 {
+			return 0, false
+		}
+		return int64(v), true
+	case int64:
+		return v, true
+	}
+	return 0, false
+}
+
+// decoder reads the header, refusing lengths that go past the end of the
+// file.
+type decoder struct {
+	r     *bufio.Reader
+	off   int64
+	size  int64
+	order binary.ByteOrder
+	v1    bool
+}
+
+func (d *decoder) read(n int64) ([]byte, error) {
+	if n < 0 || n > d.size-d.off {
+		return nil, fmt.Errorf("%w at offset %d", ErrTruncated, d.off)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(d.r, buf); err != nil {
+		return nil, fmt.Errorf("failed to read GGUF header at offset %d: %w", d.off, err)
+	}
+	d.off += n
+	return buf, nil
+}
+
+func (d *decoder) u32() (uint32, error) {
+	b, err := d.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint32(b), nil
+}
+
+func (d *decoder) u64() (uint64, error) {
+	b, err := d.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return d.order.Uint64(b), nil
+}
+
+// count reads a length or a count, which are 32 bits wide in version 1, of
+// items taking at least minSize bytes each. Counts that can not fit in the
+// rest of the file are refused before anything is allocated for them.
+func (d *decoder) count(minSize int64) (int64, error) {
+	var n uint64
+	if d.v1 {
+		v, err := d.u32()
+		if err != nil {
+			return 0, err
+		}
+		n = uint64(v)
+	} else {
+		v, err := d.u64()
+		if err != nil {
+			return 0, err
+		}
+		n = v
+	}
+	if minSize > 0 && n > uint64((d.size-d.off)/minSize) {
+		return 0, fmt.Errorf("%w: count %d at offset %d does not fit in the file", ErrTruncated, n, d.off)
+	}
+	return int64(n), nil
+}
+
+func (d *decoder) str() (string, error) {
+	n, err := d.count(1)
+	if err != nil {
+		return "", err
+	}
+	b, err := d.read(n)
+	return string(b), err
+}
+
+func (d *decoder) valueType() (ValueType, error) {
+	v, err := d.u32()
+	if err != nil {
+		return 0, err
+	}
+	t := ValueType(v)
+	if t > TypeFloat64 {
+		return 0, fmt.Errorf("unknown value type %d at offset %d", v, d.off-4)
+	}
+	return t, nil
+}
+
+func (d *decoder) kv() (KV, error) {
+	key, err := d.str()
+	if err != nil {
+		return KV{}, err
+	}
+	typ, err := d.valueType()
+	if err != nil {
+		return KV{}, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	v, err := d.value(typ, 0)
+	if err != nil {
+		return KV{}, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	return KV{Key: key, Type: typ, Value: v}, nil
+}
+
+func (d *decoder) value(typ ValueType, depth int) (any, error) {
+	if typ == TypeString {
+		return d.str()
+	}
+	if typ == TypeArray {
+		return d.array(depth + 1)
+	}
+
+	b, err := d.read(typ.size())
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case TypeUint8:
+		return b[0], nil
+	case TypeInt8:
+		return int8(b[0]), nil
+	case TypeBool:
+		if b[0] > 1 {
+			return nil, fmt.Errorf("invalid bool %d", b[0])
+		}
+		return b[0] == 1, nil
+	case TypeUint16:
+		return d.order.Uint16(b), nil
+	case TypeInt16:
+		return int16(d.order.Uint16(b)), nil
+	case TypeUint32:
+		return d.order.Uint32(b), nil
+	case TypeInt32:
+		return int32(d.order.Uint32(b)), nil
+	case TypeFloat32:
+		return math.Float32frombits(d.order.Uint32(b)), nil
+	case TypeUint64:
+		return d.order.Uint64(b), nil
+	case TypeInt64:
+		return int64(d.order.Uint64(b)), nil
+	case TypeFloat64:
+		return math.Float64frombits(d.order.Uint64(b)), nil
+	}
+	return nil, fmt.Errorf("unknown value type %d", uint32(typ))
+}
+
+func (d *decoder) array(depth int) (Array, error) {
+	if depth > maxArrayDepth {
+		return Array{}, fmt.Errorf("arrays are nested more than %d deep", maxArrayDepth)
+	}
+	elem, err := d.valueType()
+	if err != nil {
+		return Array{}, err
+	}
+	// strings and arrays take at least their length
+	minSize := elem.size()
+	if elem == TypeString || elem == TypeArray {
+		minSize = 8
+		if d.v1 {
+			minSize = 4
+		}
+	}
+	n, err := d.count(minSize)
+	if err != nil {
+		return Array{}, err
+	}
+
+	a := Array{Type: elem, Values: make([]any, n)}
+	for i := range a.Values {
+		if a.Values[i], err = d.value(elem, depth); err != nil {
+			return Array{}, err
+		}
+	}
+	return a, nil
+}
+
+func (d *decoder) tensorInfo() (TensorInfo, error) {
+	var t TensorInfo
+	var err error
+	if t.Name, err = d.str(); err != nil {
+		return t, err
+	}
+	nDims, err := d.u32()
+	if err != nil {
+		return t, err
+	}
+	if nDims > MaxDims {
+		return t, fmt.Errorf("tensor %s has %d dimensions", t.Name, nDims)
+	}
+	t.Shape = make([]uint64, nDims)
+	for i := range t.Shape {
+		if d.v1 {
+			v, err := d.u32()
+			if err != nil {
+				return t, err
+			}
+			t.Shape[i] = uint64(v)
+		} else if t.Shape[i], err = d.u64(); err != nil {
+			return t, err
+		}
+	}
+	typ, err := d.u32()
+	if err != nil {
+		return t, err
+	}
+	t.Type = GGMLType(typ)
+	if t.Offset, err = d.u64(); err != nil {
+		return t, err
+	}
+	return t, nil
+}
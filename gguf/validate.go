@@ -0,0 +1,104 @@
+package gguf
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Validate checks the integrity of a file read by Read beyond what parsing
+// it requires, and returns every problem found: tensors of unknown types,
+// misaligned, past the end of the file or overlapping each other, and
+// tokenizer arrays or special tokens inconsistent with the vocabulary size.
+// Duplicate keys and tensor names already fail Read.
+func (f *File) Validate() []error {
+	var problems []error
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if f.Architecture() == "" {
+		problem("general.architecture is not set")
+	}
+
+	type extent struct {
+		name       string
+		start, end int64
+	}
+	var extents []extent
+	for _, t := range f.Tensors {
+		if len(t.Shape) == 0 {
+			problem("tensor %s has no dimensions", t.Name)
+		}
+		size, err := t.Size()
+		if err != nil {
+			problems = append(problems, err)
+			continue
+		}
+		if int64(t.Offset)%f.Alignment != 0 {
+			problem("tensor %s at offset %d is not aligned to %d", t.Name, t.Offset, f.Alignment)
+		}
+		start := f.DataOffset + int64(t.Offset)
+		if t.Offset > uint64(f.Size) || start+size > f.Size || start+size < start {
+			problem("tensor %s of %d bytes at offset %d ends past the end of the file (%d bytes)", t.Name, size, start, f.Size)
+			continue
+		}
+		extents = append(extents, extent{t.Name, start, start + size})
+	}
+	sort.Slice(extents, func(i, j int) bool { return extents[i].start < extents[j].start })
+	for i := 1; i < len(extents); i++ {
+		if prev := extents[i-1]; extents[i].start < prev.end {
+			problem("tensor %s at offset %d overlaps tensor %s ending at offset %d", extents[i].name, extents[i].start, prev.name, prev.end)
+		}
+	}
+
+	return append(problems, f.validateVocab()...)
+}
+
+// validateVocab checks the tokenizer arrays against each other and against
+// the declared vocabulary size.
+func (f *File) validateVocab() []error {
+	var problems []error
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	tokens, ok := f.Lookup("tokenizer.ggml.tokens")
+	if !ok {
+		return nil
+	}
+	a, ok := tokens.Value.(Array)
+	if !ok || a.Type != TypeString {
+		problem("tokenizer.ggml.tokens is not an array of strings")
+		return problems
+	}
+	nVocab := int64(len(a.Values))
+
+	for _, key := range []string{"tokenizer.ggml.scores", "tokenizer.ggml.token_type"} {
+		kv, ok := f.Lookup(key)
+		if !ok {
+			continue
+		}
+		if a, ok := kv.Value.(Array); !ok {
+			problem("%s is not an array", key)
+		} else if int64(len(a.Values)) != nVocab {
+			problem("%s has %d entries for %d tokens", key, len(a.Values), nVocab)
+		}
+	}
+
+	if n, ok := f.Int(f.Architecture() + ".vocab_size"); ok && n != nVocab {
+		problem("%s.vocab_size is %d but the tokenizer has %d tokens", f.Architecture(), n, nVocab)
+	}
+	for _, name := range []string{"token_embd.weight", "output.weight"} {
+		if t, ok := f.Tensor(name); ok && len(t.Shape) == 2 && t.Shape[1] != uint64(nVocab) {
+			problem("tensor %s has %d rows but the tokenizer has %d tokens", name, t.Shape[1], nVocab)
+		}
+	}
+
+	for _, key := range []string{"bos", "eos", "unknown", "separator", "padding"} {
+		key = "tokenizer.ggml." + key + "_token_id"
+		if id, ok := f.Int(key); ok && (id < 0 || id >= nVocab) {
+			problem("%s is %d, outside of the %d tokens", key, id, nVocab)
+		}
+	}
+	return problems
+}
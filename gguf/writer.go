@@ -0,0 +1,402 @@
+package gguf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Set sets the metadata value of key, adding it after the existing ones if
+// it is new. value must be the Go type matching typ, as described by KV.
+func (f *File) Set(key string, typ ValueType, value any) error {
+	if err := checkValue(typ, value, 0); err != nil {
+		return fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	kv := KV{Key: key, Type: typ, Value: value}
+	if i, ok := f.kvIndex[key]; ok {
+		f.KV[i] = kv
+		return nil
+	}
+	if f.kvIndex == nil {
+		f.kvIndex = map[string]int{}
+	}
+	f.kvIndex[key] = len(f.KV)
+	f.KV = append(f.KV, kv)
+	return nil
+}
+
+// Delete removes the metadata value of key, and reports whether it existed.
+func (f *File) Delete(key string) bool {
+	i, ok := f.kvIndex[key]
+	if !ok {
+		return false
+	}
+	f.KV = append(f.KV[:i], f.KV[i+1:]...)
+	delete(f.kvIndex, key)
+	for j := i; j < len(f.KV); j++ {
+		f.kvIndex[f.KV[j].Key] = j
+	}
+	return true
+}
+
+func checkValue(typ ValueType, value any, depth int) error {
+	ok := false
+	switch typ {
+	case TypeUint8:
+		_, ok = value.(uint8)
+	case TypeInt8:
+		_, ok = value.(int8)
+	case TypeUint16:
+		_, ok = value.(uint16)
+	case TypeInt16:
+		_, ok = value.(int16)
+	case TypeUint32:
+		_, ok = value.(uint32)
+	case TypeInt32:
+		_, ok = value.(int32)
+	case TypeFloat32:
+		_, ok = value.(float32)
+	case TypeBool:
+		_, ok = value.(bool)
+	case TypeString:
+		_, ok = value.(string)
+	case TypeUint64:
+		_, ok = value.(uint64)
+	case TypeInt64:
+		_, ok = value.(int64)
+	case TypeFloat64:
+		_, ok = value.(float64)
+	case TypeArray:
+		var a Array
+		if a, ok = value.(Array); ok {
+			if depth >= maxArrayDepth {
+				return fmt.Errorf("arrays are nested more than %d deep", maxArrayDepth)
+			}
+			for _, v := range a.Values {
+				if err := checkValue(a.Type, v, depth+1); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("unknown value type %d", uint32(typ))
+	}
+	if !ok {
+		return fmt.Errorf("%T is not a %s", value, typ)
+	}
+	return nil
+}
+
+// Writer writes a GGUF file: NewWriter writes the header, then the data of
+// every tensor is written in the order of their offsets with WriteTensor.
+type Writer struct {
+	w         io.Writer
+	alignment int64
+	// tensors in the order of their data
+	tensors []TensorInfo
+	next    int
+	// bytes written in the data section
+	off int64
+}
+
+// NewWriter writes the header of f to w: its version, byte order, metadata
+// and tensor infos. The data section starts at the next multiple of the
+// alignment set by general.alignment, and every tensor at its Offset, which
+// must be aligned too.
+func NewWriter(w io.Writer, f *File) (*Writer, error) {
+	alignment := int64(DefaultAlignment)
+	if kv, ok := f.Lookup("general.alignment"); ok {
+		a, ok := toInt(kv.Value)
+		if !ok || a <= 0 || a&(a-1) != 0 {
+			return nil, fmt.Errorf("invalid general.alignment %v", kv.Value)
+		}
+		alignment = a
+	}
+	if f.Version < 1 || f.Version > 3 {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, f.Version)
+	}
+
+	tensors := append([]TensorInfo(nil), f.Tensors...)
+	sort.SliceStable(tensors, func(i, j int) bool { return tensors[i].Offset < tensors[j].Offset })
+	for _, t := range tensors {
+		if int64(t.Offset)%alignment != 0 {
+			return nil, fmt.Errorf("tensor %s at offset %d is not aligned to %d", t.Name, t.Offset, alignment)
+		}
+	}
+
+	e := &encoder{order: f.ByteOrder, v1: f.Version == 1}
+	if e.order == nil {
+		e.order = binary.LittleEndian
+	}
+	e.buf.WriteString("GGUF")
+	e.u32(f.Version)
+	if err := e.count(uint64(len(f.Tensors))); err != nil {
+		return nil, err
+	}
+	if err := e.count(uint64(len(f.KV))); err != nil {
+		return nil, err
+	}
+	for _, kv := range f.KV {
+		if err := e.kv(kv); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range f.Tensors {
+		if err := e.tensorInfo(t); err != nil {
+			return nil, err
+		}
+	}
+	e.buf.Write(make([]byte, padding(int64(e.buf.Len()), alignment)))
+
+	if _, err := w.Write(e.buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, alignment: alignment, tensors: tensors}, nil
+}
+
+// WriteTensor writes the size bytes of data of the next tensor read from r,
+// after the padding that puts it at its offset. The data must not run into
+// the next tensor.
+func (w *Writer) WriteTensor(r io.Reader, size int64) error {
+	if w.next >= len(w.tensors) {
+		return errors.New("every tensor is written already")
+	}
+	t := w.tensors[w.next]
+	if int64(t.Offset) < w.off {
+		return fmt.Errorf("tensor %s at offset %d overlaps the previous one", t.Name, t.Offset)
+	}
+	if w.next+1 < len(w.tensors) && int64(t.Offset)+size > int64(w.tensors[w.next+1].Offset) {
+		return fmt.Errorf("tensor %s of %d bytes overlaps the next one", t.Name, size)
+	}
+	if err := w.pad(int64(t.Offset) - w.off); err != nil {
+		return err
+	}
+
+	n, err := io.CopyN(w.w, r, size)
+	w.off += n
+	if err == io.EOF {
+		return fmt.Errorf("data of tensor %s is truncated", t.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write tensor %s: %w", t.Name, err)
+	}
+	w.next++
+	return nil
+}
+
+// Close pads the file after the last tensor. It fails if some tensors were
+// not written. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.next < len(w.tensors) {
+		return fmt.Errorf("%d tensors were not written", len(w.tensors)-w.next)
+	}
+	return w.pad(padding(w.off, w.alignment))
+}
+
+func (w *Writer) pad(n int64) error {
+	if n == 0 {
+		return nil
+	}
+	written, err := io.CopyN(w.w, zeros{}, n)
+	w.off += written
+	return err
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func padding(off, alignment int64) int64 {
+	return (alignment - off%alignment) % alignment
+}
+
+// Layout sets the offsets of the tensors of f so that their data follows
+// each other in order, each aligned as general.alignment requires.
+func (f *File) Layout() error {
+	alignment := int64(DefaultAlignment)
+	if a, ok := f.Int("general.alignment"); ok && a > 0 && a&(a-1) == 0 {
+		alignment = a
+	}
+	off := int64(0)
+	for i := range f.Tensors {
+		size, err := f.Tensors[i].Size()
+		if err != nil {
+			return err
+		}
+		f.Tensors[i].Offset = uint64(off)
+		off += size + padding(size, alignment)
+	}
+	return nil
+}
+
+// Rewrite writes to w the GGUF file read from src as f, with the metadata
+// of f, which may have been edited since. The tensor data is copied from
+// src unchanged. When the alignment is the same, the data section is copied
+// as a whole, otherwise every tensor is moved to its new offset.
+func Rewrite(w io.Writer, src io.ReaderAt, f *File) error {
+	out := *f
+	out.Tensors = append([]TensorInfo(nil), f.Tensors...)
+
+	alignment := int64(DefaultAlignment)
+	if a, ok := out.Int("general.alignment"); ok {
+		alignment = a
+	}
+	if alignment != f.Alignment {
+		if err := out.Layout(); err != nil {
+			return fmt.Errorf("failed to lay out the tensors for the new alignment: %w", err)
+		}
+	}
+
+	gw, err := NewWriter(w, &out)
+	if err != nil {
+		return err
+	}
+	if alignment == f.Alignment {
+		// keep the data section as it is, including tensors of unknown types
+		data := io.NewSectionReader(src, f.DataOffset, f.Size-f.DataOffset)
+		if _, err := io.Copy(w, data); err != nil {
+			return fmt.Errorf("failed to copy the tensor data: %w", err)
+		}
+		return nil
+	}
+
+	for _, t := range gw.tensors {
+		old, _ := f.Tensor(t.Name)
+		size, err := t.Size()
+		if err != nil {
+			return err
+		}
+		r := io.NewSectionReader(src, f.DataOffset+int64(old.Offset), size)
+		if err := gw.WriteTensor(r, size); err != nil {
+			return err
+		}
+	}
+	return gw.Close()
+}
+
+// encoder encodes a header in memory.
+type encoder struct {
+	buf   bytes.Buffer
+	order binary.ByteOrder
+	v1    bool
+}
+
+func (e *encoder) u16(v uint16) {
+	var b [2]byte
+	e.order.PutUint16(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) u32(v uint32) {
+	var b [4]byte
+	e.order.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) u64(v uint64) {
+	var b [8]byte
+	e.order.PutUint64(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) count(n uint64) error {
+	if e.v1 {
+		if n > math.MaxUint32 {
+			return fmt.Errorf("count %d does not fit in GGUF version 1", n)
+		}
+		e.u32(uint32(n))
+		return nil
+	}
+	e.u64(n)
+	return nil
+}
+
+func (e *encoder) str(s string) error {
+	if err := e.count(uint64(len(s))); err != nil {
+		return err
+	}
+	e.buf.WriteString(s)
+	return nil
+}
+
+func (e *encoder) kv(kv KV) error {
+	if err := checkValue(kv.Type, kv.Value, 0); err != nil {
+		return fmt.Errorf("invalid value for %s: %w", kv.Key, err)
+	}
+	if err := e.str(kv.Key); err != nil {
+		return err
+	}
+	e.u32(uint32(kv.Type))
+	return e.value(kv.Type, kv.Value)
+}
+
+func (e *encoder) value(typ ValueType, value any) error {
+	switch v := value.(type) {
+	case uint8:
+		e.buf.WriteByte(v)
+	case int8:
+		e.buf.WriteByte(byte(v))
+	case bool:
+		if v {
+			e.buf.WriteByte(1)
+		} else {
+			e.buf.WriteByte(0)
+		}
+	case uint16:
+		e.u16(v)
+	case int16:
+		e.u16(uint16(v))
+	case uint32:
+		e.u32(v)
+	case int32:
+		e.u32(uint32(v))
+	case float32:
+		e.u32(math.Float32bits(v))
+	case uint64:
+		e.u64(v)
+	case int64:
+		e.u64(uint64(v))
+	case float64:
+		e.u64(math.Float64bits(v))
+	case string:
+		return e.str(v)
+	case Array:
+		e.u32(uint32(v.Type))
+		if err := e.count(uint64(len(v.Values))); err != nil {
+			return err
+		}
+		for _, elem := range v.Values {
+			if err := e.value(v.Type, elem); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%T is not a %s", value, typ)
+	}
+	return nil
+}
+
+func (e *encoder) tensorInfo(t TensorInfo) error {
+	if len(t.Shape) > MaxDims {
+		return fmt.Errorf("tensor %s has %d dimensions", t.Name, len(t.Shape))
+	}
+	if err := e.str(t.Name); err != nil {
+		return err
+	}
+	e.u32(uint32(len(t.Shape)))
+	for _, d := range t.Shape {
+		if err := e.count(d); err != nil {
+			return err
+		}
+	}
+	e.u32(uint32(t.Type))
+	e.u64(t.Offset)
+	return nil
+}
@@ -0,0 +1,138 @@
+package llama
+
+// #include "binding.h"
+import "C"
+import (
+	"errors"
+	"io"
+	"log"
+	"runtime"
+	"sync"
+)
+
+// ErrClosed is returned by the methods of a model, or of its sessions, once
+// the model has been closed.
+var ErrClosed = errors.New("model is closed")
+
+var _ io.Closer = (*LLama)(nil)
+
+// lifecycle counts the calls running on a model, so that Close can wait for
+// them before freeing it.
+type lifecycle struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	inflight int
+	closing  bool
+	closed   bool
+	sessions map[*Session]struct{}
+}
+
+func (lc *lifecycle) wait() {
+	if lc.cond == nil {
+		lc.cond = sync.NewCond(&lc.mu)
+	}
+	lc.cond.Wait()
+}
+
+func (lc *lifecycle) broadcast() {
+	if lc.cond != nil {
+		lc.cond.Broadcast()
+	}
+}
+
+// use marks a call as running on the model until done is called. It fails
+// with ErrClosed once Close has started.
+func (l *LLama) use() (done func(), err error) {
+	l.life.mu.Lock()
+	defer l.life.mu.Unlock()
+
+	if l.life.closing {
+		return nil, ErrClosed
+	}
+	l.life.inflight++
+
+	return func() {
+		l.life.mu.Lock()
+		defer l.life.mu.Unlock()
+
+		if l.life.inflight--; l.life.inflight == 0 {
+			l.life.broadcast()
+		}
+	}, nil
+}
+
+func (l *LLama) addSession(s *Session) {
+	l.life.mu.Lock()
+	defer l.life.mu.Unlock()
+
+	if l.life.sessions == nil {
+		l.life.sessions = map[*Session]struct{}{}
+	}
+	l.life.sessions[s] = struct{}{}
+}
+
+func (l *LLama) removeSession(s *Session) {
+	l.life.mu.Lock()
+	defer l.life.mu.Unlock()
+
+	delete(l.life.sessions, s)
+}
+
+// track makes the garbage collector report and free the model if it is never
+// closed.
+func (l *LLama) track(source string) *LLama {
+	runtime.SetFinalizer(l, func(l *LLama) {
+		log.Printf("llama: model loaded from %s was not closed, freeing it", source)
+		l.Close()
+	})
+	return l
+}
+
+// Close waits for the calls running on the model to return and frees it,
+// along with its sessions and the memory it mapped. Later calls to its
+// methods return ErrClosed. Closing a model more than once has no effect.
+func (l *LLama) Close() error {
+	l.life.mu.Lock()
+	if l.life.closing {
+		for !l.life.closed {
+			l.life.wait()
+		}
+		l.life.mu.Unlock()
+		return nil
+	}
+	l.life.closing = true
+	for l.life.inflight > 0 {
+		l.life.wait()
+	}
+	sessions := l.life.sessions
+	l.life.sessions = nil
+	l.life.mu.Unlock()
+
+	for s := range sessions {
+		s.free()
+	}
+
+	setCallback(l.state, nil)
+	C.llama_binding_free_model(l.state)
+	// Unpin after the model is freed on the C side
+	if len(l.modelData) > 0 {
+		l.pin.Unpin()
+	}
+	var err error
+	if l.unmap != nil {
+		err = l.unmap()
+	}
+	l.state, l.modelData, l.unmap = nil, nil, nil
+	runtime.SetFinalizer(l, nil)
+
+	l.life.mu.Lock()
+	l.life.closed = true
+	l.life.broadcast()
+	l.life.mu.Unlock()
+	return err
+}
+
+// Free releases the model, like Close.
+func (l *LLama) Free() {
+	l.Close()
+}
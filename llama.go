@@ -10,30 +10,56 @@ package llama
 // #include <string.h>
 import "C"
 import (
-	"encoding/binary"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"runtime"
 	"strings"
 	"sync"
 	"unsafe"
+
+	"github.com/go-skynet/go-llama.cpp/gguf"
+	"github.com/go-skynet/go-llama.cpp/pack"
 )
 
 type LLama struct {
 	state       unsafe.Pointer
 	embeddings  bool
 	contextSize int
+	// Options the model was loaded with, reused when creating sessions
+	options ModelOptions
+	// In-memory cache of evaluated prompt prefixes, nil unless enabled
+	prefixCache *prefixCache
+	// Identifies the model in prompt cache stores
+	fingerprint string
 	// Keep a reference to the model data to prevent GC
 	modelData []byte
 	// Keep the model bytes pinned for the lifetime of the model (Go 1.21+)
 	pin runtime.Pinner
+	// Releases the memory mapped for the model, if it mapped any
+	unmap func() error
+	// Calls running on the model, waited for by Close
+	life lifecycle
 	// Mutex to protect concurrent predict calls
 	predictMu sync.Mutex
 }
 
 func New(model string, opts ...ModelOption) (*LLama, error) {
+	if shards := shardNames(model); shards != nil {
+		return NewFromShards(shards, opts...)
+	}
+
 	mo := NewModelOptions(opts...)
+	if len(mo.SignatureKeys) > 0 {
+		return newFromSignedFile(model, mo)
+	}
+	check, err := startFileChecksum(mo, model)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading model from %s - %w", model, err)
+	}
 	modelPath := C.CString(model)
 	defer C.free(unsafe.Pointer(modelPath))
 	loraBase := C.CString(mo.LoraBase)
@@ -47,20 +73,56 @@ func New(model string, opts ...ModelOption) (*LLama, error) {
 		MulMatQ = *mo.MulMatQ
 	}
 
+	progress := newLoadProgress(mo.LoadProgress)
+	defer progress.free()
+
 	result := C.load_model(modelPath,
 		C.int(mo.ContextSize), C.int(mo.Seed),
 		C.bool(mo.F16Memory), C.bool(mo.MLock), C.bool(mo.Embeddings), C.bool(mo.MMap), C.bool(mo.LowVRAM),
 		C.int(mo.NGPULayers), C.int(mo.NBatch), C.CString(mo.MainGPU), C.CString(mo.TensorSplit), C.bool(mo.NUMA),
 		C.float(mo.FreqRopeBase), C.float(mo.FreqRopeScale),
-		C.bool(MulMatQ), loraAdapter, loraBase, C.bool(mo.Perplexity),
+		C.bool(MulMatQ), loraAdapter, loraBase, C.bool(mo.Perplexity), progress.arg(),
 	)
 
 	if result == nil {
-		return nil, fmt.Errorf("failed loading model from %s - model file may not exist or is invalid", model)
+		err := progress.err(fmt.Errorf("failed loading model from %s - %s", model, diagnoseModelFile(model)))
+		return nil, checkFailedLoad(check, err)
+	}
+	if err := check.wait(); err != nil {
+		C.llama_binding_free_model(result)
+		return nil, fmt.Errorf("failed loading model from %s - %w", model, err)
 	}
 
-	ll := &LLama{state: result, contextSize: mo.ContextSize, embeddings: mo.Embeddings}
-	return ll, nil
+	ll := &LLama{state: result, contextSize: mo.ContextSize, embeddings: mo.Embeddings, options: mo,
+		fingerprint: fileFingerprint(model, mo)}
+	if mo.PrefixCacheBudget > 0 {
+		ll.prefixCache = newPrefixCache(mo.PrefixCacheBudget, mo.PrefixCacheMinMatch)
+	}
+	return ll.track(model), nil
+}
+
+// diagnoseModelFile explains why the model at path failed to load, as far as
+// its GGUF header tells.
+func diagnoseModelFile(path string) string {
+	f, err := gguf.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "model file does not exist"
+	}
+	if errors.Is(err, gguf.ErrNotGGUF) || errors.Is(err, gguf.ErrUnsupportedVersion) {
+		return err.Error()
+	}
+	if err != nil {
+		return fmt.Sprintf("model file is invalid: %s", err)
+	}
+	problems := f.Validate()
+	if len(problems) == 0 {
+		return "model file may not exist or is invalid"
+	}
+	msgs := make([]string, len(problems))
+	for i, p := range problems {
+		msgs[i] = p.Error()
+	}
+	return "model file is invalid: " + strings.Join(msgs, "; ")
 }
 
 func NewFromMemory(modelData []byte, opts ...ModelOption) (*LLama, error) {
@@ -79,6 +141,13 @@ func NewFromMemory(modelData []byte, opts ...ModelOption) (*LLama, error) {
 	if len(modelData) == 0 {
 		return nil, fmt.Errorf("model data is empty")
 	}
+	if err := checkSignature(mo, bytes.NewReader(modelData), ""); err != nil {
+		return nil, err
+	}
+	check, err := startReaderChecksum(mo, bytes.NewReader(modelData))
+	if err != nil {
+		return nil, err
+	}
 
 	// Allocate C strings up-front and free them after the call
 	mainGPU := C.CString(mo.MainGPU)
@@ -98,206 +167,181 @@ func NewFromMemory(modelData []byte, opts ...ModelOption) (*LLama, error) {
 		fmt.Printf("NewFromMemory: using Go buffer %d bytes at %p (zero-copy)\n", dataSize, dataPtr)
 	}
 
+	progress := newLoadProgress(mo.LoadProgress)
+	defer progress.free()
+
 	result := C.load_model_from_memory(dataPtr, dataSize,
 		C.int(mo.ContextSize), C.int(mo.Seed),
 		C.bool(mo.F16Memory), C.bool(mo.MLock), C.bool(mo.Embeddings), C.bool(mo.MMap), C.bool(mo.LowVRAM),
 		C.int(mo.NGPULayers), C.int(mo.NBatch), mainGPU, tensorSplit, C.bool(mo.NUMA),
 		C.float(mo.FreqRopeBase), C.float(mo.FreqRopeScale),
-		C.bool(MulMatQ), loraAdapter, loraBase, C.bool(mo.Perplexity),
+		C.bool(MulMatQ), loraAdapter, loraBase, C.bool(mo.Perplexity), progress.arg(),
 	)
 
 	if result == nil {
 		// Unpin on failure
 		pinner.Unpin()
-		return nil, fmt.Errorf("failed loading model from memory")
+		return nil, checkFailedLoad(check, progress.err(fmt.Errorf("failed loading model from memory")))
+	}
+	if err := check.wait(); err != nil {
+		C.llama_binding_free_model(result)
+		pinner.Unpin()
+		return nil, err
 	}
 
 	ll := &LLama{
 		state:       result,
 		contextSize: mo.ContextSize,
 		embeddings:  mo.Embeddings,
+		options:     mo,
+		fingerprint: memoryFingerprint(modelData, mo),
 		modelData:   modelData, // Keep reference to prevent GC
 	}
 	// Transfer the pinner to the struct to keep it pinned for the lifetime of l
 	ll.pin = pinner
+	if mo.PrefixCacheBudget > 0 {
+		ll.prefixCache = newPrefixCache(mo.PrefixCacheBudget, mo.PrefixCacheMinMatch)
+	}
 	// Pin the underlying array for the lifetime of the model to ensure C does
 	// not observe the memory moved or freed by the GC.
 	// Note: already pinned above before calling into C; keep it pinned until Free.
-	return ll, nil
+	return ll.track("memory"), nil
+}
+
+// ListEmbeddedModels returns the names of the models appended to the current
+// binary by cmd/llama-pack, in the order they were packed.
+func ListEmbeddedModels() ([]string, error) {
+	file, entries, err := openEmbeddedModels()
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = e.Name
+	}
+	return names, nil
 }
 
-// LoadSelfContainedModel loads a model that has been appended to the current binary
-// It detects self-contained models and uses zero-copy mmap loading
+// LoadSelfContainedModel loads the first model appended to the current binary
+// by cmd/llama-pack. The trailer written by llama-pack is checked, including the
+// SHA-256 of the model, binaries packed with the legacy size-only trailer are
+// still accepted. It uses zero-copy mmap loading where it can. Compressed models
+// are decompressed into an anonymous memory file, which is mapped instead.
 func LoadSelfContainedModel(opts ...ModelOption) (*LLama, error) {
+	file, entries, err := openEmbeddedModels()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return loadEmbeddedModel(file, entries[0], opts)
+}
+
+// LoadEmbeddedModel loads the model called name appended to the current binary
+// by cmd/llama-pack, like LoadSelfContainedModel.
+func LoadEmbeddedModel(name string, opts ...ModelOption) (*LLama, error) {
+	file, entries, err := openEmbeddedModels()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	for _, e := range entries {
+		if e.Name == name {
+			return loadEmbeddedModel(file, e, opts)
+		}
+	}
+	return nil, fmt.Errorf("no model called %q is embedded in the executable", name)
+}
+
+// openEmbeddedModels opens the current executable and reads the models
+// appended to it.
+func openEmbeddedModels() (*os.File, []pack.Entry, error) {
 	// Get the path to the current executable
 	execPath, err := os.Executable()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get executable path: %w", err)
+		return nil, nil, fmt.Errorf("failed to get executable path: %w", err)
 	}
 
 	// Open the executable for reading
 	file, err := os.Open(execPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open executable: %w", err)
+		return nil, nil, fmt.Errorf("failed to open executable: %w", err)
 	}
-	defer file.Close()
 
 	// Get file size
 	info, err := file.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("failed to stat executable: %w", err)
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to stat executable: %w", err)
 	}
-	fileSize := info.Size()
 
-	// Read the last 8 bytes to get the model size (uint64 in little-endian)
-	if fileSize < 8 {
-		return nil, fmt.Errorf("executable too small to contain self-contained model")
-	}
-
-	_, err = file.Seek(-8, io.SeekEnd)
+	entries, err := pack.ReadEntries(file, info.Size())
 	if err != nil {
-		return nil, fmt.Errorf("failed to seek to model size marker: %w", err)
+		file.Close()
+		return nil, nil, fmt.Errorf("failed to find self-contained model: %w", err)
 	}
+	return file, entries, nil
+}
 
-	var modelSize uint64
-	err = binary.Read(file, binary.LittleEndian, &modelSize)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read model size: %w", err)
+func loadEmbeddedModel(file *os.File, entry pack.Entry, opts []ModelOption) (*LLama, error) {
+	if entry.Signature != nil {
+		// checked by the constructors once the model is in memory
+		opts = append([]ModelOption{SetSignature(entry.Signature)}, opts...)
+	} else if mo := NewModelOptions(opts...); len(mo.SignatureKeys) > 0 && mo.Signature == nil {
+		return nil, fmt.Errorf("%w: model %s was packed without a signature", ErrSignatureInvalid, entry.Name)
 	}
-
-	// Validate model size
-	if modelSize == 0 || modelSize > uint64(fileSize-8) {
-		return nil, fmt.Errorf("invalid model size: %d (file size: %d)", modelSize, fileSize)
+	if entry.Encrypted {
+		return loadEncryptedModel(file, entry, opts)
+	}
+	if entry.Compressed {
+		return loadCompressedModel(file, entry, opts)
 	}
+	modelOffset, modelSize := entry.Offset, entry.Size
 
-	fmt.Printf("Found self-contained model of size %d MB, mapping into memory...\n", modelSize/(1024*1024))
+	fmt.Printf("Found self-contained model %s of size %d MB, mapping into memory...\n", entry.Name, modelSize/(1024*1024))
 
-	// Calculate the offset where the model starts
-	modelOffset := fileSize - int64(modelSize) - 8
+	// readModel reads the model into memory, for when it can not be mapped
+	readModel := func() (*LLama, error) {
+		modelData := make([]byte, modelSize)
+		if _, err := file.ReadAt(modelData, modelOffset); err != nil {
+			return nil, fmt.Errorf("failed to read model data: %w", err)
+		}
+		if err := entry.Verify(bytes.NewReader(modelData)); err != nil {
+			return nil, err
+		}
 
-	// Debug output
-	fmt.Printf("Debug: File size: %d, Model size: %d, Model offset: %d (0x%x)\n",
-		fileSize, modelSize, modelOffset, modelOffset)
+		fmt.Printf("Successfully loaded self-contained model into memory (%d MB)\n", modelSize/(1024*1024))
+		return NewFromMemory(modelData, append(opts, SetMMap(false))...)
+	}
 
 	// Check if model is too large for mmap (>2GB on some systems)
 	const maxMmapSize = 2 * 1024 * 1024 * 1024 // 2GB limit for safety
 	if modelSize > maxMmapSize {
 		fmt.Printf("Model size %.2f GB exceeds safe mmap limit, using standard memory loading\n",
 			float64(modelSize)/(1024*1024*1024))
-
-		// Seek to model start
-		_, err = file.Seek(modelOffset, io.SeekStart)
-		if err != nil {
-			return nil, fmt.Errorf("failed to seek to model start: %w", err)
-		}
-
-		// Read model data
-		modelData := make([]byte, modelSize)
-		_, err = io.ReadFull(file, modelData)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read model data: %w", err)
-		}
-
-		// Verify GGUF header in the loaded data
-		if len(modelData) >= 4 {
-			magic := binary.LittleEndian.Uint32(modelData[0:4])
-			if magic == 0x46554747 {
-				fmt.Printf("✅ Valid GGUF header found in loaded data\n")
-			} else {
-				fmt.Printf("❌ Invalid magic in loaded data: 0x%08x (expected 0x46554747)\n", magic)
-				fmt.Printf("First 32 bytes: % 02x\n", modelData[:32])
-			}
-		}
-
-		fmt.Printf("Successfully loaded self-contained model into memory\n")
-
-		// Force MMap to false for large models
-		modifiedOpts := append(opts, SetMMap(false))
-		return NewFromMemory(modelData, modifiedOpts...)
+		return readModel()
 	}
 
-	// For smaller models, check if we are on macOS first
 	// macOS has known issues with mmap on self-contained binaries, so use memory loading
 	if runtime.GOOS == "darwin" {
 		fmt.Printf("macOS detected: using memory loading instead of mmap to avoid platform limitations\n")
-
-		// Seek to model start
-		_, err = file.Seek(modelOffset, io.SeekStart)
-		if err != nil {
-			return nil, fmt.Errorf("failed to seek to model start: %w", err)
-		}
-
-		// Read model data
-		modelData := make([]byte, modelSize)
-		_, err = io.ReadFull(file, modelData)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read model data: %w", err)
-		}
-
-		// Verify GGUF header in the loaded data
-		if len(modelData) >= 4 {
-			magic := binary.LittleEndian.Uint32(modelData[0:4])
-			if magic == 0x46554747 {
-				fmt.Printf("Valid GGUF header found in loaded data\n")
-			} else {
-				fmt.Printf("Warning: Invalid magic in loaded data: 0x%08x (expected 0x46554747)\n", magic)
-			}
-		}
-
-		fmt.Printf("Successfully loaded self-contained model into memory (%d MB)\n", modelSize/(1024*1024))
-
-		// Force MMap to false for macOS
-		modifiedOpts := append(opts, SetMMap(false))
-		return NewFromMemory(modelData, modifiedOpts...)
+		return readModel()
 	}
 
-	// For non-macOS Unix systems, try mmap
-	fd := int(file.Fd())
-	addr, mappedData, err := mmapModel(fd, modelOffset, int(modelSize))
+	// For non-macOS systems, try mmap
+	addr, mappedData, err := mmapModel(int(file.Fd()), modelOffset, int(modelSize))
 	if err != nil {
 		// Fallback to standard memory loading if mmap fails
 		fmt.Printf("mmap failed (%v), falling back to standard memory loading\n", err)
-
-		// Seek to model start
-		_, err = file.Seek(modelOffset, io.SeekStart)
-		if err != nil {
-			return nil, fmt.Errorf("failed to seek to model start: %w", err)
-		}
-
-		// Read model data
-		modelData := make([]byte, modelSize)
-		_, err = io.ReadFull(file, modelData)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read model data: %w", err)
-		}
-
-		// Verify GGUF header in the loaded data
-		if len(modelData) >= 4 {
-			magic := binary.LittleEndian.Uint32(modelData[0:4])
-			if magic == 0x46554747 {
-				fmt.Printf("Valid GGUF header found in loaded data\n")
-			} else {
-				fmt.Printf("Warning: Invalid magic in loaded data: 0x%08x (expected 0x46554747)\n", magic)
-			}
-		}
-
-		fmt.Printf("Successfully loaded self-contained model into memory\n")
-		modifiedOpts := append(opts, SetMMap(false))
-		return NewFromMemory(modelData, modifiedOpts...)
+		return readModel()
 	}
 
 	fmt.Printf("Successfully mapped self-contained model at address %p\n", unsafe.Pointer(addr))
 
-	// Debug: Check the first 16 bytes to verify GGUF header
-	if len(mappedData) >= 16 {
-		fmt.Printf("Debug: First 16 bytes of mapped data: % 02x\n", mappedData[:16])
-		// Check for GGUF magic (0x46554747 = "GGUF" in little-endian)
-		magic := binary.LittleEndian.Uint32(mappedData[0:4])
-		if magic == 0x46554747 {
-			fmt.Printf("Debug: ✅ Valid GGUF header found at mapped address\n")
-		} else {
-			fmt.Printf("Debug: ⚠️ Invalid magic: 0x%08x (expected 0x46554747 for GGUF)\n", magic)
-		}
+	if err := entry.Verify(bytes.NewReader(mappedData)); err != nil {
+		unmapModel(mappedData)
+		return nil, err
 	}
 
 	// Use NewFromMemory with the mapped data
@@ -305,7 +349,33 @@ func LoadSelfContainedModel(opts ...ModelOption) (*LLama, error) {
 	// Append SetMMap(false) to the options to prevent llama.cpp from trying to mmap again
 	modifiedOpts := append(opts, SetMMap(false))
 
-	return NewFromMemory(mappedData, modifiedOpts...)
+	ll, err := NewFromMemory(mappedData, modifiedOpts...)
+	if err != nil {
+		unmapModel(mappedData)
+		return nil, err
+	}
+	// The model owns the mapping and releases it when closed
+	ll.unmap = func() error { return unmapModel(mappedData) }
+	return ll, nil
+}
+
+// loadCompressedModel decompresses the model of entry into a file in memory,
+// a chunk at a time so that the Go heap never holds the model, and maps it.
+func loadCompressedModel(file *os.File, entry pack.Entry, opts []ModelOption) (*LLama, error) {
+	fmt.Printf("Found compressed self-contained model %s of size %d MB, decompressing to %d MB...\n",
+		entry.Name, entry.Size/(1024*1024), entry.ModelSize/(1024*1024))
+
+	mem, remove, err := createMemoryFile("llama:" + entry.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create memory file: %w", err)
+	}
+	defer remove()
+	defer mem.Close()
+
+	if err := entry.Verify(io.TeeReader(entry.Open(file), mem)); err != nil {
+		return nil, err
+	}
+	return NewFromSharedFile(mem, opts...)
 }
 
 // NewFromMMap creates a new LLama model from a memory-mapped region (zero-copy)
@@ -316,6 +386,10 @@ func NewFromMMap(addr uintptr, size int, opts ...ModelOption) (*LLama, error) {
 	// Force mmap mode for zero-copy
 	mo.MMap = true
 
+	if err := checkSignature(mo, bytes.NewReader(unsafe.Slice((*byte)(unsafe.Pointer(addr)), size)), ""); err != nil {
+		return nil, err
+	}
+
 	loraBase := C.CString(mo.LoraBase)
 	defer C.free(unsafe.Pointer(loraBase))
 	loraAdapter := C.CString(mo.LoraAdapter)
@@ -329,6 +403,10 @@ func NewFromMMap(addr uintptr, size int, opts ...ModelOption) (*LLama, error) {
 	if size == 0 {
 		return nil, fmt.Errorf("mmap size is zero")
 	}
+	check, err := startReaderChecksum(mo, bytes.NewReader(unsafe.Slice((*byte)(unsafe.Pointer(addr)), size)))
+	if err != nil {
+		return nil, err
+	}
 
 	// Allocate C strings up-front and free them after the call
 	mainGPU := C.CString(mo.MainGPU)
@@ -345,37 +423,47 @@ func NewFromMMap(addr uintptr, size int, opts ...ModelOption) (*LLama, error) {
 		fmt.Printf("NewFromMMap: using mmap'd memory %d bytes at %p (zero-copy)\n", dataSize, dataPtr)
 	}
 
+	progress := newLoadProgress(mo.LoadProgress)
+	defer progress.free()
+
 	result := C.load_model_from_mmap(dataPtr, dataSize,
 		C.int(mo.ContextSize), C.int(mo.Seed),
 		C.bool(mo.F16Memory), C.bool(mo.MLock), C.bool(mo.Embeddings), C.bool(true), C.bool(mo.LowVRAM),
 		C.int(mo.NGPULayers), C.int(mo.NBatch), mainGPU, tensorSplit, C.bool(mo.NUMA),
 		C.float(mo.FreqRopeBase), C.float(mo.FreqRopeScale),
-		C.bool(MulMatQ), loraAdapter, loraBase, C.bool(mo.Perplexity),
+		C.bool(MulMatQ), loraAdapter, loraBase, C.bool(mo.Perplexity), progress.arg(),
 	)
 
 	if result == nil {
-		return nil, fmt.Errorf("failed loading model from mmap")
+		return nil, checkFailedLoad(check, progress.err(fmt.Errorf("failed loading model from mmap")))
+	}
+	if err := check.wait(); err != nil {
+		C.llama_binding_free_model(result)
+		return nil, err
 	}
 
 	ll := &LLama{
 		state:       result,
 		contextSize: mo.ContextSize,
 		embeddings:  mo.Embeddings,
+		options:     mo,
+		fingerprint: memoryFingerprint(unsafe.Slice((*byte)(dataPtr), size), mo),
 		// No modelData or pin for mmap - memory is externally managed
 	}
+	if mo.PrefixCacheBudget > 0 {
+		ll.prefixCache = newPrefixCache(mo.PrefixCacheBudget, mo.PrefixCacheMinMatch)
+	}
 
-	return ll, nil
+	return ll.track("a memory mapping"), nil
 }
 
-func (l *LLama) Free() {
-	C.llama_binding_free_model(l.state)
-	// Unpin after the model is freed on the C side
-	if len(l.modelData) > 0 {
-		l.pin.Unpin()
+func (l *LLama) LoadState(state string) error {
+	done, err := l.use()
+	if err != nil {
+		return err
 	}
-}
+	defer done()
 
-func (l *LLama) LoadState(state string) error {
 	d := C.CString(state)
 	w := C.CString("rb")
 	result := C.load_state(l.state, d, w)
@@ -391,6 +479,12 @@ func (l *LLama) LoadState(state string) error {
 }
 
 func (l *LLama) SaveState(dst string) error {
+	done, err := l.use()
+	if err != nil {
+		return err
+	}
+	defer done()
+
 	d := C.CString(dst)
 	w := C.CString("wb")
 
@@ -399,12 +493,18 @@ func (l *LLama) SaveState(dst string) error {
 	defer C.free(unsafe.Pointer(d)) // free allocated C string
 	defer C.free(unsafe.Pointer(w)) // free allocated C string
 
-	_, err := os.Stat(dst)
+	_, err = os.Stat(dst)
 	return err
 }
 
 // Token Embeddings
 func (l *LLama) TokenEmbeddings(tokens []int, opts ...PredictOption) ([]float32, error) {
+	done, err := l.use()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	if !l.embeddings {
 		return []float32{}, fmt.Errorf("model loaded without embeddings")
 	}
@@ -457,6 +557,12 @@ func (l *LLama) TokenEmbeddings(tokens []int, opts ...PredictOption) ([]float32,
 
 // Embeddings
 func (l *LLama) Embeddings(text string, opts ...PredictOption) ([]float32, error) {
+	done, err := l.use()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	if !l.embeddings {
 		return []float32{}, fmt.Errorf("model loaded without embeddings")
 	}
@@ -504,6 +610,12 @@ func (l *LLama) Embeddings(text string, opts ...PredictOption) ([]float32, error
 }
 
 func (l *LLama) Eval(text string, opts ...PredictOption) error {
+	done, err := l.use()
+	if err != nil {
+		return err
+	}
+	defer done()
+
 	// Protect against concurrent eval calls
 	l.predictMu.Lock()
 	defer l.predictMu.Unlock()
@@ -548,6 +660,17 @@ func (l *LLama) Eval(text string, opts ...PredictOption) error {
 }
 
 func (l *LLama) SpeculativeSampling(ll *LLama, text string, opts ...PredictOption) (string, error) {
+	done, err := l.use()
+	if err != nil {
+		return "", err
+	}
+	defer done()
+	draftDone, err := ll.use()
+	if err != nil {
+		return "", err
+	}
+	defer draftDone()
+
 	// Protect against concurrent predictions
 	l.predictMu.Lock()
 	defer l.predictMu.Unlock()
@@ -613,12 +736,96 @@ func (l *LLama) SpeculativeSampling(ll *LLama, text string, opts ...PredictOptio
 	return res, nil
 }
 
+// StopReason tells why a prediction stopped.
+type StopReason int
+
+const (
+	// The model generated an end of text token, a stop prompt or the
+	// requested number of tokens, or the token callback returned false
+	StopCompleted StopReason = iota
+	// The context was full and the overflow policy did not make room
+	StopContextFull
+	// The prediction was suspended by Suspend
+	StopSuspended
+	// The prediction was stopped by Interrupt
+	StopInterrupted
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopCompleted:
+		return "completed"
+	case StopContextFull:
+		return "context full"
+	case StopSuspended:
+		return "suspended"
+	case StopInterrupted:
+		return "interrupted"
+	}
+	return fmt.Sprintf("StopReason(%d)", int(r))
+}
+
+// PredictResult describes a finished prediction.
+type PredictResult struct {
+	// Text generated by the model
+	Text string
+	// Why the prediction stopped
+	StopReason StopReason
+	// Every time the context overflowed during the prediction
+	ContextShifts []ContextShift
+	// Set when the prediction was suspended, pass it to Resume to carry on
+	Checkpoint *GenerationCheckpoint
+}
+
 func (l *LLama) Predict(text string, opts ...PredictOption) (string, error) {
+	result, err := l.PredictWithResult(text, opts...)
+	if result == nil {
+		return "", err
+	}
+	if err == nil && result.StopReason == StopSuspended {
+		// the checkpoint is not returned, so the text is all that is left
+		return result.Text, ErrSuspended
+	}
+	return result.Text, err
+}
+
+// PredictWithResult is like Predict but also reports what happened during
+// the prediction. When the context fills up with the ContextError policy, it
+// returns the text generated so far along with ErrContextFull.
+func (l *LLama) PredictWithResult(text string, opts ...PredictOption) (*PredictResult, error) {
+	return l.predict(text, nil, NewPredictOptions(opts...))
+}
+
+// predict runs a prediction for text, or carries on the one saved in
+// checkpoint if it is not nil.
+func (l *LLama) predict(text string, checkpoint *GenerationCheckpoint, po PredictOptions) (*PredictResult, error) {
+	done, err := l.use()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	// Protect against concurrent predictions
 	l.predictMu.Lock()
 	defer l.predictMu.Unlock()
 
-	po := NewPredictOptions(opts...)
+	if checkpoint != nil {
+		if err := checkpoint.validate(l.state); err != nil {
+			return nil, err
+		}
+		// the checkpoint carries the evaluated prompt already
+		po.PromptCacheStore = nil
+		po.PathPromptCache = ""
+	}
+
+	if po.PromptCacheStore != nil {
+		path, release, err := po.PromptCacheStore.acquire(l.fingerprint, text, !po.PromptCacheRO)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+		po.PathPromptCache = path
+	}
 
 	if po.TokenCallback != nil {
 		setCallback(l.state, po.TokenCallback)
@@ -634,7 +841,7 @@ func (l *LLama) Predict(text string, opts ...PredictOption) (string, error) {
 	outSize := C.size_t(po.Tokens)
 	outPtr := C.malloc(outSize)
 	if outPtr == nil {
-		return "", fmt.Errorf("failed to allocate memory for output")
+		return nil, fmt.Errorf("failed to allocate memory for output")
 	}
 	defer C.free(outPtr)
 	// Clear the allocated memory
@@ -679,9 +886,81 @@ func (l *LLama) Predict(text string, opts ...PredictOption) (string, error) {
 	)
 	defer C.llama_free_params(params)
 
-	ret := C.llama_predict(params, l.state, (*C.char)(outPtr), outSize, C.bool(po.DebugMode))
-	if ret != 0 {
-		return "", fmt.Errorf("inference failed")
+	// Restore the longest cached prefix of the prompt, if any, and ask for
+	// the evaluated prompt back so that later calls can reuse it.
+	var promptCache *C.llama_binding_prompt_cache
+	var promptTokens []int32
+	if l.prefixCache != nil && po.PathPromptCache == "" && text != "" && checkpoint == nil {
+		promptTokens = l.tokenizePrompt(text)
+	}
+	if len(promptTokens) > 0 {
+		promptCache = (*C.llama_binding_prompt_cache)(C.calloc(1, C.sizeof_llama_binding_prompt_cache))
+		defer C.free(unsafe.Pointer(promptCache))
+		promptCache.store = true
+
+		if entry, matched := l.prefixCache.lookup(promptTokens); entry != nil {
+			if matched == len(promptTokens) && len(entry.tokens) == matched {
+				// the whole prompt is cached already
+				promptCache.store = false
+			}
+			// always re-evaluate the last prompt token to recompute its logits
+			reuse := entry.tokens[:min(matched, len(promptTokens)-1)]
+			var cachePin runtime.Pinner
+			defer cachePin.Unpin()
+			if len(reuse) > 0 {
+				cachePin.Pin(&reuse[0])
+				promptCache.tokens_in = (*C.int)(unsafe.Pointer(&reuse[0]))
+			}
+			cachePin.Pin(&entry.state[0])
+			promptCache.n_tokens_in = C.int(len(reuse))
+			promptCache.state_in = unsafe.Pointer(&entry.state[0])
+			promptCache.state_in_size = C.size_t(len(entry.state))
+		}
+	}
+
+	predictHooks := &predictHooks{
+		overflowHook:  po.ContextOverflowHook,
+		shiftCallback: po.ContextShiftCallback,
+		guided:        po.NegativePromptScale > 1,
+	}
+	setPredictHooks(l.state, predictHooks)
+	defer setPredictHooks(l.state, nil)
+
+	var checkpointIn *C.llama_binding_checkpoint
+	if checkpoint != nil {
+		var checkpointPin runtime.Pinner
+		defer checkpointPin.Unpin()
+		checkpointIn = checkpoint.toC(&checkpointPin)
+		defer C.free(unsafe.Pointer(checkpointIn))
+	}
+	checkpointOut := (*C.llama_binding_checkpoint)(C.calloc(1, C.sizeof_llama_binding_checkpoint))
+	defer C.free(unsafe.Pointer(checkpointOut))
+
+	ret := C.llama_predict(params, l.state, (*C.char)(outPtr), outSize, C.bool(po.DebugMode), unsafe.Pointer(promptCache),
+		C.int(po.ContextOverflowPolicy), C.int(po.ContextWindow),
+		unsafe.Pointer(checkpointIn), unsafe.Pointer(checkpointOut))
+	if promptCache != nil && promptCache.state_out != nil {
+		tokens := unsafe.Slice((*int32)(unsafe.Pointer(promptCache.tokens_out)), int(promptCache.n_tokens_out))
+		l.prefixCache.insert(tokens, C.GoBytes(promptCache.state_out, C.int(promptCache.state_out_size)))
+		C.llama_binding_free_prompt_cache_out(unsafe.Pointer(promptCache))
+	}
+	var suspended *GenerationCheckpoint
+	if ret == C.LLAMA_BINDING_SUSPENDED {
+		suspended = checkpointFromC(checkpointOut, l.fingerprint, text)
+		C.llama_binding_free_checkpoint(unsafe.Pointer(checkpointOut))
+	}
+	var reason StopReason
+	switch ret {
+	case 0:
+		reason = StopCompleted
+	case C.LLAMA_BINDING_ERR_CONTEXT_FULL:
+		reason = StopContextFull
+	case C.LLAMA_BINDING_SUSPENDED:
+		reason = StopSuspended
+	case C.LLAMA_BINDING_INTERRUPTED:
+		reason = StopInterrupted
+	default:
+		return nil, fmt.Errorf("inference failed")
 	}
 	res := C.GoString((*C.char)(outPtr))
 
@@ -700,12 +979,93 @@ func (l *LLama) Predict(text string, opts ...PredictOption) (string, error) {
 	// Ensure the LLama struct doesn't get garbage collected while C code is using it
 	runtime.KeepAlive(l)
 
-	return res, nil
+	result := &PredictResult{Text: res, StopReason: reason, ContextShifts: predictHooks.shifts, Checkpoint: suspended}
+	if ret == C.LLAMA_BINDING_ERR_CONTEXT_FULL {
+		return result, ErrContextFull
+	}
+	return result, nil
+}
+
+// allocatePredictParams converts the predict options into a gpt_params
+// allocated on the C side. The returned function frees the params together
+// with every C string that was allocated for them.
+func allocatePredictParams(text string, po PredictOptions) (unsafe.Pointer, func()) {
+	var cstrings []*C.char
+	cstr := func(s string) *C.char {
+		cs := C.CString(s)
+		cstrings = append(cstrings, cs)
+		return cs
+	}
+
+	reverseCount := len(po.StopPrompts)
+	reversePrompt := make([]*C.char, reverseCount)
+	var pass **C.char
+	for i, s := range po.StopPrompts {
+		reversePrompt[i] = cstr(s)
+		pass = &reversePrompt[0]
+	}
+
+	params := C.llama_allocate_params(cstr(text), C.int(po.Seed), C.int(po.Threads), C.int(po.Tokens), C.int(po.TopK),
+		C.float(po.TopP), C.float(po.Temperature), C.float(po.Penalty), C.int(po.Repeat),
+		C.bool(po.IgnoreEOS), C.bool(po.F16KV),
+		C.int(po.Batch), C.int(po.NKeep), pass, C.int(reverseCount),
+		C.float(po.TailFreeSamplingZ), C.float(po.TypicalP), C.float(po.FrequencyPenalty), C.float(po.PresencePenalty),
+		C.int(po.Mirostat), C.float(po.MirostatETA), C.float(po.MirostatTAU), C.bool(po.PenalizeNL), cstr(po.LogitBias),
+		cstr(po.PathPromptCache), C.bool(po.PromptCacheAll), C.bool(po.MLock), C.bool(po.MMap),
+		cstr(po.MainGPU), cstr(po.TensorSplit),
+		C.bool(po.PromptCacheRO),
+		cstr(po.Grammar),
+		C.float(po.RopeFreqBase), C.float(po.RopeFreqScale), C.float(po.NegativePromptScale), cstr(po.NegativePrompt),
+		C.int(po.NDraft),
+	)
+
+	return params, func() {
+		C.llama_free_params(params)
+		for _, cs := range cstrings {
+			C.free(unsafe.Pointer(cs))
+		}
+	}
+}
+
+// tokenizePrompt tokenizes text the way Predict does, returning nil if it
+// cannot be tokenized.
+func (l *LLama) tokenizePrompt(text string) []int32 {
+	input := C.CString(text)
+	defer C.free(unsafe.Pointer(input))
+
+	// a token is never shorter than a byte, plus room for BOS
+	out := make([]C.int, len(text)+1)
+	n := C.llama_binding_tokenize_prompt(l.state, input, &out[0], C.int(len(out)))
+	if n < 0 {
+		return nil
+	}
+
+	tokens := make([]int32, int(n))
+	for i := range tokens {
+		tokens[i] = int32(out[i])
+	}
+	return tokens
+}
+
+// PrefixCacheStats returns the hit/miss counters and memory use of the
+// prefix cache. It returns zero values if the cache was not enabled with
+// SetPrefixCache.
+func (l *LLama) PrefixCacheStats() PrefixCacheStats {
+	if l.prefixCache == nil {
+		return PrefixCacheStats{}
+	}
+	return l.prefixCache.stats()
 }
 
 // tokenize has an interesting return property: negative lengths (potentially) have meaning.
 // Therefore, return the length seperate from the slice and error - all three can be used together
 func (l *LLama) TokenizeString(text string, opts ...PredictOption) (int32, []int32, error) {
+	done, err := l.use()
+	if err != nil {
+		return 0, nil, err
+	}
+	defer done()
+
 	po := NewPredictOptions(opts...)
 
 	input := C.CString(text)
@@ -764,6 +1124,12 @@ func (l *LLama) TokenizeString(text string, opts ...PredictOption) (int32, []int
 //
 // It is save to call this method while a prediction is running.
 func (l *LLama) SetTokenCallback(callback func(token string) bool) {
+	done, err := l.use()
+	if err != nil {
+		return
+	}
+	defer done()
+
 	setCallback(l.state, callback)
 }
 
@@ -76,3 +76,46 @@ size_t llama_memory_source::tell() const { return current_pos; }
 size_t llama_memory_source::size() const { return data_size; }
 
 bool llama_memory_source::eof() const { return current_pos >= data_size; }
+
+// Callback data source implementation
+llama_callback_source::llama_callback_source(read_at_fn read_at,
+                                             void *user_data, size_t data_size)
+    : read_at(read_at), user_data(user_data), data_size(data_size),
+      current_pos(0) {}
+
+size_t llama_callback_source::read(void *buffer, size_t size) {
+    size_t bytes_to_read = std::min(size, data_size - current_pos);
+    if (bytes_to_read == 0) {
+        return 0;
+    }
+    size_t n = read_at(user_data, buffer, current_pos, bytes_to_read);
+    current_pos += n;
+    return n;
+}
+
+void llama_callback_source::seek(size_t offset, int whence) {
+    switch (whence) {
+    case SEEK_SET:
+        current_pos = std::min(offset, data_size);
+        break;
+    case SEEK_CUR:
+        current_pos = std::min(current_pos + offset, data_size);
+        break;
+    case SEEK_END:
+        current_pos = data_size > offset ? data_size - offset : 0;
+        break;
+    }
+}
+
+size_t llama_callback_source::tell() const { return current_pos; }
+
+size_t llama_callback_source::size() const { return data_size; }
+
+bool llama_callback_source::eof() const { return current_pos >= data_size; }
+
+size_t llama_data_source_read_at(void *user_data, void *buffer, size_t offset,
+                                 size_t size) {
+    llama_data_source *source = static_cast<llama_data_source *>(user_data);
+    source->seek(offset, SEEK_SET);
+    return source->read(buffer, size);
+}
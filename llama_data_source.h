@@ -52,4 +52,34 @@ class llama_memory_source : public llama_data_source {
     bool eof() const override;
 };
 
+// Data source reading through a positional read callback, such as an
+// io.ReaderAt on the Go side
+class llama_callback_source : public llama_data_source {
+  public:
+    typedef size_t (*read_at_fn)(void *user_data, void *buffer, size_t offset,
+                                 size_t size);
+
+  private:
+    read_at_fn read_at;
+    void *user_data;
+    size_t data_size;
+    size_t current_pos;
+
+  public:
+    llama_callback_source(read_at_fn read_at, void *user_data,
+                          size_t data_size);
+    ~llama_callback_source() = default;
+
+    size_t read(void *buffer, size_t size) override;
+    void seek(size_t offset, int whence) override;
+    size_t tell() const override;
+    size_t size() const override;
+    bool eof() const override;
+};
+
+// Reads size bytes at offset from the llama_data_source in user_data, usable
+// as a llama_read_at_callback
+size_t llama_data_source_read_at(void *user_data, void *buffer, size_t offset,
+                                 size_t size);
+
 #endif // LLAMA_DATA_SOURCE_H
@@ -1,12 +1,112 @@
 package llama_test
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/go-skynet/go-llama.cpp"
+	"github.com/go-skynet/go-llama.cpp/pack"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
 
+func TestMain(m *testing.M) {
+	// NewWorker runs the test binary again as the worker
+	llama.RunWorker()
+	if os.Getenv("LLAMA_TEST_SHARED_MODEL") != "" {
+		runSharedModelChild()
+	}
+	if os.Getenv("LLAMA_TEST_EMBEDDED_MODELS") != "" {
+		runEmbeddedModelsChild()
+	}
+	os.Exit(m.Run())
+}
+
+// runSharedModelChild attaches to the shared model inherited as fd 3, reads
+// all of its weights and stays attached until stdin is closed.
+func runSharedModelChild() {
+	model, err := llama.NewFromSharedFile(os.NewFile(3, "shared model"), llama.SetContext(128))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if _, err := model.Predict("Hello", llama.SetTokens(2)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println("ready")
+	io.Copy(io.Discard, os.Stdin)
+	model.Close()
+	os.Exit(0)
+}
+
+// runEmbeddedModelsChild lists the models packed into the test binary, loads
+// the one named by LLAMA_TEST_EMBEDDED_MODELS and prints its name and how
+// long loading it took.
+func runEmbeddedModelsChild() {
+	names, err := llama.ListEmbeddedModels()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	name := os.Getenv("LLAMA_TEST_EMBEDDED_MODELS")
+	start := time.Now()
+	model, err := llama.LoadEmbeddedModel(name, llama.SetContext(128))
+	loadTime := time.Since(start)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if _, err := model.Predict("Hello", llama.SetTokens(2)); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	model.Close()
+	fmt.Printf("models %s, loaded %s\n", strings.Join(names, ","), name)
+	fmt.Printf("load time %d\n", loadTime)
+	os.Exit(0)
+}
+
+// packTestBinary writes to path a copy of the test binary with the model at
+// modelPath appended under every name, for runEmbeddedModelsChild.
+func packTestBinary(path, modelPath string, compress bool, names ...string) error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	exe, err := os.Open(exePath)
+	if err != nil {
+		return err
+	}
+	defer exe.Close()
+	packed, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o755)
+	if err != nil {
+		return err
+	}
+	defer packed.Close()
+	if _, err := io.Copy(packed, exe); err != nil {
+		return err
+	}
+
+	var models []pack.Model
+	for _, name := range names {
+		f, err := os.Open(modelPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		models = append(models, pack.Model{Name: name, Data: f, Compress: compress})
+	}
+	if _, err := pack.Append(packed, models...); err != nil {
+		return err
+	}
+	return packed.Close()
+}
+
 func TestLLaMa(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "go-llama.cpp test suite")
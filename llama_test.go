@@ -1,10 +1,29 @@
 package llama_test
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-skynet/go-llama.cpp"
 	. "github.com/go-skynet/go-llama.cpp"
+	"github.com/go-skynet/go-llama.cpp/gguf"
+	"github.com/go-skynet/go-llama.cpp/pack"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 )
@@ -18,7 +37,538 @@ var _ = Describe("LLama binding", func() {
 			Expect(err).To(HaveOccurred())
 			Expect(model).To(BeNil())
 		})
+
+		It("explains why models fail to load", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "model.gguf")
+			Expect(os.WriteFile(path, []byte("GGML not a gguf model"), 0o644)).To(Succeed())
+			_, err := New(path)
+			Expect(err).To(MatchError(ContainSubstring("not a GGUF file")))
+
+			_, err = New("not-existing")
+			Expect(err).To(MatchError(ContainSubstring("model file does not exist")))
+		})
+
+		It("reports errors of the reader a model is loaded from", func() {
+			broken := errors.New("device is gone")
+			_, err := NewFromReaderAt(failingReaderAt{broken}, 1<<20)
+			Expect(err).To(MatchError(broken))
+		})
+	})
+	Context("Prompt cache store", func() {
+		It("keeps entries of different models apart", func() {
+			store, err := NewPromptCacheStore(GinkgoT().TempDir(), 1024)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(store.Path("model-a", "prompt")).ToNot(Equal(store.Path("model-b", "prompt")))
+			Expect(store.Path("model-a", "prompt")).To(Equal(store.Path("model-a", "prompt")))
+		})
+
+		It("keys entries by a prefix of the prompt", func() {
+			store, err := NewPromptCacheStore(GinkgoT().TempDir(), 1024)
+			Expect(err).ToNot(HaveOccurred())
+			system := strings.Repeat("You are a helpful assistant. ", 100)
+			Expect(store.Path("model", system+"Q: 2+2?")).To(Equal(store.Path("model", system+"Q: 3+3?")))
+			Expect(store.Path("model", "Q: 2+2?")).ToNot(Equal(store.Path("model", "Q: 3+3?")))
+
+			store.SetPrefixLength(3)
+			Expect(store.Path("model", "Q: 2+2?")).To(Equal(store.Path("model", "Q: 3+3?")))
+			store.SetPrefixLength(0)
+			Expect(store.Path("model", "Q: 2+2?")).ToNot(Equal(store.Path("model", "Q: 3+3?")))
+		})
+
+		It("evicts the least recently used entries", func() {
+			dir := GinkgoT().TempDir()
+			store, err := NewPromptCacheStore(dir, 1024)
+			Expect(err).ToNot(HaveOccurred())
+
+			old := store.Path("model", "old")
+			recent := store.Path("model", "recent")
+			Expect(os.WriteFile(old, make([]byte, 800), 0o644)).To(Succeed())
+			Expect(os.WriteFile(recent, make([]byte, 800), 0o644)).To(Succeed())
+			Expect(os.Chtimes(old, time.Now().Add(-time.Hour), time.Now().Add(-time.Hour))).To(Succeed())
+
+			Expect(store.Evict()).To(Succeed())
+			Expect(old).ToNot(BeAnExistingFile())
+			Expect(recent).To(BeAnExistingFile())
+			Expect(old + ".lock").ToNot(BeAnExistingFile())
+		})
+
+		It("tells apart models that only differ in their weights", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			data, err := os.ReadFile(testModelPath)
+			Expect(err).ToNot(HaveOccurred())
+			model, err := NewFromMemory(data, SetContext(128))
+			Expect(err).ToNot(HaveOccurred())
+			fingerprint := model.Fingerprint()
+			model.Free()
+
+			// knowing the SHA-256 of the model does not change its key
+			model, err = NewFromMemory(data, SetContext(128), SetExpectedSHA256(fmt.Sprintf("%x", sha256.Sum256(data))))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(model.Fingerprint()).To(Equal(fingerprint))
+			model.Free()
+
+			tuned := append([]byte(nil), data...)
+			tuned[len(tuned)-1]++
+			model, err = NewFromMemory(tuned, SetContext(128))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(model.Fingerprint()).ToNot(Equal(fingerprint))
+			model.Free()
+
+			model, err = NewFromMemory(data, SetContext(128))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(model.Fingerprint()).To(Equal(fingerprint))
+			model.Free()
+		})
+	})
+
+	Context("Sharded models", func() {
+		// shard builds a GGUF file holding only split metadata
+		shard := func(no, count uint16) []byte {
+			return encodeGGUF([]gguf.KV{
+				{Key: "split.no", Type: gguf.TypeUint16, Value: no},
+				{Key: "split.count", Type: gguf.TypeUint16, Value: count},
+				{Key: "split.tensors.count", Type: gguf.TypeInt32, Value: int32(0)},
+			})
+		}
+
+		It("rejects shards that do not belong together", func() {
+			_, err := NewFromMemoryShards([][]byte{shard(0, 3), shard(1, 3)})
+			Expect(err).To(MatchError(ContainSubstring("2 shards were given")))
+
+			_, err = NewFromMemoryShards([][]byte{shard(1, 2), shard(0, 2)})
+			Expect(err).To(MatchError(ContainSubstring("in order")))
+
+			_, err = NewFromMemoryShards([][]byte{shard(0, 2)[:20], shard(1, 2)})
+			Expect(err).To(MatchError(ContainSubstring("truncated")))
+		})
+
+		It("verifies the SHA-256 of every shard", func() {
+			parts := [][]byte{shard(0, 2), shard(1, 2)}
+			wrong := fmt.Sprintf("%x", sha256.Sum256(nil))
+
+			_, err := NewFromMemoryShards(parts, SetVerifySHA256File(true))
+			Expect(err).To(MatchError(ContainSubstring("only applies to models loaded from files")))
+			_, err = NewFromMemory(parts[0], SetVerifySHA256File(true))
+			Expect(err).To(MatchError(ContainSubstring("only applies to models loaded from files")))
+			_, err = NewFromMemoryShards(parts, SetExpectedSHA256(wrong))
+			Expect(err).To(MatchError(ContainSubstring("no single SHA-256")))
+
+			dir := GinkgoT().TempDir()
+			for i, part := range parts {
+				path := filepath.Join(dir, fmt.Sprintf("model-%05d-of-00002.gguf", i+1))
+				Expect(os.WriteFile(path, part, 0o644)).To(Succeed())
+				Expect(os.WriteFile(path+ChecksumExt, []byte(wrong+"\n"), 0o644)).To(Succeed())
+			}
+			path := filepath.Join(dir, "model-00001-of-00002.gguf")
+			_, err = New(path, SetExpectedSHA256(wrong))
+			Expect(err).To(MatchError(ContainSubstring("no single SHA-256")))
+			_, err = New(path, SetVerifySHA256File(true))
+			Expect(err).To(MatchError(ErrChecksumMismatch))
+			Expect(err).To(MatchError(ContainSubstring("shard 2")))
+		})
+
+		It("verifies the signature of every shard", func() {
+			pub, priv, err := ed25519.GenerateKey(nil)
+			Expect(err).ToNot(HaveOccurred())
+			parts := [][]byte{shard(0, 2), shard(1, 2)}
+
+			dir := GinkgoT().TempDir()
+			paths := make([]string, len(parts))
+			for i, part := range parts {
+				paths[i] = filepath.Join(dir, fmt.Sprintf("model-%05d-of-00002.gguf", i+1))
+				Expect(os.WriteFile(paths[i], part, 0o644)).To(Succeed())
+				sig, err := pack.Sign(priv, bytes.NewReader(part))
+				Expect(err).ToNot(HaveOccurred())
+				Expect(pack.WriteSignature(paths[i]+pack.SignatureExt, sig)).To(Succeed())
+			}
+
+			// the shards only hold metadata, so they pass verification and
+			// then fail to load
+			_, err = New(paths[0], SetRequireSignature(pub))
+			Expect(err).To(HaveOccurred())
+			Expect(err).ToNot(MatchError(ErrSignatureInvalid))
+
+			_, err = New(paths[0], SetRequireSignature(pub[:16]))
+			Expect(err).To(MatchError(ErrSignatureInvalid))
+			_, err = NewFromShards(paths, SetRequireSignature(pub), SetSignature(make([]byte, 64)))
+			Expect(err).To(MatchError(ErrSignatureInvalid))
+			_, err = NewFromMemoryShards(parts, SetRequireSignature(pub))
+			Expect(err).To(MatchError(ErrSignatureInvalid))
+
+			sig, err := pack.Sign(priv, bytes.NewReader(parts[0]))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pack.WriteSignature(paths[1]+pack.SignatureExt, sig)).To(Succeed())
+			_, err = NewFromShards(paths, SetRequireSignature(pub))
+			Expect(err).To(MatchError(ErrSignatureInvalid))
+			Expect(err).To(MatchError(ContainSubstring("shard 2")))
+
+			Expect(os.Remove(paths[1] + pack.SignatureExt)).To(Succeed())
+			_, err = NewFromShards(paths, SetRequireSignature(pub))
+			Expect(err).To(MatchError(ErrSignatureInvalid))
+		})
+	})
+
+	Context("Memory estimation", func() {
+		It("sizes the weights and the KV cache from the header", func() {
+			kv := []gguf.KV{{Key: "general.architecture", Type: gguf.TypeString, Value: "llama"}}
+			for _, p := range []struct {
+				key string
+				v   uint32
+			}{{"block_count", 2}, {"embedding_length", 8}, {"feed_forward_length", 16}, {"attention.head_count", 2}} {
+				kv = append(kv, gguf.KV{Key: "llama." + p.key, Type: gguf.TypeUint32, Value: p.v})
+			}
+			data := encodeGGUF(kv,
+				gguf.TensorInfo{Name: "token_embd.weight", Shape: []uint64{8, 10}, Type: gguf.GGMLTypeF32, Offset: 0},
+				gguf.TensorInfo{Name: "blk.1.attn_q.weight", Shape: []uint64{8, 8}, Type: gguf.GGMLTypeF32, Offset: 320},
+			)
+
+			path := filepath.Join(GinkgoT().TempDir(), "model.gguf")
+			Expect(os.WriteFile(path, data, 0o644)).To(Succeed())
+
+			f32, err := EstimateMemory(path, SetContext(16))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f32.Weights).To(BeNumerically("==", 576))
+			Expect(f32.Offloaded).To(BeZero())
+
+			f16, err := EstimateMemory(path, SetContext(16), EnableF16Memory, SetGPULayers(1))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f32.KVCache - f16.KVCache).To(BeNumerically("==", 2*2*16*8*2))
+			Expect(f32.KVCacheF16).To(Equal(f16.KVCache))
+			Expect(f16.KVCacheF32).To(Equal(f32.KVCache))
+			Expect(f16.Offloaded).To(BeNumerically("==", 256))
+
+			inRAM := f16.Weights
+			if SupportsGPUOffload() {
+				inRAM -= f16.Offloaded
+			}
+			Expect(f16.Total()).To(Equal(inRAM + f16.KVCache + f16.Compute + f16.Output))
+			Expect(f16.Total()).To(BeNumerically("<", f32.Total()))
+
+			_, err = EstimateMemory(path + ".missing")
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Model manager", func() {
+		It("only serves registered models", func() {
+			manager := NewManager(1 << 30)
+			Expect(manager.Register("missing", "not-existing")).ToNot(Succeed())
+
+			_, _, err := manager.Acquire(context.Background(), "missing")
+			Expect(err).To(MatchError(ContainSubstring("not registered")))
+		})
+
+		It("cancels loads with the context of the caller", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "model.gguf")
+			Expect(os.WriteFile(path, []byte("GGUF"), 0o644)).To(Succeed())
+			manager := NewManager(1 << 30)
+			Expect(manager.Register("model", path)).To(Succeed())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, _, err := manager.Acquire(ctx, "model")
+			Expect(err).To(MatchError(context.Canceled))
+			Expect(manager.Status()[0].State).To(Equal(ModelUnloaded))
+			Expect(manager.Close()).To(Succeed())
+		})
+
+		It("unloads the least recently used model", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			estimate, err := EstimateMemory(testModelPath, SetContext(128))
+			Expect(err).ToNot(HaveOccurred())
+			manager := NewManager(estimate.Total() * 3 / 2)
+			Expect(manager.Register("a", testModelPath, SetContext(128))).To(Succeed())
+			Expect(manager.Register("b", testModelPath, SetContext(128))).To(Succeed())
+
+			first, release, err := manager.Acquire(context.Background(), "a")
+			Expect(err).ToNot(HaveOccurred())
+			second, releaseAgain, err := manager.Acquire(context.Background(), "a")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(second).To(BeIdenticalTo(first))
+			release()
+			releaseAgain()
+
+			_, release, err = manager.Acquire(context.Background(), "b")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(manager.Status()).To(Equal([]ModelStatus{
+				{Name: "a", State: ModelUnloaded, Memory: estimate.Total()},
+				{Name: "b", State: ModelReady, Memory: estimate.Total(), Users: 1},
+			}))
+
+			// "b" is in use, so there is no room for "a"
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			_, _, err = manager.Acquire(ctx, "a")
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+
+			release()
+			Expect(manager.Close()).To(Succeed())
+		})
 	})
+
+	Context("Worker processes", func() {
+		It("reports models failing to load", func() {
+			worker, err := NewWorker("not-existing")
+			Expect(err).To(MatchError(ContainSubstring("failed loading model")))
+			Expect(worker).To(BeNil())
+		})
+
+		It("rejects options that can not reach the worker", func() {
+			_, err := NewWorker("not-existing", SetLoadProgress(func(float32) bool { return true }))
+			Expect(err).To(MatchError(ContainSubstring("SetLoadProgress")))
+			_, err = NewWorker("not-existing", SetModelKey(make([]byte, 32)))
+			Expect(err).To(MatchError(ContainSubstring("SetModelKey")))
+		})
+
+		It("survives crashes of the worker", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			worker, err := NewWorker(testModelPath, SetContext(128))
+			Expect(err).ToNot(HaveOccurred())
+			defer worker.Close()
+
+			var tokens []string
+			text, err := worker.Predict("2+2=", SetTokens(8), SetTokenCallback(func(token string) bool {
+				tokens = append(tokens, token)
+				return true
+			}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(tokens).ToNot(BeEmpty())
+			Expect(text).ToNot(BeEmpty())
+
+			killed := false
+			_, err = worker.Predict("Count from one to one hundred:", SetTokens(64), SetTokenCallback(func(string) bool {
+				if !killed {
+					killed = true
+					Expect(worker.Process().Kill()).To(Succeed())
+				}
+				return true
+			}))
+			Expect(err).To(MatchError(ErrWorkerCrashed))
+
+			n, _, err := worker.TokenizeString("2+2=")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(n).To(BeNumerically(">", 0))
+
+			_, err = worker.Predict("2+2=", SetContextOverflowHook(func(history []int32) []int32 { return history }))
+			Expect(err).To(MatchError(ContainSubstring("SetContextOverflowHook")))
+		})
+	})
+
+	Context("Shared models", func() {
+		It("shares the weights between processes", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+			if runtime.GOOS != "linux" {
+				Skip("test skipped - reads the memory maps from /proc.")
+			}
+
+			shared, err := PublishModel(testModelPath)
+			Expect(err).ToNot(HaveOccurred())
+			defer shared.Close()
+
+			var children []*exec.Cmd
+			for i := 0; i < 2; i++ {
+				cmd := exec.Command(os.Args[0])
+				cmd.Env = append(os.Environ(), "LLAMA_TEST_SHARED_MODEL=1")
+				cmd.ExtraFiles = []*os.File{shared.File()}
+				cmd.Stderr = GinkgoWriter
+				stdin, err := cmd.StdinPipe()
+				Expect(err).ToNot(HaveOccurred())
+				stdout, err := cmd.StdoutPipe()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(cmd.Start()).To(Succeed())
+				defer cmd.Wait()
+				defer stdin.Close()
+
+				// wait for the child to have read the weights
+				lines := bufio.NewScanner(stdout)
+				for lines.Scan() && lines.Text() != "ready" {
+				}
+				Expect(lines.Err()).ToNot(HaveOccurred())
+				go io.Copy(io.Discard, stdout)
+				children = append(children, cmd)
+			}
+
+			for _, cmd := range children {
+				rss, sharedRSS := mappingMemory(cmd.Process.Pid, "memfd:")
+				Expect(rss).To(BeNumerically(">", 0))
+				Expect(sharedRSS).To(BeNumerically(">=", rss*9/10))
+			}
+		})
+	})
+
+	Context("Embedded models", func() {
+		for _, compress := range []bool{false, true} {
+			compress := compress
+			It(fmt.Sprintf("loads models packed into the executable by name (compressed: %v)", compress), func() {
+				if testModelPath == "" {
+					Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+				}
+
+				packed := filepath.Join(GinkgoT().TempDir(), "packed.test")
+				Expect(packTestBinary(packed, testModelPath, compress, "chat", "embed")).To(Succeed())
+
+				for _, name := range []string{"chat", "embed"} {
+					cmd := exec.Command(packed)
+					cmd.Env = append(os.Environ(), "LLAMA_TEST_EMBEDDED_MODELS="+name)
+					cmd.Stderr = GinkgoWriter
+					out, err := cmd.Output()
+					Expect(err).ToNot(HaveOccurred())
+					Expect(string(out)).To(ContainSubstring("models chat,embed, loaded " + name))
+				}
+			})
+		}
+	})
+
+	Context("Encrypted models", func() {
+		It("decrypts models into locked memory and detects tampering", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			key := bytes.Repeat([]byte{0x42}, 32)
+			encrypted := filepath.Join(GinkgoT().TempDir(), "model.enc")
+			src, err := os.Open(testModelPath)
+			Expect(err).ToNot(HaveOccurred())
+			defer src.Close()
+			dst, err := os.Create(encrypted)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = pack.Encrypt(dst, src, key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dst.Close()).To(Succeed())
+
+			model, err := NewFromEncrypted(encrypted, key, SetContext(128))
+			if err != nil && strings.Contains(err.Error(), "failed to lock") {
+				Skip("test skipped - the model does not fit in the memory lock limit.")
+			}
+			Expect(err).ToNot(HaveOccurred())
+			text, err := model.Predict("Hello", SetTokens(4))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(text).ToNot(BeEmpty())
+			Expect(model.Close()).To(Succeed())
+
+			_, err = NewFromEncrypted(encrypted, bytes.Repeat([]byte{0x43}, 32), SetContext(128))
+			Expect(err).To(MatchError(pack.ErrAuthentication))
+
+			f, err := os.OpenFile(encrypted, os.O_RDWR, 0)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = f.WriteAt([]byte{0xff}, 1000)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Close()).To(Succeed())
+			_, err = NewFromEncrypted(encrypted, key, SetContext(128))
+			Expect(err).To(MatchError(pack.ErrAuthentication))
+		})
+	})
+
+	Context("Signed models", func() {
+		It("requires a signature by a trusted key", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			pub, priv, err := ed25519.GenerateKey(nil)
+			Expect(err).ToNot(HaveOccurred())
+			otherPub, _, err := ed25519.GenerateKey(nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			data, err := os.ReadFile(testModelPath)
+			Expect(err).ToNot(HaveOccurred())
+			path := filepath.Join(GinkgoT().TempDir(), "model.gguf")
+			Expect(os.WriteFile(path, data, 0o644)).To(Succeed())
+
+			_, err = New(path, SetContext(128), SetRequireSignature(pub))
+			Expect(err).To(MatchError(ErrSignatureInvalid))
+
+			sig, err := pack.Sign(priv, bytes.NewReader(data))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(pack.WriteSignature(path+pack.SignatureExt, sig)).To(Succeed())
+			model, err := New(path, SetContext(128), SetRequireSignature(otherPub, pub))
+			Expect(err).ToNot(HaveOccurred())
+			model.Free()
+
+			_, err = New(path, SetContext(128), SetRequireSignature(otherPub))
+			Expect(err).To(MatchError(ErrSignatureInvalid))
+
+			model, err = NewFromMemory(data, SetContext(128), SetRequireSignature(pub), SetSignature(sig))
+			Expect(err).ToNot(HaveOccurred())
+			model.Free()
+			_, err = NewFromMemory(data, SetContext(128), SetRequireSignature(pub))
+			Expect(err).To(MatchError(ErrSignatureInvalid))
+
+			data[len(data)-1]++
+			Expect(os.WriteFile(path, data, 0o644)).To(Succeed())
+			_, err = New(path, SetContext(128), SetRequireSignature(pub))
+			Expect(err).To(MatchError(ErrSignatureInvalid))
+		})
+	})
+
+	Context("Checksums", func() {
+		It("verifies the SHA-256 of models and caches it", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			cache := GinkgoT().TempDir()
+			old, set := os.LookupEnv("XDG_CACHE_HOME")
+			os.Setenv("XDG_CACHE_HOME", cache)
+			DeferCleanup(func() {
+				if set {
+					os.Setenv("XDG_CACHE_HOME", old)
+				} else {
+					os.Unsetenv("XDG_CACHE_HOME")
+				}
+			})
+
+			data, err := os.ReadFile(testModelPath)
+			Expect(err).ToNot(HaveOccurred())
+			sum := fmt.Sprintf("%x", sha256.Sum256(data))
+			wrong := fmt.Sprintf("%x", sha256.Sum256(nil))
+			path := filepath.Join(GinkgoT().TempDir(), "model.gguf")
+			Expect(os.WriteFile(path, data, 0o644)).To(Succeed())
+
+			_, err = New(path, SetContext(128), SetExpectedSHA256("not hex"))
+			Expect(err).To(MatchError(ContainSubstring("invalid SHA-256")))
+			_, err = NewFromMemory(data, SetContext(128), SetExpectedSHA256(wrong))
+			Expect(err).To(MatchError(ErrChecksumMismatch))
+			model, err := NewFromMemory(data, SetContext(128), SetExpectedSHA256(sum))
+			Expect(err).ToNot(HaveOccurred())
+			model.Free()
+
+			_, err = New(path, SetContext(128), SetExpectedSHA256(wrong))
+			Expect(err).To(MatchError(ErrChecksumMismatch))
+			Expect(filepath.Join(cache, "go-llama.cpp", "sha256")).ToNot(BeADirectory())
+
+			Expect(os.WriteFile(path+ChecksumExt, []byte(sum+"  model.gguf\n"), 0o644)).To(Succeed())
+			model, err = New(path, SetContext(128), SetVerifySHA256File(true))
+			Expect(err).ToNot(HaveOccurred())
+			model.Free()
+			entries, err := os.ReadDir(filepath.Join(cache, "go-llama.cpp", "sha256"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(entries).To(HaveLen(1))
+
+			// the cached result fails the wrong sum without hashing again
+			_, err = New(path, SetContext(128), SetExpectedSHA256(wrong))
+			Expect(err).To(MatchError(ErrChecksumMismatch))
+
+			// a modified model is hashed again
+			data[len(data)-1]++
+			Expect(os.WriteFile(path, data, 0o644)).To(Succeed())
+			Expect(os.Chtimes(path, time.Now(), time.Now().Add(time.Hour))).To(Succeed())
+			_, err = New(path, SetContext(128), SetVerifySHA256File(true))
+			Expect(err).To(MatchError(ErrChecksumMismatch))
+		})
+	})
+
 	Context("Inferencing tests (using "+testModelPath+") ", func() {
 		getModel := func() (*LLama, error) {
 			model, err := New(
@@ -46,6 +596,149 @@ how much is 2+2?
 			Expect(text).To(ContainSubstring("4"), text)
 		})
 
+		It("loads models from a file system", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			fsys := os.DirFS(filepath.Dir(testModelPath))
+			model, err := NewFromFS(fsys, filepath.Base(testModelPath), SetContext(128))
+			Expect(err).ToNot(HaveOccurred())
+			defer model.Free()
+
+			text, err := model.Predict(`[INST] Answer to the following question:
+how much is 2+2?
+[/INST]`)
+			Expect(err).ToNot(HaveOccurred(), text)
+			Expect(text).To(ContainSubstring("4"), text)
+
+			_, err = NewFromFS(fsys, "missing.gguf")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("reports loading progress and cancels loads", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			var last float32
+			model, err := New(testModelPath, SetContext(128), SetLoadProgress(func(fraction float32) bool {
+				Expect(fraction).To(BeNumerically(">=", last))
+				last = fraction
+				return true
+			}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(last).To(BeNumerically("==", 1))
+			model.Free()
+
+			model, err = New(testModelPath, SetContext(128), SetMMap(false), SetLoadProgress(func(fraction float32) bool {
+				return fraction < 0.5
+			}))
+			Expect(err).To(MatchError(ErrLoadCanceled))
+			Expect(model).To(BeNil())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			model, err = NewWithContext(ctx, testModelPath, SetContext(128), SetLoadProgress(func(fraction float32) bool {
+				if fraction > 0 {
+					cancel()
+				}
+				return true
+			}))
+			Expect(err).To(MatchError(context.Canceled))
+			Expect(model).To(BeNil())
+		})
+
+		It("estimates the memory a model takes", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+			rss := func() int64 {
+				status, err := os.ReadFile("/proc/self/status")
+				if err != nil {
+					Skip("test skipped - needs /proc/self/status")
+				}
+				for _, line := range strings.Split(string(status), "\n") {
+					if kb, ok := strings.CutPrefix(line, "VmRSS:"); ok {
+						n, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(kb, "kB")), 10, 64)
+						Expect(err).ToNot(HaveOccurred())
+						return n * 1024
+					}
+				}
+				Skip("test skipped - VmRSS is not reported")
+				return 0
+			}
+			// the estimate leaves out allocator and library overheads
+			const tolerance = 0.25
+
+			opts := []ModelOption{SetContext(128), SetMMap(false)}
+			estimate, err := EstimateMemory(testModelPath, opts...)
+			Expect(err).ToNot(HaveOccurred())
+
+			runtime.GC()
+			before := rss()
+			model, err := New(testModelPath, opts...)
+			Expect(err).ToNot(HaveOccurred())
+			defer model.Free()
+
+			used := float64(rss() - before)
+			Expect(used).To(BeNumerically("~", float64(estimate.Total()), tolerance*float64(estimate.Total())))
+		})
+
+		It("reloads models without dropping requests", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			reloadable, err := NewReloadable(testModelPath, SetContext(128))
+			Expect(err).ToNot(HaveOccurred())
+			defer reloadable.Close()
+
+			old, release, err := reloadable.Acquire()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(reloadable.ReloadFrom(context.Background(), "not-existing")).ToNot(Succeed())
+			current, releaseCurrent, err := reloadable.Acquire()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(current).To(BeIdenticalTo(old))
+			releaseCurrent()
+
+			Expect(reloadable.Reload(context.Background())).To(Succeed())
+			current, releaseCurrent, err = reloadable.Acquire()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(current).ToNot(BeIdenticalTo(old))
+			releaseCurrent()
+
+			// the request started before the reload still runs on the old model
+			_, err = old.Predict("2+2=", SetTokens(4))
+			Expect(err).ToNot(HaveOccurred())
+			release()
+
+			_, err = reloadable.Predict("2+2=", SetTokens(4))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("closes models once", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			model, err := getModel()
+			Expect(err).ToNot(HaveOccurred())
+			session, err := model.NewSession()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(model.Close()).To(Succeed())
+			Expect(model.Close()).To(Succeed())
+			model.Free()
+
+			_, err = model.Predict("2+2=")
+			Expect(err).To(MatchError(ErrClosed))
+			_, _, err = model.TokenizeString("2+2=")
+			Expect(err).To(MatchError(ErrClosed))
+			Expect(session.Eval("2+2=")).To(MatchError(ErrClosed))
+			session.Free()
+		})
+
 		It("speculative sampling predicts", Label("gpu"), func() {
 			if testModelPath == "" {
 				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
@@ -83,6 +776,298 @@ how much is 2+2?
 			Expect(len(text)).To(BeNumerically(">", 0))
 		})
 
+		It("forks sessions into independent branches", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			model, err := getModel()
+			Expect(err).ToNot(HaveOccurred())
+			defer model.Free()
+
+			session, err := model.NewSession()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(session.Eval("The capital of France is")).To(Succeed())
+			nPast := session.NPast()
+			Expect(nPast).To(BeNumerically(">", 0))
+
+			branch, err := session.Fork()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(branch.NPast()).To(Equal(nPast))
+
+			session.Free()
+
+			text, err := branch.Predict("", SetTokens(8), SetSeed(1))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(text).ToNot(BeEmpty())
+			Expect(branch.NPast()).To(BeNumerically(">", nPast))
+			branch.Free()
+		})
+
+		It("reuses cached prompt prefixes", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			model, err := New(testModelPath, SetContext(128), SetPrefixCache(512*1024*1024))
+			Expect(err).ToNot(HaveOccurred())
+			defer model.Free()
+
+			system := "You are a helpful assistant that answers briefly.\n"
+			_, err = model.Predict(system+"Q: 2+2?\nA:", SetTokens(4))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(model.PrefixCacheStats().Entries).To(Equal(1))
+
+			_, err = model.Predict(system+"Q: 3+3?\nA:", SetTokens(4))
+			Expect(err).ToNot(HaveOccurred())
+			stats := model.PrefixCacheStats()
+			Expect(stats.Hits).To(BeNumerically(">=", 1))
+			Expect(stats.Bytes).To(BeNumerically("<=", stats.Budget))
+
+			// sharing only the first tokens is not worth restoring a state
+			_, err = model.Predict("You are", SetTokens(4))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(model.PrefixCacheStats().Hits).To(Equal(stats.Hits))
+			Expect(model.PrefixCacheStats().Misses).To(Equal(stats.Misses + 1))
+		})
+
+		It("reports context overflows", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			model, err := getModel()
+			Expect(err).ToNot(HaveOccurred())
+			defer model.Free()
+
+			_, err = model.PredictWithResult("Count from one to one thousand:", SetTokens(256), IgnoreEOS,
+				SetContextOverflowPolicy(ContextError))
+			Expect(err).To(MatchError(ErrContextFull))
+
+			var shifts []ContextShift
+			result, err := model.PredictWithResult("Count from one to one thousand:", SetTokens(256), IgnoreEOS,
+				SetNKeep(4), SetContextWindow(32), SetContextShiftCallback(func(s ContextShift) {
+					shifts = append(shifts, s)
+				}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.ContextShifts).ToNot(BeEmpty())
+			Expect(result.ContextShifts).To(Equal(shifts))
+			Expect(shifts[0].Policy).To(Equal(ContextSlidingWindow))
+		})
+
+		It("suspends and resumes predictions", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			model, err := getModel()
+			Expect(err).ToNot(HaveOccurred())
+			defer model.Free()
+
+			opts := []PredictOption{SetTokens(32), SetSeed(42), SetTemperature(0.8), IgnoreEOS}
+			full, err := model.Predict("Once upon a time", opts...)
+			Expect(err).ToNot(HaveOccurred())
+
+			n := 0
+			result, err := model.PredictWithResult("Once upon a time", append(opts, SetTokenCallback(func(string) bool {
+				if n++; n == 8 {
+					Expect(model.Suspend()).To(BeTrue())
+				}
+				return true
+			}))...)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Checkpoint).ToNot(BeNil())
+			Expect(full).To(HavePrefix(result.Text))
+
+			data, err := result.Checkpoint.MarshalBinary()
+			Expect(err).ToNot(HaveOccurred())
+			var checkpoint GenerationCheckpoint
+			Expect(checkpoint.UnmarshalBinary(data)).To(Succeed())
+
+			resumed, err := model.Resume(&checkpoint, opts...)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(resumed.Checkpoint).To(BeNil())
+			Expect(resumed.Text).To(Equal(full))
+		})
+
+		It("reports suspensions it can not resume", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			model, err := getModel()
+			Expect(err).ToNot(HaveOccurred())
+			defer model.Free()
+
+			n := 0
+			_, err = model.Predict("Once upon a time", SetTokens(32), IgnoreEOS, SetTokenCallback(func(string) bool {
+				if n++; n == 8 {
+					Expect(model.Suspend()).To(BeTrue())
+				}
+				return true
+			}))
+			Expect(err).To(MatchError(ErrSuspended))
+
+			n = 0
+			result, err := model.PredictWithResult("Once upon a time", SetTokens(16), IgnoreEOS,
+				SetNegativePrompt("The end"), SetNegativePromptScale(1.5), SetTokenCallback(func(string) bool {
+					if n++; n == 8 {
+						Expect(model.Suspend()).To(BeFalse())
+					}
+					return true
+				}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.StopReason).To(Equal(StopCompleted))
+		})
+
+		It("rejects truncated and tampered checkpoints", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			model, err := getModel()
+			Expect(err).ToNot(HaveOccurred())
+			defer model.Free()
+
+			n := 0
+			result, err := model.PredictWithResult("Once upon a time", SetTokens(32), IgnoreEOS, SetTokenCallback(func(string) bool {
+				if n++; n == 8 {
+					Expect(model.Suspend()).To(BeTrue())
+				}
+				return true
+			}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.Checkpoint).ToNot(BeNil())
+			data, err := result.Checkpoint.MarshalBinary()
+			Expect(err).ToNot(HaveOccurred())
+
+			// offsets of the counters, of the first prompt token and of
+			// the size of the state in the encoded checkpoint
+			off := 8
+			for i := 0; i < 3; i++ {
+				off += 4 + int(binary.LittleEndian.Uint32(data[off:]))
+			}
+			counters := off
+			off += 16
+			firstToken := off + 4
+			for i := 0; i < 5; i++ {
+				off += 4 + 4*int(binary.LittleEndian.Uint32(data[off:]))
+			}
+			stateSize := off
+
+			resume := func(tamper func(b []byte) []byte) error {
+				b := tamper(append([]byte(nil), data...))
+				var checkpoint GenerationCheckpoint
+				if err := checkpoint.UnmarshalBinary(b); err != nil {
+					return err
+				}
+				_, err := model.Resume(&checkpoint, SetTokens(32), IgnoreEOS)
+				return err
+			}
+
+			Expect(resume(func(b []byte) []byte {
+				size := binary.LittleEndian.Uint64(b[stateSize:])
+				binary.LittleEndian.PutUint64(b[stateSize:], size-100)
+				return b[:len(b)-100]
+			})).To(MatchError(ErrInvalidCheckpoint))
+			Expect(resume(func(b []byte) []byte {
+				return b[:len(b)-100]
+			})).To(MatchError(ContainSubstring("truncated")))
+			Expect(resume(func(b []byte) []byte {
+				binary.LittleEndian.PutUint32(b[counters:], 1<<20)
+				return b
+			})).To(MatchError(ErrInvalidCheckpoint))
+			Expect(resume(func(b []byte) []byte {
+				binary.LittleEndian.PutUint32(b[counters+8:], 1<<20)
+				return b
+			})).To(MatchError(ErrInvalidCheckpoint))
+			Expect(resume(func(b []byte) []byte {
+				binary.LittleEndian.PutUint32(b[firstToken:], 1<<30)
+				return b
+			})).To(MatchError(ErrInvalidCheckpoint))
+
+			// the model is still usable
+			Expect(resume(func(b []byte) []byte { return b })).To(Succeed())
+		})
+
+		It("interrupts predictions on SIGINT", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+			if runtime.GOOS == "windows" {
+				Skip("test skipped - sending SIGINT is not supported on windows.")
+			}
+
+			model, err := getModel()
+			Expect(err).ToNot(HaveOccurred())
+			defer model.Free()
+
+			interrupts := make(chan os.Signal, 1)
+			signal.Notify(interrupts, os.Interrupt)
+			go func() {
+				for range interrupts {
+					model.Interrupt()
+				}
+			}()
+			defer func() {
+				// no signal is delivered to the channel once Stop returns
+				signal.Stop(interrupts)
+				close(interrupts)
+			}()
+
+			self, err := os.FindProcess(os.Getpid())
+			Expect(err).ToNot(HaveOccurred())
+			n := 0
+			result, err := model.PredictWithResult("Once upon a time", SetTokens(64), IgnoreEOS, SetTokenCallback(func(string) bool {
+				if n++; n == 4 {
+					Expect(self.Signal(os.Interrupt)).To(Succeed())
+				}
+				return true
+			}))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.StopReason).To(Equal(StopInterrupted))
+			Expect(result.Text).ToNot(BeEmpty())
+			Expect(n).To(BeNumerically("<", 64))
+
+			result, err = model.PredictWithResult("Once upon a time", SetTokens(8))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(result.StopReason).To(Equal(StopCompleted))
+		})
+
+		It("loads models with edited metadata", func() {
+			if testModelPath == "" {
+				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
+			}
+
+			src, err := os.Open(testModelPath)
+			Expect(err).ToNot(HaveOccurred())
+			defer src.Close()
+			info, err := src.Stat()
+			Expect(err).ToNot(HaveOccurred())
+			f, err := gguf.Read(src, info.Size())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(f.Set("general.name", gguf.TypeString, "edited")).To(Succeed())
+			Expect(f.Set("general.license", gguf.TypeString, "MIT")).To(Succeed())
+
+			path := filepath.Join(GinkgoT().TempDir(), "edited.gguf")
+			out, err := os.Create(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(gguf.Rewrite(out, src, f)).To(Succeed())
+			Expect(out.Close()).To(Succeed())
+
+			edited, err := gguf.Open(path)
+			Expect(err).ToNot(HaveOccurred())
+			name, _ := edited.String("general.name")
+			Expect(name).To(Equal("edited"))
+
+			model, err := New(path, SetContext(128))
+			Expect(err).ToNot(HaveOccurred())
+			defer model.Free()
+			text, err := model.Predict("2+2=", SetTokens(4))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(text).ToNot(BeEmpty())
+		})
+
 		It("tokenizes strings successfully", func() {
 			if testModelPath == "" {
 				Skip("test skipped - only makes sense if the TEST_MODEL environment variable is set.")
@@ -123,3 +1108,68 @@ how much is 2+2?
 		})
 	})
 })
+
+// mappingMemory sums the resident and shared memory of the mappings of the
+// process whose path contains name, in kB.
+func mappingMemory(pid int, name string) (rss, shared int64) {
+	f, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "smaps"))
+	Expect(err).ToNot(HaveOccurred())
+	defer f.Close()
+
+	matching := false
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		fields := strings.Fields(lines.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if !strings.HasSuffix(fields[0], ":") {
+			// header of the next mapping
+			matching = strings.Contains(lines.Text(), name)
+			continue
+		}
+		if !matching || len(fields) < 2 {
+			continue
+		}
+		kb, _ := strconv.ParseInt(fields[1], 10, 64)
+		switch fields[0] {
+		case "Rss:":
+			rss += kb
+		case "Shared_Clean:", "Shared_Dirty:":
+			shared += kb
+		}
+	}
+	Expect(lines.Err()).ToNot(HaveOccurred())
+	return rss, shared
+}
+
+// encodeGGUF writes a GGUF file with the metadata kv and the tensors, filled
+// with zeros.
+func encodeGGUF(kv []gguf.KV, tensors ...gguf.TensorInfo) []byte {
+	GinkgoHelper()
+
+	f := &gguf.File{Version: 3, Tensors: tensors}
+	for _, v := range kv {
+		Expect(f.Set(v.Key, v.Type, v.Value)).To(Succeed())
+	}
+	var b bytes.Buffer
+	w, err := gguf.NewWriter(&b, f)
+	Expect(err).ToNot(HaveOccurred())
+
+	tensors = append([]gguf.TensorInfo(nil), tensors...)
+	sort.Slice(tensors, func(i, j int) bool { return tensors[i].Offset < tensors[j].Offset })
+	for _, t := range tensors {
+		size, err := t.Size()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(w.WriteTensor(bytes.NewReader(make([]byte, size)), size)).To(Succeed())
+	}
+	Expect(w.Close()).To(Succeed())
+	return b.Bytes()
+}
+
+// failingReaderAt fails every read with err.
+type failingReaderAt struct{ err error }
+
+func (r failingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return 0, r.err
+}
@@ -5,6 +5,7 @@ package llama
 
 import (
 	"fmt"
+	"os"
 	"syscall"
 	"unsafe"
 )
@@ -35,3 +36,69 @@ func mmapModel(fd int, offset int64, size int) (uintptr, []byte, error) {
 
 	return addr, modelData[:size], nil
 }
+
+// unmapModel unmaps data returned by mmapModel (Unix systems)
+func unmapModel(data []byte) error {
+	// mmapModel skipped the page alignment padding in front of the data
+	pageSize := syscall.Getpagesize()
+	adjustment := int(uintptr(unsafe.Pointer(unsafe.SliceData(data))) % uintptr(pageSize))
+	base := unsafe.Add(unsafe.Pointer(unsafe.SliceData(data)), -adjustment)
+	return syscall.Munmap(unsafe.Slice((*byte)(base), adjustment+len(data)))
+}
+
+// lockFile takes an advisory lock on f, blocking until it is available
+func lockFile(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	return syscall.Flock(int(f.Fd()), how)
+}
+
+// tryLockFile is like lockFile but reports false instead of blocking
+func tryLockFile(f *os.File, exclusive bool) (bool, error) {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// unlockFile releases a lock taken with lockFile or tryLockFile
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// sharedMemoryDir is where named shared models are published: the tmpfs
+// mounted on /dev/shm when there is one
+func sharedMemoryDir() string {
+	if info, err := os.Stat("/dev/shm"); err == nil && info.IsDir() {
+		return "/dev/shm"
+	}
+	return os.TempDir()
+}
+
+// allocLocked allocates size bytes of memory outside of the Go heap, locked
+// so that it is never swapped out (Unix systems)
+func allocLocked(size int) ([]byte, error) {
+	data, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to allocate %d bytes: %w", size, err)
+	}
+	if err := syscall.Mlock(data); err != nil {
+		syscall.Munmap(data)
+		return nil, fmt.Errorf("failed to lock %d bytes of memory, see ulimit -l: %w", size, err)
+	}
+	return data, nil
+}
+
+// freeLocked zeroes and frees memory returned by allocLocked (Unix systems)
+func freeLocked(data []byte) error {
+	clear(data)
+	syscall.Munlock(data)
+	return syscall.Munmap(data)
+}
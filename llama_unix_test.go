@@ -0,0 +1,67 @@
+//go:build !windows
+
+package llama_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// BenchmarkLoadEmbeddedModel reports how long loading a model packed into
+// the executable takes, mapped from the file or decompressed, and the peak
+// RSS of the process loading it.
+func BenchmarkLoadEmbeddedModel(b *testing.B) {
+	modelPath := os.Getenv("TEST_MODEL")
+	if modelPath == "" {
+		b.Skip("benchmark skipped - only makes sense if the TEST_MODEL environment variable is set.")
+	}
+
+	for _, compress := range []bool{false, true} {
+		name := "mapped"
+		if compress {
+			name = "compressed"
+		}
+		b.Run(name, func(b *testing.B) {
+			packed := filepath.Join(b.TempDir(), "packed.test")
+			if err := packTestBinary(packed, modelPath, compress, "model"); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+
+			var loadTime time.Duration
+			var peakRSS int64
+			for i := 0; i < b.N; i++ {
+				cmd := exec.Command(packed)
+				cmd.Env = append(os.Environ(), "LLAMA_TEST_EMBEDDED_MODELS=model")
+				out, err := cmd.Output()
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				lines := bufio.NewScanner(bytes.NewReader(out))
+				for lines.Scan() {
+					var d time.Duration
+					if _, err := fmt.Sscanf(lines.Text(), "load time %d", &d); err == nil {
+						loadTime += d
+					}
+				}
+				rss := cmd.ProcessState.SysUsage().(*syscall.Rusage).Maxrss
+				if runtime.GOOS != "darwin" {
+					// in kilobytes everywhere but on macOS
+					rss *= 1024
+				}
+				peakRSS = max(peakRSS, int64(rss))
+			}
+			b.ReportMetric(float64(loadTime.Milliseconds())/float64(b.N), "load-ms/op")
+			b.ReportMetric(float64(peakRSS)/(1<<20), "peak-rss-MB")
+		})
+	}
+}
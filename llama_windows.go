@@ -5,6 +5,7 @@ package llama
 
 import (
 	"fmt"
+	"os"
 	"syscall"
 	"unsafe"
 )
@@ -15,11 +16,27 @@ var (
 	procCreateFileMapping = modkernel32.NewProc("CreateFileMappingW")
 	procMapViewOfFile     = modkernel32.NewProc("MapViewOfFile")
 	procUnmapViewOfFile   = modkernel32.NewProc("UnmapViewOfFile")
+	procLockFileEx        = modkernel32.NewProc("LockFileEx")
+	procUnlockFileEx      = modkernel32.NewProc("UnlockFileEx")
+	procVirtualAlloc      = modkernel32.NewProc("VirtualAlloc")
+	procVirtualFree       = modkernel32.NewProc("VirtualFree")
+	procVirtualLock       = modkernel32.NewProc("VirtualLock")
+	procVirtualUnlock     = modkernel32.NewProc("VirtualUnlock")
 )
 
 const (
-	PAGE_READONLY = 0x02
-	FILE_MAP_READ = 0x04
+	PAGE_READONLY  = 0x02
+	PAGE_READWRITE = 0x04
+	FILE_MAP_READ  = 0x04
+
+	MEM_COMMIT  = 0x1000
+	MEM_RESERVE = 0x2000
+	MEM_RELEASE = 0x8000
+
+	LOCKFILE_FAIL_IMMEDIATELY = 0x01
+	LOCKFILE_EXCLUSIVE_LOCK   = 0x02
+
+	ERROR_LOCK_VIOLATION syscall.Errno = 33
 )
 
 // mmapModel maps a file region into memory (Windows)
@@ -57,8 +74,9 @@ func mmapModel(fd int, offset int64, size int) (uintptr, []byte, error) {
 		uintptr(size),
 	)
 
+	// the view keeps the mapping alive until it is unmapped
+	syscall.CloseHandle(syscall.Handle(mapping))
 	if addr == 0 {
-		syscall.CloseHandle(syscall.Handle(mapping))
 		return 0, nil, fmt.Errorf("MapViewOfFile failed: %v", err)
 	}
 
@@ -68,11 +86,102 @@ func mmapModel(fd int, offset int64, size int) (uintptr, []byte, error) {
 	return addr, data, nil
 }
 
-// unmapModel unmaps the memory (Windows specific)
-func unmapModel(addr uintptr) error {
-	ret, _, err := procUnmapViewOfFile.Call(addr)
+// unmapModel unmaps data returned by mmapModel (Windows)
+func unmapModel(data []byte) error {
+	ret, _, err := procUnmapViewOfFile.Call(uintptr(unsafe.Pointer(unsafe.SliceData(data))))
 	if ret == 0 {
 		return fmt.Errorf("UnmapViewOfFile failed: %v", err)
 	}
 	return nil
 }
+
+func lockFileEx(f *os.File, flags uint32) error {
+	var overlapped syscall.Overlapped
+	ret, _, err := procLockFileEx.Call(
+		f.Fd(),
+		uintptr(flags),
+		0,
+		0xFFFFFFFF,
+		0xFFFFFFFF,
+		uintptr(unsafe.Pointer(&overlapped)),
+	)
+	if ret == 0 {
+		return err
+	}
+	return nil
+}
+
+// lockFile takes an advisory lock on f, blocking until it is available
+func lockFile(f *os.File, exclusive bool) error {
+	var flags uint32
+	if exclusive {
+		flags |= LOCKFILE_EXCLUSIVE_LOCK
+	}
+	if err := lockFileEx(f, flags); err != nil {
+		return fmt.Errorf("LockFileEx failed: %v", err)
+	}
+	return nil
+}
+
+// tryLockFile is like lockFile but reports false instead of blocking
+func tryLockFile(f *os.File, exclusive bool) (bool, error) {
+	flags := uint32(LOCKFILE_FAIL_IMMEDIATELY)
+	if exclusive {
+		flags |= LOCKFILE_EXCLUSIVE_LOCK
+	}
+	err := lockFileEx(f, flags)
+	if err == ERROR_LOCK_VIOLATION {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("LockFileEx failed: %v", err)
+	}
+	return true, nil
+}
+
+// unlockFile releases a lock taken with lockFile or tryLockFile
+func unlockFile(f *os.File) error {
+	var overlapped syscall.Overlapped
+	ret, _, err := procUnlockFileEx.Call(
+		f.Fd(),
+		0,
+		0xFFFFFFFF,
+		0xFFFFFFFF,
+		uintptr(unsafe.Pointer(&overlapped)),
+	)
+	if ret == 0 {
+		return fmt.Errorf("UnlockFileEx failed: %v", err)
+	}
+	return nil
+}
+
+// sharedMemoryDir is where named shared models are published. Views of the
+// same file share their pages across processes.
+func sharedMemoryDir() string {
+	return os.TempDir()
+}
+
+// allocLocked allocates size bytes of memory outside of the Go heap, locked
+// so that it is never paged out (Windows)
+func allocLocked(size int) ([]byte, error) {
+	addr, _, err := procVirtualAlloc.Call(0, uintptr(size), MEM_COMMIT|MEM_RESERVE, PAGE_READWRITE)
+	if addr == 0 {
+		return nil, fmt.Errorf("VirtualAlloc failed: %v", err)
+	}
+	if ret, _, err := procVirtualLock.Call(addr, uintptr(size)); ret == 0 {
+		procVirtualFree.Call(addr, 0, MEM_RELEASE)
+		return nil, fmt.Errorf("failed to lock %d bytes of memory, see SetProcessWorkingSetSize: %v", size, err)
+	}
+	return unsafe.Slice((*byte)(unsafe.Pointer(addr)), size), nil
+}
+
+// freeLocked zeroes and frees memory returned by allocLocked (Windows)
+func freeLocked(data []byte) error {
+	clear(data)
+	addr := uintptr(unsafe.Pointer(unsafe.SliceData(data)))
+	procVirtualUnlock.Call(addr, uintptr(len(data)))
+	if ret, _, err := procVirtualFree.Call(addr, 0, MEM_RELEASE); ret == 0 {
+		return fmt.Errorf("VirtualFree failed: %v", err)
+	}
+	return nil
+}
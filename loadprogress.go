@@ -0,0 +1,109 @@
+package llama
+
+// #include "binding.h"
+import "C"
+import (
+	"context"
+	"errors"
+	"io"
+	"runtime/cgo"
+)
+
+// ErrLoadCanceled is returned when the function set with SetLoadProgress
+// cancels loading.
+var ErrLoadCanceled = errors.New("model loading was canceled")
+
+// loadProgress passes the progress of one load to the function set with
+// SetLoadProgress and remembers whether it asked to cancel.
+type loadProgress struct {
+	fn       func(fraction float32) bool
+	canceled bool
+	handle   cgo.Handle
+}
+
+func newLoadProgress(fn func(fraction float32) bool) *loadProgress {
+	p := &loadProgress{fn: fn}
+	if fn != nil {
+		p.handle = cgo.NewHandle(p)
+	}
+	return p
+}
+
+// arg is what the load_model functions take as progress, 0 when there is no
+// function to call.
+func (p *loadProgress) arg() C.uintptr_t {
+	return C.uintptr_t(p.handle)
+}
+
+func (p *loadProgress) free() {
+	if p.handle != 0 {
+		p.handle.Delete()
+	}
+}
+
+// err returns the error of a failed load: ErrLoadCanceled if it was canceled,
+// err otherwise.
+func (p *loadProgress) err(err error) error {
+	if p.canceled {
+		return ErrLoadCanceled
+	}
+	return err
+}
+
+//export loadProgressCallback
+func loadProgressCallback(handle C.uintptr_t, fraction C.float) C.int {
+	p := cgo.Handle(handle).Value().(*loadProgress)
+	if !p.fn(float32(fraction)) {
+		p.canceled = true
+		return 0
+	}
+	return 1
+}
+
+// loadReader stops reading r once the context set by NewWithContext is done,
+// so that verifying a model can be canceled like reading its weights.
+func loadReader(mo ModelOptions, r io.Reader) io.Reader {
+	if mo.ctx == nil {
+		return r
+	}
+	return ctxReader{mo.ctx, r}
+}
+
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// NewWithContext loads a model like New, giving up once ctx is done while
+// its signature and SHA-256 are verified or its weights are read. Creating
+// the context of the model once the weights are loaded is not interrupted.
+// A canceled load frees everything allocated so far and returns ctx.Err().
+func NewWithContext(ctx context.Context, model string, opts ...ModelOption) (*LLama, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	opts = append(opts, func(p *ModelOptions) {
+		p.ctx = ctx
+		progress := p.LoadProgress
+		p.LoadProgress = func(fraction float32) bool {
+			if ctx.Err() != nil {
+				return false
+			}
+			return progress == nil || progress(fraction)
+		}
+	})
+
+	l, err := New(model, opts...)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return l, err
+}
@@ -0,0 +1,302 @@
+package llama
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// ModelState is the state of a model registered with a Manager.
+type ModelState int
+
+const (
+	ModelUnloaded ModelState = iota
+	ModelLoading
+	ModelReady
+	ModelUnloading
+)
+
+func (s ModelState) String() string {
+	switch s {
+	case ModelUnloaded:
+		return "unloaded"
+	case ModelLoading:
+		return "loading"
+	case ModelReady:
+		return "ready"
+	case ModelUnloading:
+		return "unloading"
+	}
+	return fmt.Sprintf("ModelState(%d)", int(s))
+}
+
+// ModelStatus describes a model registered with a Manager.
+type ModelStatus struct {
+	Name  string
+	State ModelState
+	// Estimated memory of the model, counted against the budget while it is
+	// loaded
+	Memory int64
+	// Number of Acquire calls not released yet
+	Users int
+}
+
+// Manager loads registered models on first use and keeps the memory they
+// take within a budget, unloading the least recently used models nobody is
+// using to make room for new ones.
+type Manager struct {
+	mu     sync.Mutex
+	budget int64
+	used   int64
+	models map[string]*managedModel
+	// closed and replaced whenever a model is loaded, unloaded or released
+	changed chan struct{}
+	clock   uint64
+}
+
+type managedModel struct {
+	name   string
+	path   string
+	opts   []ModelOption
+	memory int64
+
+	state    ModelState
+	model    *LLama
+	refs     int
+	lastUsed uint64
+	// set while the model is loading, to share the outcome with concurrent
+	// callers
+	load *modelLoad
+}
+
+type modelLoad struct {
+	done chan struct{}
+	err  error
+	// set when the caller that started the load gave up, the others try
+	// again
+	canceled bool
+}
+
+// NewManager returns a Manager keeping loaded models within budget bytes.
+func NewManager(budget int64) *Manager {
+	return &Manager{
+		budget:  budget,
+		models:  map[string]*managedModel{},
+		changed: make(chan struct{}),
+	}
+}
+
+// Register makes the model at path available as name, loaded with opts. Its
+// memory is estimated with EstimateMemory, or taken as the size of the file
+// when the model can not be estimated.
+func (m *Manager) Register(name, path string, opts ...ModelOption) error {
+	memory := int64(0)
+	if estimate, err := EstimateMemory(path, opts...); err == nil {
+		memory = estimate.Total()
+	} else {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("failed to register %s: %w", name, err)
+		}
+		memory = info.Size()
+	}
+	if memory > m.budget {
+		return fmt.Errorf("model %s needs %d bytes, more than the budget of %d", name, memory, m.budget)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.models[name]; ok {
+		return fmt.Errorf("model %s is already registered", name)
+	}
+	m.models[name] = &managedModel{name: name, path: path, opts: opts, memory: memory}
+	return nil
+}
+
+// Acquire returns the model registered as name, loading it first if needed.
+// Concurrent calls for a model being loaded wait for the same load. When the
+// budget is exhausted, Acquire unloads idle models or waits for models to be
+// released, until ctx is done, which also cancels a load it started. The
+// model stays loaded until release is called, and must not be freed by the
+// caller.
+func (m *Manager) Acquire(ctx context.Context, name string) (model *LLama, release func(), err error) {
+	m.mu.Lock()
+	mm, ok := m.models[name]
+	if !ok {
+		m.mu.Unlock()
+		return nil, nil, fmt.Errorf("model %s is not registered", name)
+	}
+
+	for {
+		switch mm.state {
+		case ModelReady:
+			mm.refs++
+			m.touch(mm)
+			m.mu.Unlock()
+
+			var once sync.Once
+			return mm.model, func() { once.Do(func() { m.release(mm) }) }, nil
+		case ModelLoading:
+			load := mm.load
+			m.mu.Unlock()
+			select {
+			case <-load.done:
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+			if load.err != nil && !load.canceled {
+				return nil, nil, load.err
+			}
+			m.mu.Lock()
+			continue
+		case ModelUnloaded:
+			if victims, ok := m.makeRoom(mm.memory); ok {
+				load := &modelLoad{done: make(chan struct{})}
+				mm.state, mm.load = ModelLoading, load
+				m.used += mm.memory
+				m.mu.Unlock()
+				m.loadModel(ctx, mm, load, victims)
+				if load.err != nil {
+					return nil, nil, load.err
+				}
+				m.mu.Lock()
+				continue
+			}
+		}
+
+		// wait for a model to be unloaded or released
+		changed := m.changed
+		m.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		m.mu.Lock()
+	}
+}
+
+// makeRoom picks the idle models to unload for memory more bytes to fit in
+// the budget, least recently used first, and marks them as unloading. It
+// returns false if there is not enough to unload yet.
+func (m *Manager) makeRoom(memory int64) ([]*managedModel, bool) {
+	var idle []*managedModel
+	for _, mm := range m.models {
+		if mm.state == ModelReady && mm.refs == 0 {
+			idle = append(idle, mm)
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool { return idle[i].lastUsed < idle[j].lastUsed })
+
+	var victims []*managedModel
+	free := m.budget - m.used
+	for _, mm := range idle {
+		if free >= memory {
+			break
+		}
+		victims = append(victims, mm)
+		free += mm.memory
+	}
+	if free < memory {
+		return nil, false
+	}
+
+	for _, mm := range victims {
+		mm.state = ModelUnloading
+	}
+	return victims, true
+}
+
+// loadModel unloads victims and loads mm in their place, giving up when ctx
+// is done.
+func (m *Manager) loadModel(ctx context.Context, mm *managedModel, load *modelLoad, victims []*managedModel) {
+	for _, v := range victims {
+		v.model.Free()
+	}
+
+	m.mu.Lock()
+	for _, v := range victims {
+		v.state, v.model = ModelUnloaded, nil
+		m.used -= v.memory
+	}
+	m.notify()
+	m.mu.Unlock()
+
+	model, err := NewWithContext(ctx, mm.path, mm.opts...)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			load.err, load.canceled = err, true
+		} else {
+			load.err = fmt.Errorf("failed to load %s: %w", mm.name, err)
+		}
+		mm.state = ModelUnloaded
+		m.used -= mm.memory
+	} else {
+		mm.state, mm.model = ModelReady, model
+	}
+	mm.load = nil
+	close(load.done)
+	m.notify()
+}
+
+func (m *Manager) release(mm *managedModel) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mm.refs--
+	m.touch(mm)
+	m.notify()
+}
+
+func (m *Manager) touch(mm *managedModel) {
+	m.clock++
+	mm.lastUsed = m.clock
+}
+
+func (m *Manager) notify() {
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// Status returns the state of every registered model, sorted by name.
+func (m *Manager) Status() []ModelStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := make([]ModelStatus, 0, len(m.models))
+	for _, mm := range m.models {
+		status = append(status, ModelStatus{Name: mm.name, State: mm.state, Memory: mm.memory, Users: mm.refs})
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	return status
+}
+
+// Close frees every loaded model. It fails if some are still in use or
+// loading.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, mm := range m.models {
+		if mm.refs > 0 || mm.state == ModelLoading || mm.state == ModelUnloading {
+			return fmt.Errorf("model %s is still in use", mm.name)
+		}
+	}
+	for _, mm := range m.models {
+		if mm.state == ModelReady {
+			mm.model.Free()
+			mm.state, mm.model = ModelUnloaded, nil
+			m.used -= mm.memory
+		}
+	}
+	m.notify()
+	return nil
+}
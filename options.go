@@ -1,5 +1,10 @@
 package llama
 
+import (
+	"context"
+	"crypto/ed25519"
+)
+
 type ModelOptions struct {
 	ContextSize   int
 	Seed          int
@@ -19,6 +24,30 @@ type ModelOptions struct {
 	LoraBase      string
 	LoraAdapter   string
 	Perplexity    bool
+
+	// Memory budget in bytes for the in-memory prompt prefix cache, 0
+	// disables it, and the tokens a prompt must share with a cached prefix
+	PrefixCacheBudget   int64
+	PrefixCacheMinMatch int
+
+	// Called while the weights are read, returning false cancels loading
+	LoadProgress func(fraction float32) bool `json:"-"`
+
+	// AES key of encrypted models embedded in the executable
+	ModelKey []byte `json:"-"`
+
+	// Keys one of which must have signed the model, and its signature when
+	// it does not come with the model
+	SignatureKeys []ed25519.PublicKey
+	Signature     []byte
+
+	// SHA-256 the model must have, in hex, and whether New reads it from
+	// the file next to the model when it is not set
+	ExpectedSHA256   string
+	VerifySHA256File bool
+
+	// Set by NewWithContext, stops verifying the model once done
+	ctx context.Context
 }
 
 type PredictOptions struct {
@@ -39,9 +68,10 @@ type PredictOptions struct {
 	MirostatTAU       float32
 	PenalizeNL        bool
 	LogitBias         string
-	TokenCallback     func(string) bool
+	TokenCallback     func(string) bool `json:"-"`
 
 	PathPromptCache             string
+	PromptCacheStore            *PromptCacheStore `json:"-"`
 	MLock, MMap, PromptCacheAll bool
 	PromptCacheRO               bool
 	Grammar                     string
@@ -55,6 +85,12 @@ type PredictOptions struct {
 	// Negative prompt parameters
 	NegativePromptScale float32
 	NegativePrompt      string
+
+	// Context overflow handling
+	ContextOverflowPolicy ContextOverflowPolicy
+	ContextWindow         int
+	ContextOverflowHook   func(history []int32) []int32 `json:"-"`
+	ContextShiftCallback  func(ContextShift)            `json:"-"`
 }
 
 type PredictOption func(p *PredictOptions)
@@ -201,6 +237,87 @@ func SetNDraft(nd int) PredictOption {
 	}
 }
 
+// SetPrefixCache enables an in-memory cache of evaluated prompt prefixes.
+// Predict restores the longest cached prefix of its prompt and only evaluates
+// the rest. Saved states are evicted in LRU order once they take more than
+// budget bytes.
+func SetPrefixCache(budget int64) ModelOption {
+	return func(p *ModelOptions) {
+		p.PrefixCacheBudget = budget
+	}
+}
+
+// SetPrefixCacheMinMatch sets how many tokens a prompt must share with a
+// cached prefix for Predict to restore it, 8 by default. Shorter matches are
+// evaluated again and count as misses.
+func SetPrefixCacheMinMatch(n int) ModelOption {
+	return func(p *ModelOptions) {
+		p.PrefixCacheMinMatch = n
+	}
+}
+
+// SetLoadProgress sets a function called with the fraction of the model
+// loaded so far, from 0 to 1. Returning false cancels loading: the model is
+// freed and the constructor returns ErrLoadCanceled.
+func SetLoadProgress(fn func(fraction float32) bool) ModelOption {
+	return func(p *ModelOptions) {
+		p.LoadProgress = fn
+	}
+}
+
+// SetModelKey sets the AES key that decrypts models packed encrypted into the
+// executable, for LoadSelfContainedModel and LoadEmbeddedModel.
+func SetModelKey(key []byte) ModelOption {
+	return func(p *ModelOptions) {
+		p.ModelKey = key
+	}
+}
+
+// SetRequireSignature requires the model to be signed by one of pubkeys, see
+// pack.Sign, and fails loading it with ErrSignatureInvalid otherwise. New
+// reads the signature next to the model file, with pack.SignatureExt appended
+// to its name, LoadSelfContainedModel and LoadEmbeddedModel from the
+// executable, and the other constructors from SetSignature. Each shard of a
+// split model is signed on its own, and NewFromShards reads the signature
+// next to every shard file. Signed model files are read rather than mapped,
+// from the file the signature was checked over.
+func SetRequireSignature(pubkeys ...ed25519.PublicKey) ModelOption {
+	return func(p *ModelOptions) {
+		p.SignatureKeys = pubkeys
+	}
+}
+
+// SetSignature sets the signature of the model checked by SetRequireSignature,
+// in place of the one that comes with it.
+func SetSignature(sig []byte) ModelOption {
+	return func(p *ModelOptions) {
+		p.Signature = sig
+	}
+}
+
+// SetExpectedSHA256 fails loading the model with ErrChecksumMismatch unless
+// its SHA-256 is sum, in hex. The model is hashed while it loads. New caches
+// the files it verified, and does not hash them again until they change. A
+// model split in shards has no single SHA-256, so loading one with it set
+// fails; see SetVerifySHA256File.
+func SetExpectedSHA256(sum string) ModelOption {
+	return func(p *ModelOptions) {
+		p.ExpectedSHA256 = sum
+	}
+}
+
+// SetVerifySHA256File makes New verify the model against the SHA-256 in the
+// file next to it with ChecksumExt appended to its name, as written by
+// sha256sum, when there is one and SetExpectedSHA256 is not used. Each shard
+// of a split model is verified against its own file. Loading a model that is
+// not read from files, such as with NewFromMemory or NewFromFS, fails with it
+// set.
+func SetVerifySHA256File(b bool) ModelOption {
+	return func(p *ModelOptions) {
+		p.VerifySHA256File = b
+	}
+}
+
 func SetPerplexity(b bool) ModelOption {
 	return func(p *ModelOptions) {
 		p.Perplexity = b
@@ -359,6 +476,51 @@ func SetPathPromptCache(f string) PredictOption {
 	}
 }
 
+// SetPromptCacheStore picks the prompt cache session file from a managed
+// store instead of a raw path. See PromptCacheStore.
+func SetPromptCacheStore(s *PromptCacheStore) PredictOption {
+	return func(p *PredictOptions) {
+		p.PromptCacheStore = s
+	}
+}
+
+// SetContextOverflowPolicy sets what happens once the generated text no
+// longer fits in the context.
+func SetContextOverflowPolicy(policy ContextOverflowPolicy) PredictOption {
+	return func(p *PredictOptions) {
+		p.ContextOverflowPolicy = policy
+	}
+}
+
+// SetContextWindow selects the ContextSlidingWindow policy, keeping the
+// first NKeep tokens plus the n most recent ones when the context overflows.
+// With n <= 0 it keeps half of the context left after NKeep.
+func SetContextWindow(n int) PredictOption {
+	return func(p *PredictOptions) {
+		p.ContextOverflowPolicy = ContextSlidingWindow
+		p.ContextWindow = n
+	}
+}
+
+// SetContextOverflowHook selects the ContextHook policy. When the context
+// overflows, fn receives the tokens in the context and returns the tokens to
+// continue from, which must leave room for generation. Returning nil, or more
+// tokens than it was given, stops the prediction with ErrContextFull.
+func SetContextOverflowHook(fn func(history []int32) []int32) PredictOption {
+	return func(p *PredictOptions) {
+		p.ContextOverflowPolicy = ContextHook
+		p.ContextOverflowHook = fn
+	}
+}
+
+// SetContextShiftCallback registers a callback that is called every time
+// tokens are dropped from a full context while predicting.
+func SetContextShiftCallback(fn func(ContextShift)) PredictOption {
+	return func(p *PredictOptions) {
+		p.ContextShiftCallback = fn
+	}
+}
+
 // SetPenalty sets the repetition penalty for text generation.
 func SetPenalty(penalty float32) PredictOption {
 	return func(p *PredictOptions) {
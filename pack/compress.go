@@ -0,0 +1,155 @@
+package pack
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Compressed models are a sequence of chunks of at most ChunkSize bytes of
+// the model, each compressed on its own so that decompressing one takes a
+// bounded amount of memory. Every chunk starts with its size in the file and
+// its size once decompressed as little endian uint32, followed by its DEFLATE
+// data. Chunks that do not compress are stored as they are, with the top bit
+// of their size in the file set.
+const (
+	// ChunkSize is the size of the chunks of compressed models.
+	ChunkSize = 4 << 20
+
+	chunkHeaderSize = 8
+	chunkStored     = 1 << 31
+)
+
+// compress writes the model read from r to w in chunks, and returns the
+// number of bytes written and read.
+func compress(w io.Writer, r io.Reader) (written, read int64, err error) {
+	chunk := make([]byte, ChunkSize)
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	header := make([]byte, chunkHeaderSize)
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if err == io.EOF {
+			return written, read, nil
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return written, read, err
+		}
+		read += int64(n)
+
+		buf.Reset()
+		fw.Reset(&buf)
+		if _, err := fw.Write(chunk[:n]); err != nil {
+			return written, read, err
+		}
+		if err := fw.Close(); err != nil {
+			return written, read, err
+		}
+		data, stored := buf.Bytes(), uint32(buf.Len())
+		if buf.Len() >= n {
+			data, stored = chunk[:n], uint32(n)|chunkStored
+		}
+
+		binary.LittleEndian.PutUint32(header, stored)
+		binary.LittleEndian.PutUint32(header[4:], uint32(n))
+		if _, err := w.Write(header); err != nil {
+			return written, read, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return written, read, err
+		}
+		written += chunkHeaderSize + int64(len(data))
+	}
+}
+
+// chunkReader decompresses a model written by compress, a chunk at a time.
+type chunkReader struct {
+	r *bufio.Reader
+	// size of the model left to decompress
+	left  int64
+	chunk []byte
+	// unread part of chunk
+	pending []byte
+	fr      io.ReadCloser
+	err     error
+}
+
+func newChunkReader(r io.Reader, modelSize int64) *chunkReader {
+	return &chunkReader{r: bufio.NewReader(r), left: modelSize}
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.left == 0 {
+			// the model must end with the data
+			if _, err := c.r.ReadByte(); err != io.EOF {
+				c.err = errors.New("compressed model has trailing data")
+			} else {
+				c.err = io.EOF
+			}
+			continue
+		}
+		c.err = c.next()
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// next decompresses the next chunk into pending.
+func (c *chunkReader) next() error {
+	var header [chunkHeaderSize]byte
+	if _, err := io.ReadFull(c.r, header[:]); err == io.ErrUnexpectedEOF || err == io.EOF {
+		return errors.New("compressed model is truncated")
+	} else if err != nil {
+		return fmt.Errorf("failed to read compressed model: %w", err)
+	}
+	stored := binary.LittleEndian.Uint32(header[:])
+	size := int64(binary.LittleEndian.Uint32(header[4:]))
+	if size == 0 || size > ChunkSize || size > c.left {
+		return fmt.Errorf("invalid chunk of %d bytes in compressed model", size)
+	}
+	if c.chunk == nil {
+		c.chunk = make([]byte, ChunkSize)
+	}
+	chunk := c.chunk[:size]
+
+	limited := io.LimitReader(c.r, int64(stored&^chunkStored))
+	data := limited
+	if stored&chunkStored != 0 {
+		if int64(stored&^chunkStored) != size {
+			return fmt.Errorf("invalid stored chunk of %d bytes in compressed model", size)
+		}
+	} else {
+		if c.fr == nil {
+			c.fr = flate.NewReader(limited)
+		} else {
+			c.fr.(flate.Resetter).Reset(limited, nil)
+		}
+		data = c.fr
+	}
+	if _, err := io.ReadFull(data, chunk); err == io.ErrUnexpectedEOF || err == io.EOF {
+		return errors.New("compressed model is truncated")
+	} else if err != nil {
+		return fmt.Errorf("failed to decompress model: %w", err)
+	}
+	// the chunk must decompress to exactly its size
+	if n, _ := data.Read(make([]byte, 1)); n != 0 {
+		return errors.New("failed to decompress model: chunk is larger than its size")
+	}
+	// skip what follows the end of the compressed data, to the next chunk
+	if _, err := io.Copy(io.Discard, limited); err != nil {
+		return fmt.Errorf("failed to decompress model: %w", err)
+	}
+
+	c.left -= size
+	c.pending = chunk
+	return nil
+}
@@ -0,0 +1,267 @@
+package pack
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Encrypted models are a header followed by the model in chunks of at most
+// ChunkSize bytes, each sealed with AES-GCM. The header is
+//
+//	magic       [8]byte, "LLAMAENC"
+//	version     uint32, little endian
+//	chunk size  uint32, little endian
+//	nonce       [8]byte, random
+//
+// The nonce of a chunk is the nonce of the header followed by the index of
+// the chunk as a big endian uint32. Its additional data is the header
+// followed by 1 for the last chunk and 0 for the others, so that chunks can
+// not be reordered, dropped or moved to another file without failing
+// authentication.
+const (
+	// EncryptedMagic starts encrypted models.
+	EncryptedMagic = "LLAMAENC"
+
+	encryptedVersion    = 1
+	encryptedHeaderSize = 24
+	maxEncryptedChunk   = 64 << 20
+)
+
+var (
+	// ErrAuthentication is returned when an encrypted model fails
+	// authentication, because of a wrong key or tampering.
+	ErrAuthentication = errors.New("model failed authentication: wrong key or tampered data")
+	// ErrEncrypted is returned when reading an encrypted model without a key.
+	ErrEncrypted = errors.New("model is encrypted")
+)
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt writes the model read from r to w encrypted with key, an AES key
+// of 16, 24 or 32 bytes, and returns the number of bytes written.
+func Encrypt(w io.Writer, r io.Reader, key []byte) (int64, error) {
+	ew, err := newEncryptWriter(w, key)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(ew, r); err != nil {
+		return ew.written, err
+	}
+	err = ew.Close()
+	return ew.written, err
+}
+
+// encryptWriter encrypts what is written to it, sealing a chunk once it is
+// full and more follows, and the last one on Close.
+type encryptWriter struct {
+	w       io.Writer
+	gcm     cipher.AEAD
+	header  []byte
+	index   uint32
+	chunk   []byte
+	sealed  []byte
+	written int64
+}
+
+func newEncryptWriter(w io.Writer, key []byte) (*encryptWriter, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, encryptedHeaderSize)
+	header = append(header, EncryptedMagic...)
+	header = binary.LittleEndian.AppendUint32(header, encryptedVersion)
+	header = binary.LittleEndian.AppendUint32(header, ChunkSize)
+	header = header[:encryptedHeaderSize]
+	if _, err := rand.Read(header[16:]); err != nil {
+		return nil, err
+	}
+
+	ew := &encryptWriter{w: w, gcm: gcm, header: header, chunk: make([]byte, 0, ChunkSize)}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	ew.written = encryptedHeaderSize
+	return ew, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		if len(ew.chunk) == ChunkSize {
+			if err := ew.seal(false); err != nil {
+				return n, err
+			}
+		}
+		m := copy(ew.chunk[len(ew.chunk):ChunkSize], p)
+		ew.chunk = ew.chunk[:len(ew.chunk)+m]
+		p = p[m:]
+		n += m
+	}
+	return n, nil
+}
+
+// Close seals the last chunk. It does not close the underlying writer.
+func (ew *encryptWriter) Close() error {
+	err := ew.seal(true)
+	clear(ew.chunk[:cap(ew.chunk)])
+	return err
+}
+
+func (ew *encryptWriter) seal(last bool) error {
+	if ew.index == ^uint32(0) {
+		return errors.New("model is too large to encrypt")
+	}
+	ew.sealed = ew.gcm.Seal(ew.sealed[:0], chunkNonce(ew.header, ew.index), ew.chunk, chunkAD(ew.header, last))
+	if _, err := ew.w.Write(ew.sealed); err != nil {
+		return err
+	}
+	ew.written += int64(len(ew.sealed))
+	ew.index++
+	ew.chunk = ew.chunk[:0]
+	return nil
+}
+
+func chunkNonce(header []byte, index uint32) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte(nil), header[16:24]...), index)
+}
+
+func chunkAD(header []byte, last bool) []byte {
+	ad := append([]byte(nil), header...)
+	if last {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// Decrypt returns a reader of the model encrypted with key in the file r of
+// the given size, and the size of the model. Reading fails with
+// ErrAuthentication if the model was not encrypted with key or was tampered
+// with. Reads into buffers of at least a chunk decrypt in place, without
+// copying the model anywhere else in memory.
+func Decrypt(r io.ReaderAt, size int64, key []byte) (io.Reader, int64, error) {
+	if size < encryptedHeaderSize {
+		return nil, 0, fmt.Errorf("%w: encrypted model is truncated", ErrAuthentication)
+	}
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, 0, fmt.Errorf("failed to read encrypted model: %w", err)
+	}
+	if string(header[:8]) != EncryptedMagic {
+		return nil, 0, errors.New("not an encrypted model")
+	}
+	if v := binary.LittleEndian.Uint32(header[8:]); v != encryptedVersion {
+		return nil, 0, fmt.Errorf("unsupported encrypted model version %d", v)
+	}
+	chunkSize := int64(binary.LittleEndian.Uint32(header[12:]))
+	if chunkSize == 0 || chunkSize > maxEncryptedChunk {
+		return nil, 0, fmt.Errorf("invalid chunk size %d in encrypted model", chunkSize)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// every chunk but the last is full, and the last one holds at least
+	// the authentication tag
+	overhead := int64(gcm.Overhead())
+	data := size - encryptedHeaderSize
+	chunks := data / (chunkSize + overhead)
+	if rest := data % (chunkSize + overhead); rest != 0 {
+		if rest < overhead {
+			return nil, 0, fmt.Errorf("%w: encrypted model is truncated", ErrAuthentication)
+		}
+		chunks++
+	}
+	if chunks == 0 || chunks > int64(^uint32(0)) {
+		return nil, 0, fmt.Errorf("%w: encrypted model is truncated", ErrAuthentication)
+	}
+
+	d := &decryptReader{
+		r:         r,
+		gcm:       gcm,
+		header:    header,
+		chunkSize: chunkSize,
+		chunks:    chunks,
+		size:      size,
+	}
+	return d, data - chunks*overhead, nil
+}
+
+// decryptReader decrypts a model a chunk at a time.
+type decryptReader struct {
+	r         io.ReaderAt
+	gcm       cipher.AEAD
+	header    []byte
+	chunkSize int64
+	chunks    int64
+	size      int64
+
+	index   int64
+	sealed  []byte
+	chunk   []byte
+	pending []byte
+	err     error
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	if len(d.pending) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.index == d.chunks {
+			clear(d.chunk[:cap(d.chunk)])
+			d.err = io.EOF
+			return 0, d.err
+		}
+
+		off := encryptedHeaderSize + d.index*(d.chunkSize+int64(d.gcm.Overhead()))
+		n := min(d.chunkSize+int64(d.gcm.Overhead()), d.size-off)
+		if int64(cap(d.sealed)) < n {
+			d.sealed = make([]byte, n)
+		}
+		sealed := d.sealed[:n]
+		if _, err := d.r.ReadAt(sealed, off); err != nil {
+			d.err = fmt.Errorf("failed to read encrypted model: %w", err)
+			return 0, d.err
+		}
+
+		// decrypt straight into p when the chunk fits
+		plain := int(n) - d.gcm.Overhead()
+		dst := p
+		if len(p) < plain {
+			if d.chunk == nil {
+				d.chunk = make([]byte, 0, d.chunkSize)
+			}
+			dst = d.chunk
+		}
+		last := d.index == d.chunks-1
+		opened, err := d.gcm.Open(dst[:0], chunkNonce(d.header, uint32(d.index)), sealed, chunkAD(d.header, last))
+		if err != nil {
+			clear(dst[:plain])
+			d.err = ErrAuthentication
+			return 0, d.err
+		}
+		d.index++
+		if len(p) >= plain {
+			return len(opened), nil
+		}
+		d.pending = opened
+	}
+
+	n := copy(p, d.pending)
+	clear(d.pending[:n])
+	d.pending = d.pending[n:]
+	return n, nil
+}
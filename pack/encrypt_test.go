@@ -0,0 +1,126 @@
+package pack_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+
+	"github.com/go-skynet/go-llama.cpp/pack"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Encrypted models", func() {
+	key := bytes.Repeat([]byte{0x42}, 32)
+
+	encrypt := func(model []byte) []byte {
+		var buf bytes.Buffer
+		n, err := pack.Encrypt(&buf, bytes.NewReader(model), key)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(BeEquivalentTo(buf.Len()))
+		return buf.Bytes()
+	}
+	decrypt := func(encrypted, key []byte) ([]byte, error) {
+		r, size, err := pack.Decrypt(bytes.NewReader(encrypted), int64(len(encrypted)), key)
+		if err != nil {
+			return nil, err
+		}
+		model, err := io.ReadAll(r)
+		if err == nil {
+			Expect(model).To(HaveLen(int(size)))
+		}
+		return model, err
+	}
+
+	It("round trips models of any size", func() {
+		for _, size := range []int{0, 1, pack.ChunkSize - 1, pack.ChunkSize, 2*pack.ChunkSize + 5} {
+			model := make([]byte, size)
+			rand.New(rand.NewSource(int64(size))).Read(model)
+			encrypted := encrypt(model)
+			Expect(bytes.Contains(encrypted, model[:min(size, 64)])).To(Equal(size == 0))
+
+			decrypted, err := decrypt(encrypted, key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decrypted).To(Equal(model))
+
+			// reading whole chunks at a time decrypts in place
+			r, modelSize, err := pack.Decrypt(bytes.NewReader(encrypted), int64(len(encrypted)), key)
+			Expect(err).ToNot(HaveOccurred())
+			buf := make([]byte, modelSize)
+			_, err = io.ReadFull(r, buf)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(buf).To(Equal(model))
+		}
+	})
+
+	It("fails authentication with the wrong key or when tampered with", func() {
+		model := bytes.Repeat([]byte("weights "), pack.ChunkSize/4)
+		encrypted := encrypt(model)
+
+		_, err := decrypt(encrypted, bytes.Repeat([]byte{0x43}, 32))
+		Expect(err).To(MatchError(pack.ErrAuthentication))
+		_, err = decrypt(encrypted, key[:5])
+		Expect(err).To(MatchError(ContainSubstring("invalid key")))
+
+		tampered := bytes.Clone(encrypted)
+		tampered[len(tampered)/2]++
+		_, err = decrypt(tampered, key)
+		Expect(err).To(MatchError(pack.ErrAuthentication))
+
+		// the nonce in the header is authenticated too
+		tampered = bytes.Clone(encrypted)
+		tampered[20]++
+		_, err = decrypt(tampered, key)
+		Expect(err).To(MatchError(pack.ErrAuthentication))
+
+		// dropping the last chunk leaves one that is not marked last
+		chunk := pack.ChunkSize + 16
+		_, err = decrypt(encrypted[:24+chunk], key)
+		Expect(err).To(MatchError(pack.ErrAuthentication))
+		_, err = decrypt(encrypted[:len(encrypted)-5], key)
+		Expect(err).To(MatchError(pack.ErrAuthentication))
+
+		// swapping full chunks
+		swapped := append(bytes.Clone(encrypted[:24]), encrypted[24+chunk:24+2*chunk]...)
+		swapped = append(swapped, encrypted[24:24+chunk]...)
+		swapped = append(swapped, encrypted[24+2*chunk:]...)
+		_, err = decrypt(swapped, key)
+		Expect(err).To(MatchError(pack.ErrAuthentication))
+	})
+
+	It("packs encrypted models", func() {
+		exe := newExecutable()
+		model := append([]byte("GGUF"), bytes.Repeat([]byte("secret "), 100000)...)
+		entries, err := pack.Append(exe,
+			pack.Model{Name: "plain", Data: bytes.NewReader(model)},
+			pack.Model{Name: "encrypted", Data: bytes.NewReader(model), Key: key},
+			pack.Model{Name: "both", Data: bytes.NewReader(model), Key: key, Compress: true})
+		Expect(err).ToNot(HaveOccurred())
+
+		data, err := io.ReadAll(io.NewSectionReader(exe, 0, 1<<40))
+		Expect(err).ToNot(HaveOccurred())
+		// only the plain model can be read from the executable
+		Expect(bytes.Count(data, []byte("secret secret"))).To(Equal(bytes.Count(model, []byte("secret secret"))))
+
+		read, err := pack.ReadEntries(exe, int64(len(data)))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read).To(Equal(entries))
+		Expect(read[1].Encrypted).To(BeTrue())
+		Expect(read[2].Encrypted).To(BeTrue())
+		Expect(read[2].Compressed).To(BeTrue())
+		Expect(read[2].Size).To(BeNumerically("<", len(model)/10))
+
+		for _, e := range read[1:] {
+			Expect(e.ModelSize).To(BeEquivalentTo(len(model)))
+			Expect(e.Verify(e.Open(exe))).To(MatchError(pack.ErrEncrypted))
+
+			r, err := e.OpenWithKey(exe, key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(e.Verify(r)).To(Succeed())
+
+			r, err = e.OpenWithKey(exe, bytes.Repeat([]byte{1}, 32))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(e.Verify(r)).To(MatchError(pack.ErrAuthentication))
+		}
+	})
+})
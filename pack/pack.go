@@ -0,0 +1,469 @@
+// Package pack appends models to executables, to be loaded back with
+// LoadSelfContainedModel and LoadEmbeddedModel, and reads them. It also
+// encrypts and signs model files. It is pure Go so that packing tools build
+// without cgo.
+//
+// A packed executable is the original binary followed by the models, each
+// preceded by zero padding up to a multiple of Alignment so that it can be
+// mapped from the file, then by a table of contents and a trailer of
+// TrailerSize bytes:
+//
+//	version   uint32, little endian
+//	flags     uint32, reserved
+//	offset    uint64, of the table of contents from the start of the file
+//	size      uint64, of the table of contents
+//	sha256    [32]byte, of the table of contents
+//	magic     [8]byte, "LLAMAPAK"
+//
+// The table of contents is the number of models as a uint32, then for every
+// model the length of its name as a uint16, the name, its flags as a uint32,
+// its offset, size in the file and size once decompressed as uint64, the
+// SHA-256 of the decompressed model and, for signed models, their signature
+// as described in sign.go, all little endian. Compressed models are stored
+// as described in compress.go, encrypted ones as described in encrypt.go,
+// compressed first when both.
+//
+// Version 2 tables of contents have no flags nor decompressed size. Version 1
+// trailers describe a single model in place of the table of contents.
+// Executables packed before the trailer existed end with the model followed
+// by its size as a little endian uint64. Both are still read, as a single
+// model called DefaultName, legacy ones without a checksum.
+package pack
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+const (
+	// Magic ends every packed executable.
+	Magic = "LLAMAPAK"
+	// Version is the version of the trailer written by Append.
+	Version = 3
+	// TrailerSize is the size of the trailer.
+	TrailerSize = 64
+	// Alignment of the models in the file: the allocation granularity of
+	// Windows, a multiple of the page size everywhere else.
+	Alignment = 64 << 10
+	// DefaultName is the name of the model of executables packed with a
+	// single model before names existed.
+	DefaultName = "model"
+	// MaxModels bounds the number of models of an executable.
+	MaxModels = 1024
+
+	// FlagCompressed marks compressed models in the table of contents.
+	FlagCompressed = 1 << 0
+	// FlagEncrypted marks encrypted models in the table of contents.
+	FlagEncrypted = 1 << 1
+	// FlagSigned marks models followed by their signature in the table of
+	// contents.
+	FlagSigned = 1 << 2
+
+	legacyTrailerSize = 8
+	ggufMagic         = "GGUF"
+)
+
+var (
+	// ErrNoModel is returned when no model is appended to the file.
+	ErrNoModel = errors.New("no model is appended to the executable")
+	// ErrChecksum is returned when a model does not match its checksum.
+	ErrChecksum = errors.New("model does not match its checksum")
+)
+
+// Entry locates a model appended to an executable.
+type Entry struct {
+	Name string
+	// Offset and Size of the model in the file, compressed or not
+	Offset int64
+	Size   int64
+	// Size of the model once decompressed
+	ModelSize  int64
+	Compressed bool
+	Encrypted  bool
+	// SHA-256 of the decompressed model
+	SHA256 [32]byte
+	// Signature of the decompressed model, see Sign
+	Signature []byte
+	// Set for executables packed with the legacy size-only trailer, which
+	// have no checksum
+	Legacy bool
+}
+
+// Open returns a reader of the model of the entry in the file r,
+// decompressing it if needed. Reading encrypted models fails with
+// ErrEncrypted, see OpenWithKey.
+func (e Entry) Open(r io.ReaderAt) io.Reader {
+	if e.Encrypted {
+		return errReader{fmt.Errorf("%w: %s", ErrEncrypted, e.Name)}
+	}
+	model, _ := e.OpenWithKey(r, nil)
+	return model
+}
+
+// OpenWithKey is like Open, decrypting encrypted models with key.
+func (e Entry) OpenWithKey(r io.ReaderAt, key []byte) (io.Reader, error) {
+	var model io.Reader = io.NewSectionReader(r, e.Offset, e.Size)
+	if e.Encrypted {
+		var err error
+		if model, _, err = Decrypt(io.NewSectionReader(r, e.Offset, e.Size), e.Size, key); err != nil {
+			return nil, fmt.Errorf("failed to decrypt model %s: %w", e.Name, err)
+		}
+	}
+	if e.Compressed {
+		model = newChunkReader(model, e.ModelSize)
+	}
+	return model, nil
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+// Verify checks the decompressed model read from model, see Open, against
+// the checksum of the entry. Legacy entries have none, they always pass.
+func (e Entry) Verify(model io.Reader) error {
+	if e.Legacy {
+		return nil
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, model)
+	if err != nil {
+		return fmt.Errorf("failed to read model %s: %w", e.Name, err)
+	}
+	if n != e.ModelSize || !bytes.Equal(h.Sum(nil), e.SHA256[:]) {
+		return fmt.Errorf("%w: %s", ErrChecksum, e.Name)
+	}
+	return nil
+}
+
+// Model is a model to append to an executable.
+type Model struct {
+	Name string
+	Data io.Reader
+	// Compress the model, which can then not be mapped from the executable
+	// and is decompressed when loaded
+	Compress bool
+	// Encrypt the model with this AES key of 16, 24 or 32 bytes
+	Key []byte
+	// Signature of the model made with Sign, to be stored with it
+	Signature []byte
+}
+
+// trailer ends a packed executable.
+type trailer struct {
+	version uint32
+	offset  int64
+	size    int64
+	sha256  [32]byte
+	legacy  bool
+}
+
+func (t trailer) marshal() []byte {
+	b := make([]byte, 0, TrailerSize)
+	b = binary.LittleEndian.AppendUint32(b, t.version)
+	b = binary.LittleEndian.AppendUint32(b, 0)
+	b = binary.LittleEndian.AppendUint64(b, uint64(t.offset))
+	b = binary.LittleEndian.AppendUint64(b, uint64(t.size))
+	b = append(b, t.sha256[:]...)
+	return append(b, Magic...)
+}
+
+// readTrailer reads the trailer at the end of the file of the given size,
+// and checks that what it describes lies just before it.
+func readTrailer(r io.ReaderAt, size int64) (trailer, error) {
+	if size < legacyTrailerSize {
+		return trailer{}, ErrNoModel
+	}
+
+	var t trailer
+	buf := make([]byte, min(size, TrailerSize))
+	if _, err := r.ReadAt(buf, size-int64(len(buf))); err != nil {
+		return trailer{}, fmt.Errorf("failed to read the trailer: %w", err)
+	}
+	if len(buf) == TrailerSize && string(buf[TrailerSize-len(Magic):]) == Magic {
+		t.version = binary.LittleEndian.Uint32(buf[0:])
+		if t.version < 1 || t.version > Version {
+			return trailer{}, fmt.Errorf("unsupported trailer version %d", t.version)
+		}
+		offset := binary.LittleEndian.Uint64(buf[8:])
+		contentSize := binary.LittleEndian.Uint64(buf[16:])
+		copy(t.sha256[:], buf[24:56])
+		if contentSize == 0 || offset > uint64(size) || contentSize != uint64(size)-TrailerSize-offset {
+			return trailer{}, fmt.Errorf("invalid trailer: %d bytes at offset %d in a file of %d bytes", contentSize, offset, size)
+		}
+		t.offset, t.size = int64(offset), int64(contentSize)
+	} else {
+		t.legacy = true
+		modelSize := binary.LittleEndian.Uint64(buf[len(buf)-legacyTrailerSize:])
+		if modelSize == 0 || modelSize > uint64(size-legacyTrailerSize) {
+			return trailer{}, ErrNoModel
+		}
+		t.size = int64(modelSize)
+		t.offset = size - legacyTrailerSize - t.size
+	}
+	return t, nil
+}
+
+// ReadEntries reads the models appended to the file of the given size, and
+// checks that they lie within the file, aligned, without overlapping, and
+// start like GGUF files. The models themselves are not verified, see
+// Entry.Verify.
+func ReadEntries(r io.ReaderAt, size int64) ([]Entry, error) {
+	t, err := readTrailer(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	switch {
+	case t.legacy:
+		entries = []Entry{{Name: DefaultName, Offset: t.offset, Size: t.size, ModelSize: t.size, Legacy: true}}
+	case t.version == 1:
+		entries = []Entry{{Name: DefaultName, Offset: t.offset, Size: t.size, ModelSize: t.size, SHA256: t.sha256}}
+	default:
+		toc := make([]byte, t.size)
+		if _, err := r.ReadAt(toc, t.offset); err != nil {
+			return nil, fmt.Errorf("failed to read the table of contents: %w", err)
+		}
+		if sha256.Sum256(toc) != t.sha256 {
+			return nil, fmt.Errorf("%w: table of contents", ErrChecksum)
+		}
+		if entries, err = decodeTOC(toc, t.version); err != nil {
+			return nil, err
+		}
+	}
+
+	// the end of the models, the table of contents or the trailer
+	end := t.offset
+	if t.version == 1 || t.legacy {
+		end += t.size
+	}
+	sorted := append([]Entry(nil), entries...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Offset < sorted[j].Offset })
+	for i, e := range sorted {
+		if !t.legacy && e.Offset%Alignment != 0 {
+			return nil, fmt.Errorf("model %s at offset %d is not aligned to %d", e.Name, e.Offset, Alignment)
+		}
+		if e.Size <= 0 || e.Offset < 0 || e.Offset > end || e.Size > end-e.Offset {
+			return nil, fmt.Errorf("invalid trailer: model %s of %d bytes at offset %d in a file of %d bytes", e.Name, e.Size, e.Offset, size)
+		}
+		if i > 0 && e.Offset < sorted[i-1].Offset+sorted[i-1].Size {
+			return nil, fmt.Errorf("invalid trailer: model %s overlaps model %s", e.Name, sorted[i-1].Name)
+		}
+		if e.Compressed || e.Encrypted {
+			// the checksum of the decompressed model tells
+			continue
+		}
+
+		magic := make([]byte, len(ggufMagic))
+		if _, err := r.ReadAt(magic, e.Offset); err != nil {
+			return nil, fmt.Errorf("failed to read model %s: %w", e.Name, err)
+		}
+		if string(magic) != ggufMagic {
+			if t.legacy {
+				// most likely a binary without a model whose last bytes happen
+				// to look like a size
+				return nil, ErrNoModel
+			}
+			return nil, fmt.Errorf("appended model %s is not a GGUF file", e.Name)
+		}
+	}
+	return entries, nil
+}
+
+func encodeTOC(entries []Entry) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(entries)))
+	for _, e := range entries {
+		var flags uint32
+		if e.Compressed {
+			flags |= FlagCompressed
+		}
+		if e.Encrypted {
+			flags |= FlagEncrypted
+		}
+		if e.Signature != nil {
+			flags |= FlagSigned
+		}
+		b = binary.LittleEndian.AppendUint16(b, uint16(len(e.Name)))
+		b = append(b, e.Name...)
+		b = binary.LittleEndian.AppendUint32(b, flags)
+		b = binary.LittleEndian.AppendUint64(b, uint64(e.Offset))
+		b = binary.LittleEndian.AppendUint64(b, uint64(e.Size))
+		b = binary.LittleEndian.AppendUint64(b, uint64(e.ModelSize))
+		b = append(b, e.SHA256[:]...)
+		b = append(b, e.Signature...)
+	}
+	return b
+}
+
+func decodeTOC(b []byte, version uint32) ([]Entry, error) {
+	invalid := errors.New("invalid table of contents")
+	if len(b) < 4 {
+		return nil, invalid
+	}
+	n := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	// the size of an entry without its name
+	entrySize := 4 + 8 + 8 + 8 + 32
+	if version == 2 {
+		entrySize = 8 + 8 + 32
+	}
+	if n == 0 || n > MaxModels || uint64(n)*uint64(2+entrySize) > uint64(len(b)) {
+		return nil, invalid
+	}
+
+	entries := make([]Entry, n)
+	names := make(map[string]bool, n)
+	for i := range entries {
+		if len(b) < 2 {
+			return nil, invalid
+		}
+		nameLen := int(binary.LittleEndian.Uint16(b))
+		b = b[2:]
+		if len(b) < nameLen+entrySize {
+			return nil, invalid
+		}
+		e := &entries[i]
+		e.Name = string(b[:nameLen])
+		b = b[nameLen:]
+		if names[e.Name] {
+			return nil, fmt.Errorf("duplicate model %s", e.Name)
+		}
+		names[e.Name] = true
+
+		var flags uint32
+		if version >= 3 {
+			flags = binary.LittleEndian.Uint32(b)
+			b = b[4:]
+		}
+		if flags&^(FlagCompressed|FlagEncrypted|FlagSigned) != 0 {
+			return nil, fmt.Errorf("model %s has unknown flags %#x", e.Name, flags)
+		}
+		e.Compressed = flags&FlagCompressed != 0
+		e.Encrypted = flags&FlagEncrypted != 0
+		e.Offset = int64(binary.LittleEndian.Uint64(b))
+		e.Size = int64(binary.LittleEndian.Uint64(b[8:]))
+		b = b[16:]
+		e.ModelSize = e.Size
+		if version >= 3 {
+			e.ModelSize = int64(binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		}
+		if e.ModelSize <= 0 || (!e.Compressed && !e.Encrypted && e.ModelSize != e.Size) {
+			return nil, fmt.Errorf("model %s has an invalid size", e.Name)
+		}
+		copy(e.SHA256[:], b[:32])
+		b = b[32:]
+		if flags&FlagSigned != 0 {
+			if len(b) < ed25519.SignatureSize {
+				return nil, invalid
+			}
+			e.Signature = append([]byte(nil), b[:ed25519.SignatureSize]...)
+			b = b[ed25519.SignatureSize:]
+		}
+	}
+	if len(b) != 0 {
+		return nil, invalid
+	}
+	return entries, nil
+}
+
+// Append appends the models to the executable open for writing in exe,
+// compressing and encrypting those that ask for it, followed by the table of
+// contents and the trailer, and returns their entries. Names must be unique
+// and non-empty. It fails if models are appended already.
+func Append(exe *os.File, models ...Model) ([]Entry, error) {
+	if len(models) == 0 || len(models) > MaxModels {
+		return nil, fmt.Errorf("can not append %d models", len(models))
+	}
+	names := map[string]bool{}
+	for _, m := range models {
+		if m.Name == "" || len(m.Name) > 0xffff {
+			return nil, fmt.Errorf("invalid model name %q", m.Name)
+		}
+		if names[m.Name] {
+			return nil, fmt.Errorf("duplicate model %s", m.Name)
+		}
+		names[m.Name] = true
+		if m.Signature != nil && len(m.Signature) != ed25519.SignatureSize {
+			return nil, fmt.Errorf("signature of model %s is %d bytes, not %d", m.Name, len(m.Signature), ed25519.SignatureSize)
+		}
+	}
+
+	info, err := exe.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ReadEntries(exe, info.Size()); err == nil {
+		return nil, fmt.Errorf("%s has models appended already", exe.Name())
+	}
+
+	off := info.Size()
+	entries := make([]Entry, len(models))
+	for i, m := range models {
+		e := Entry{Name: m.Name, Offset: (off + Alignment - 1) / Alignment * Alignment, Signature: m.Signature}
+		if _, err := exe.WriteAt(make([]byte, e.Offset-off), off); err != nil {
+			return nil, err
+		}
+		if _, err := exe.Seek(e.Offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+
+		h := sha256.New()
+		model := io.TeeReader(m.Data, h)
+		out := &countingWriter{w: exe}
+		var w io.Writer = out
+		var ew *encryptWriter
+		if m.Key != nil {
+			e.Encrypted = true
+			if ew, err = newEncryptWriter(out, m.Key); err != nil {
+				return nil, fmt.Errorf("failed to encrypt model %s: %w", m.Name, err)
+			}
+			w = ew
+		}
+		if m.Compress {
+			e.Compressed = true
+			_, e.ModelSize, err = compress(w, model)
+		} else {
+			e.ModelSize, err = io.Copy(w, model)
+		}
+		if err == nil && ew != nil {
+			err = ew.Close()
+		}
+		e.Size = out.n
+		if err != nil {
+			return nil, fmt.Errorf("failed to append model %s: %w", m.Name, err)
+		}
+		if e.ModelSize == 0 {
+			return nil, fmt.Errorf("model %s is empty", m.Name)
+		}
+		copy(e.SHA256[:], h.Sum(nil))
+		entries[i] = e
+		off = e.Offset + e.Size
+	}
+
+	toc := encodeTOC(entries)
+	t := trailer{version: Version, offset: off, size: int64(len(toc)), sha256: sha256.Sum256(toc)}
+	if _, err := exe.Write(append(toc, t.marshal()...)); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,221 @@
+package pack_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/go-skynet/go-llama.cpp/pack"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// newExecutable creates a fake executable of 12345 bytes.
+func newExecutable() *os.File {
+	exe, err := os.Create(filepath.Join(GinkgoT().TempDir(), "exe"))
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(exe.Close)
+	_, err = exe.Write(bytes.Repeat([]byte{0xcc}, 12345))
+	Expect(err).ToNot(HaveOccurred())
+	return exe
+}
+
+var _ = Describe("Packed executables", func() {
+	var exe *os.File
+	chat := append([]byte("GGUF"), bytes.Repeat([]byte{7}, 1000)...)
+	embed := append([]byte("GGUF"), bytes.Repeat([]byte{8}, pack.Alignment+10)...)
+
+	BeforeEach(func() {
+		exe = newExecutable()
+	})
+
+	size := func() int64 {
+		info, err := exe.Stat()
+		Expect(err).ToNot(HaveOccurred())
+		return info.Size()
+	}
+
+	// writeTrailer appends a trailer for the data at offset, a model for
+	// version 1 and a table of contents for later versions
+	writeTrailer := func(version uint32, offset int64, model []byte) {
+		b := binary.LittleEndian.AppendUint32(nil, version)
+		b = binary.LittleEndian.AppendUint32(b, 0)
+		b = binary.LittleEndian.AppendUint64(b, uint64(offset))
+		b = binary.LittleEndian.AppendUint64(b, uint64(len(model)))
+		sum := sha256.Sum256(model)
+		b = append(b, sum[:]...)
+		_, err := exe.WriteAt(append(b, pack.Magic...), size())
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	It("appends several models aligned, with a table of contents", func() {
+		entries, err := pack.Append(exe,
+			pack.Model{Name: "chat", Data: bytes.NewReader(chat)},
+			pack.Model{Name: "embed", Data: bytes.NewReader(embed)})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(2))
+		Expect(entries[0].Offset).To(BeEquivalentTo(pack.Alignment))
+		Expect(entries[1].Offset).To(BeEquivalentTo(2 * pack.Alignment))
+		for _, e := range entries {
+			Expect(e.Offset % pack.Alignment).To(BeZero())
+		}
+
+		read, err := pack.ReadEntries(exe, size())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read).To(Equal(entries))
+		Expect(read[0].Name).To(Equal("chat"))
+		Expect(read[0].Verify(bytes.NewReader(chat))).To(Succeed())
+		Expect(read[1].Name).To(Equal("embed"))
+		Expect(read[1].Verify(bytes.NewReader(embed))).To(Succeed())
+
+		corrupted := bytes.Clone(chat)
+		corrupted[500]++
+		Expect(read[0].Verify(bytes.NewReader(corrupted))).To(MatchError(pack.ErrChecksum))
+		Expect(read[1].Verify(bytes.NewReader(chat))).To(MatchError(pack.ErrChecksum))
+
+		_, err = pack.Append(exe, pack.Model{Name: "chat", Data: bytes.NewReader(chat)})
+		Expect(err).To(MatchError(ContainSubstring("has models appended already")))
+	})
+
+	It("compresses models in chunks", func() {
+		// a model that compresses, larger than a chunk, and one that does not
+		large := append([]byte("GGUF"), bytes.Repeat([]byte("weights "), pack.ChunkSize/4)...)
+		random := make([]byte, 100000)
+		_, err := rand.New(rand.NewSource(1)).Read(random)
+		Expect(err).ToNot(HaveOccurred())
+
+		entries, err := pack.Append(exe,
+			pack.Model{Name: "large", Data: bytes.NewReader(large), Compress: true},
+			pack.Model{Name: "random", Data: bytes.NewReader(random), Compress: true},
+			pack.Model{Name: "chat", Data: bytes.NewReader(chat)})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries[0].Compressed).To(BeTrue())
+		Expect(entries[0].ModelSize).To(BeEquivalentTo(len(large)))
+		Expect(entries[0].Size).To(BeNumerically("<", len(large)/10))
+		Expect(entries[1].Size).To(BeNumerically(">", len(random)))
+		Expect(entries[2].Compressed).To(BeFalse())
+
+		read, err := pack.ReadEntries(exe, size())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read).To(Equal(entries))
+		for i, model := range [][]byte{large, random, chat} {
+			data, err := io.ReadAll(read[i].Open(exe))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(data).To(Equal(model))
+			Expect(read[i].Verify(read[i].Open(exe))).To(Succeed())
+		}
+
+		// corrupt the second chunk of the large model
+		_, err = exe.WriteAt([]byte{0xff, 0xff, 0xff}, entries[0].Offset+entries[0].Size-10)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read[0].Verify(read[0].Open(exe))).ToNot(Succeed())
+		truncated := read[1]
+		truncated.Size -= 100
+		_, err = io.ReadAll(truncated.Open(exe))
+		Expect(err).To(MatchError(ContainSubstring("truncated")))
+	})
+
+	It("reads version 2 tables of contents", func() {
+		_, err := exe.WriteAt(chat, pack.Alignment)
+		Expect(err).ToNot(HaveOccurred())
+		sum := sha256.Sum256(chat)
+		toc := binary.LittleEndian.AppendUint32(nil, 1)
+		toc = binary.LittleEndian.AppendUint16(toc, 4)
+		toc = append(toc, "chat"...)
+		toc = binary.LittleEndian.AppendUint64(toc, pack.Alignment)
+		toc = binary.LittleEndian.AppendUint64(toc, uint64(len(chat)))
+		toc = append(toc, sum[:]...)
+		_, err = exe.WriteAt(toc, size())
+		Expect(err).ToNot(HaveOccurred())
+		writeTrailer(2, size()-int64(len(toc)), toc)
+
+		entries, err := pack.ReadEntries(exe, size())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Name).To(Equal("chat"))
+		Expect(entries[0].ModelSize).To(BeEquivalentTo(len(chat)))
+		Expect(entries[0].Verify(entries[0].Open(exe))).To(Succeed())
+	})
+
+	It("refuses duplicate or empty names", func() {
+		_, err := pack.Append(exe,
+			pack.Model{Name: "chat", Data: bytes.NewReader(chat)},
+			pack.Model{Name: "chat", Data: bytes.NewReader(embed)})
+		Expect(err).To(MatchError(ContainSubstring("duplicate model chat")))
+		_, err = pack.Append(exe, pack.Model{Data: bytes.NewReader(chat)})
+		Expect(err).To(MatchError(ContainSubstring("invalid model name")))
+		Expect(size()).To(BeEquivalentTo(12345))
+	})
+
+	It("reads version 1 trailers as a single model", func() {
+		_, err := exe.WriteAt(chat, pack.Alignment)
+		Expect(err).ToNot(HaveOccurred())
+		writeTrailer(1, pack.Alignment, chat)
+
+		entries, err := pack.ReadEntries(exe, size())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Name).To(Equal(pack.DefaultName))
+		Expect(entries[0].Offset).To(BeEquivalentTo(pack.Alignment))
+		Expect(entries[0].Verify(bytes.NewReader(chat))).To(Succeed())
+	})
+
+	It("reads legacy trailers", func() {
+		_, err := exe.Write(chat)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(binary.Write(exe, binary.LittleEndian, uint64(len(chat)))).To(Succeed())
+
+		entries, err := pack.ReadEntries(exe, size())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Legacy).To(BeTrue())
+		Expect(entries[0].Offset).To(BeEquivalentTo(12345))
+		Expect(entries[0].Size).To(BeEquivalentTo(len(chat)))
+		Expect(entries[0].Verify(bytes.NewReader(chat))).To(Succeed())
+	})
+
+	It("refuses executables without a model or with a damaged trailer", func() {
+		// the last 8 bytes of a binary without a model may look like a size
+		Expect(binary.Write(exe, binary.LittleEndian, uint64(100))).To(Succeed())
+		_, err := pack.ReadEntries(exe, size())
+		Expect(err).To(MatchError(pack.ErrNoModel))
+
+		_, err = pack.Append(exe, pack.Model{Name: "chat", Data: bytes.NewReader(chat)})
+		Expect(err).ToNot(HaveOccurred())
+		trailer := make([]byte, pack.TrailerSize)
+		_, err = exe.ReadAt(trailer, size()-pack.TrailerSize)
+		Expect(err).ToNot(HaveOccurred())
+
+		damage := func(at int, value uint64, match any) {
+			damaged := bytes.Clone(trailer)
+			binary.LittleEndian.PutUint64(damaged[at:], value)
+			_, err := exe.WriteAt(damaged, size()-pack.TrailerSize)
+			Expect(err).ToNot(HaveOccurred())
+			_, err = pack.ReadEntries(exe, size())
+			Expect(err).To(MatchError(match))
+		}
+		damage(0, 4, ContainSubstring("unsupported trailer version 4"))
+		damage(16, 999, ContainSubstring("invalid trailer"))
+		damage(16, 1<<63, ContainSubstring("invalid trailer"))
+		damage(24, 0, pack.ErrChecksum)
+
+		_, err = exe.WriteAt(trailer, size()-pack.TrailerSize)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = exe.WriteAt([]byte("GGML"), pack.Alignment)
+		Expect(err).ToNot(HaveOccurred())
+		_, err = pack.ReadEntries(exe, size())
+		Expect(err).To(MatchError(ContainSubstring("not a GGUF file")))
+	})
+
+	It("refuses models outside of the file or misaligned", func() {
+		_, err := exe.WriteAt(chat, pack.Alignment)
+		Expect(err).ToNot(HaveOccurred())
+		writeTrailer(1, pack.Alignment+1, chat[1:])
+		_, err = pack.ReadEntries(exe, size())
+		Expect(err).To(MatchError(ContainSubstring("not aligned")))
+	})
+})
@@ -0,0 +1,126 @@
+package pack
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Models are signed with Ed25519ph: the signature is over the SHA-512 of
+// the model, so that signing and verifying stream over it. Signatures and
+// keys are stored in files as a line of standard base64, detached
+// signatures next to the model with SignatureExt appended to its name.
+const (
+	// SignatureExt is appended to the name of a model for its signature.
+	SignatureExt = ".sig"
+
+	signatureContext = "go-llama.cpp model"
+)
+
+// ErrSignatureInvalid is returned when a model has no signature, or one that
+// was not made by any of the trusted keys.
+var ErrSignatureInvalid = errors.New("model signature is invalid")
+
+var signatureOptions = &ed25519.Options{Hash: crypto.SHA512, Context: signatureContext}
+
+// Sign signs the model read from model with key.
+func Sign(key ed25519.PrivateKey, model io.Reader) ([]byte, error) {
+	h := sha512.New()
+	if _, err := io.Copy(h, model); err != nil {
+		return nil, fmt.Errorf("failed to read the model: %w", err)
+	}
+	return key.Sign(nil, h.Sum(nil), signatureOptions)
+}
+
+// VerifySignature checks that sig is a signature of the model read from
+// model by one of keys.
+func VerifySignature(model io.Reader, sig []byte, keys ...ed25519.PublicKey) error {
+	for i, key := range keys {
+		if len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("%w: key %d is %d bytes, not %d", ErrSignatureInvalid, i+1, len(key), ed25519.PublicKeySize)
+		}
+	}
+	if len(sig) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: it is %d bytes, not %d", ErrSignatureInvalid, len(sig), ed25519.SignatureSize)
+	}
+	h := sha512.New()
+	if _, err := io.Copy(h, model); err != nil {
+		return fmt.Errorf("failed to read the model: %w", err)
+	}
+	digest := h.Sum(nil)
+	for _, key := range keys {
+		if ed25519.VerifyWithOptions(key, digest, sig, signatureOptions) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: not signed by a trusted key", ErrSignatureInvalid)
+}
+
+// ReadSignature reads the signature in the file at path.
+func ReadSignature(path string) ([]byte, error) {
+	sig, err := readBase64(path, ed25519.SignatureSize)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s does not exist", ErrSignatureInvalid, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrSignatureInvalid, err)
+	}
+	return sig, nil
+}
+
+// WriteSignature writes sig to the file at path.
+func WriteSignature(path string, sig []byte) error {
+	return writeBase64(path, sig, 0o644)
+}
+
+// ReadPublicKey reads the public key in the file at path.
+func ReadPublicKey(path string) (ed25519.PublicKey, error) {
+	key, err := readBase64(path, ed25519.PublicKeySize)
+	return ed25519.PublicKey(key), err
+}
+
+// WritePublicKey writes key to the file at path.
+func WritePublicKey(path string, key ed25519.PublicKey) error {
+	return writeBase64(path, key, 0o644)
+}
+
+// ReadPrivateKey reads the private key in the file at path, stored as its
+// seed.
+func ReadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	seed, err := readBase64(path, ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// WritePrivateKey writes the seed of key to the file at path, readable by
+// its owner only.
+func WritePrivateKey(path string, key ed25519.PrivateKey) error {
+	return writeBase64(path, key.Seed(), 0o600)
+}
+
+func readBase64(path string, size int) ([]byte, error) {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(text)))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not in base64: %w", path, err)
+	}
+	if len(b) != size {
+		return nil, fmt.Errorf("%s holds %d bytes, not %d", path, len(b), size)
+	}
+	return b, nil
+}
+
+func writeBase64(path string, b []byte, perm os.FileMode) error {
+	return os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(b)+"\n"), perm)
+}
@@ -0,0 +1,97 @@
+package pack_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+
+	"github.com/go-skynet/go-llama.cpp/pack"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Signed models", func() {
+	model := append([]byte("GGUF"), bytes.Repeat([]byte("weights "), 100000)...)
+	var pub, otherPub ed25519.PublicKey
+	var priv ed25519.PrivateKey
+
+	BeforeEach(func() {
+		var err error
+		pub, priv, err = ed25519.GenerateKey(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+		otherPub, _, err = ed25519.GenerateKey(rand.Reader)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	It("verifies signatures by any of the trusted keys", func() {
+		sig, err := pack.Sign(priv, bytes.NewReader(model))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(pack.VerifySignature(bytes.NewReader(model), sig, pub)).To(Succeed())
+		Expect(pack.VerifySignature(bytes.NewReader(model), sig, otherPub, pub)).To(Succeed())
+
+		Expect(pack.VerifySignature(bytes.NewReader(model), sig, otherPub)).To(MatchError(pack.ErrSignatureInvalid))
+		Expect(pack.VerifySignature(bytes.NewReader(model), sig)).To(MatchError(pack.ErrSignatureInvalid))
+		Expect(pack.VerifySignature(bytes.NewReader(model), sig[:10], pub)).To(MatchError(pack.ErrSignatureInvalid))
+		Expect(pack.VerifySignature(bytes.NewReader(model), sig, pub[:16])).To(MatchError(ContainSubstring("key 1 is 16 bytes")))
+		Expect(pack.VerifySignature(bytes.NewReader(model), sig, pub, nil)).To(MatchError(pack.ErrSignatureInvalid))
+		tampered := bytes.Clone(model)
+		tampered[1000]++
+		Expect(pack.VerifySignature(bytes.NewReader(tampered), sig, pub)).To(MatchError(pack.ErrSignatureInvalid))
+
+		// signatures are of the digest of the model, not of the model
+		Expect(ed25519.Verify(pub, model, sig)).To(BeFalse())
+	})
+
+	It("reads and writes signatures and keys", func() {
+		dir := GinkgoT().TempDir()
+		sig, err := pack.Sign(priv, bytes.NewReader(model))
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(pack.WriteSignature(filepath.Join(dir, "model.gguf.sig"), sig)).To(Succeed())
+		Expect(pack.WritePublicKey(filepath.Join(dir, "key.pub"), pub)).To(Succeed())
+		Expect(pack.WritePrivateKey(filepath.Join(dir, "key.key"), priv)).To(Succeed())
+		info, err := os.Stat(filepath.Join(dir, "key.key"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0o600)))
+
+		read, err := pack.ReadSignature(filepath.Join(dir, "model.gguf.sig"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read).To(Equal(sig))
+		readPub, err := pack.ReadPublicKey(filepath.Join(dir, "key.pub"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(readPub).To(Equal(pub))
+		readPriv, err := pack.ReadPrivateKey(filepath.Join(dir, "key.key"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(readPriv).To(Equal(priv))
+
+		_, err = pack.ReadSignature(filepath.Join(dir, "missing.sig"))
+		Expect(err).To(MatchError(pack.ErrSignatureInvalid))
+		_, err = pack.ReadSignature(filepath.Join(dir, "key.pub"))
+		Expect(err).To(MatchError(ContainSubstring("holds 32 bytes, not 64")))
+	})
+
+	It("packs signatures with the models", func() {
+		sig, err := pack.Sign(priv, bytes.NewReader(model))
+		Expect(err).ToNot(HaveOccurred())
+
+		exe := newExecutable()
+		entries, err := pack.Append(exe,
+			pack.Model{Name: "signed", Data: bytes.NewReader(model), Signature: sig},
+			pack.Model{Name: "unsigned", Data: bytes.NewReader(model)})
+		Expect(err).ToNot(HaveOccurred())
+		info, err := exe.Stat()
+		Expect(err).ToNot(HaveOccurred())
+
+		read, err := pack.ReadEntries(exe, info.Size())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(read).To(Equal(entries))
+		Expect(read[0].Signature).To(Equal(sig))
+		Expect(read[1].Signature).To(BeNil())
+		Expect(pack.VerifySignature(read[0].Open(exe), read[0].Signature, pub)).To(Succeed())
+
+		_, err = pack.Append(newExecutable(), pack.Model{Name: "bad", Data: bytes.NewReader(model), Signature: sig[:63]})
+		Expect(err).To(MatchError(ContainSubstring("signature of model bad is 63 bytes")))
+	})
+})
@@ -0,0 +1,208 @@
+package llama
+
+import (
+	"container/list"
+	"sync"
+)
+
+// PrefixCacheStats reports the activity of the in-memory prefix cache enabled
+// with SetPrefixCache.
+type PrefixCacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int
+	Bytes     int64
+	Budget    int64
+}
+
+// prefixCache maps token sequences to the model state saved right after they
+// were evaluated. Sequences are stored in a radix tree so that the cached
+// sequence sharing the longest prefix with a prompt can be found in a single
+// walk, and entries are evicted in LRU order once the saved states exceed the
+// budget.
+type prefixCache struct {
+	mu       sync.Mutex
+	root     prefixNode
+	lru      *list.List
+	budget   int64
+	size     int64
+	minMatch int
+
+	hits, misses, evictions uint64
+}
+
+type prefixNode struct {
+	// edge holds the tokens leading from the parent to this node
+	edge     []int32
+	parent   *prefixNode
+	children map[int32]*prefixNode
+	entry    *prefixEntry
+}
+
+type prefixEntry struct {
+	tokens []int32
+	state  []byte
+	node   *prefixNode
+	elem   *list.Element
+}
+
+// defaultPrefixMinMatch is the number of tokens a prompt must share with a
+// cached sequence for its state to be restored, unless set otherwise with
+// SetPrefixCacheMinMatch. Nearly every prompt starts with BOS, and restoring
+// a whole state is not worth skipping only a few tokens.
+const defaultPrefixMinMatch = 8
+
+func newPrefixCache(budget int64, minMatch int) *prefixCache {
+	if minMatch <= 0 {
+		minMatch = defaultPrefixMinMatch
+	}
+	return &prefixCache{budget: budget, lru: list.New(), minMatch: minMatch}
+}
+
+// lookup finds the cached sequence sharing the longest common prefix with
+// tokens. It returns that entry together with the length of the shared
+// prefix, or nil if no cached sequence shares at least minMatch tokens with
+// tokens.
+func (c *prefixCache) lookup(tokens []int32) (*prefixEntry, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := &c.root
+	matched := 0
+	rest := tokens
+	for len(rest) > 0 {
+		child, ok := n.children[rest[0]]
+		if !ok {
+			break
+		}
+		common := commonPrefix(child.edge, rest)
+		matched += common
+		n = child
+		if common < len(child.edge) {
+			break
+		}
+		rest = rest[common:]
+	}
+
+	if matched < c.minMatch {
+		c.misses++
+		return nil, 0
+	}
+
+	// every sequence below n shares the matched prefix, and pruning
+	// guarantees that there is at least one
+	for n.entry == nil {
+		for _, child := range n.children {
+			n = child
+			break
+		}
+	}
+
+	c.hits++
+	c.lru.MoveToFront(n.entry.elem)
+	return n.entry, matched
+}
+
+// insert stores the state saved after evaluating tokens, replacing any state
+// previously stored for the same sequence.
+func (c *prefixCache) insert(tokens []int32, state []byte) {
+	if len(tokens) == 0 || int64(len(state)) > c.budget {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := &c.root
+	rest := tokens
+	for len(rest) > 0 {
+		child, ok := n.children[rest[0]]
+		if !ok {
+			leaf := &prefixNode{edge: append([]int32(nil), rest...), parent: n}
+			if n.children == nil {
+				n.children = map[int32]*prefixNode{}
+			}
+			n.children[rest[0]] = leaf
+			n = leaf
+			break
+		}
+
+		common := commonPrefix(child.edge, rest)
+		if common < len(child.edge) {
+			// split the edge so that the common part becomes its own node
+			mid := &prefixNode{
+				edge:     child.edge[:common:common],
+				parent:   n,
+				children: map[int32]*prefixNode{child.edge[common]: child},
+			}
+			child.edge = child.edge[common:]
+			child.parent = mid
+			n.children[mid.edge[0]] = mid
+			child = mid
+		}
+		rest = rest[common:]
+		n = child
+	}
+
+	if n.entry != nil {
+		c.remove(n.entry)
+	}
+	e := &prefixEntry{tokens: append([]int32(nil), tokens...), state: state, node: n}
+	e.elem = c.lru.PushFront(e)
+	n.entry = e
+	c.size += int64(len(state))
+
+	for c.size > c.budget {
+		oldest := c.lru.Back().Value.(*prefixEntry)
+		c.remove(oldest)
+		c.evictions++
+	}
+}
+
+// remove drops an entry and prunes the nodes that no longer lead anywhere.
+func (c *prefixCache) remove(e *prefixEntry) {
+	c.lru.Remove(e.elem)
+	c.size -= int64(len(e.state))
+
+	n := e.node
+	n.entry = nil
+	for n != &c.root && n.entry == nil {
+		switch len(n.children) {
+		case 0:
+			delete(n.parent.children, n.edge[0])
+			n = n.parent
+			continue
+		case 1:
+			// merge the node into its only child
+			for _, child := range n.children {
+				child.edge = append(append([]int32(nil), n.edge...), child.edge...)
+				child.parent = n.parent
+				n.parent.children[child.edge[0]] = child
+			}
+		}
+		break
+	}
+}
+
+func (c *prefixCache) stats() PrefixCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return PrefixCacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Entries:   c.lru.Len(),
+		Bytes:     c.size,
+		Budget:    c.budget,
+	}
+}
+
+func commonPrefix(a, b []int32) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,307 @@
+package llama
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-skynet/go-llama.cpp/gguf"
+)
+
+const (
+	promptCacheExt     = ".session"
+	promptCacheLockExt = ".lock"
+
+	// defaultPromptCachePrefix is how many bytes of the prompt pick its
+	// entry unless set with SetPrefixLength, so that prompts sharing a
+	// system prompt share an entry
+	defaultPromptCachePrefix = 1 << 10
+
+	// fingerprintHeaderSize is how much of the model is hashed to tell
+	// models apart when its GGUF header can not be read.
+	fingerprintHeaderSize = 1 << 20
+
+	// Samples of the tensor data hashed along with the header, so that
+	// finetunes sharing a header are told apart
+	fingerprintSamples    = 16
+	fingerprintSampleSize = 64 << 10
+)
+
+// PromptCacheStore manages the session files used as prompt caches in a
+// single directory. File names are derived from the model fingerprint and the
+// prompt prefix, so a session saved by one model is never loaded by another.
+// Writers take an advisory lock on the entry, and the least recently used
+// entries are removed once the directory grows past its budget.
+type PromptCacheStore struct {
+	dir          string
+	budget       int64
+	prefixLength int
+
+	mu sync.Mutex
+}
+
+// NewPromptCacheStore creates a store in dir, creating the directory if
+// needed. Entries are evicted once their total size exceeds budget bytes.
+func NewPromptCacheStore(dir string, budget int64) (*PromptCacheStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create prompt cache directory: %w", err)
+	}
+	return &PromptCacheStore{dir: dir, budget: budget}, nil
+}
+
+// SetPrefixLength sets the part of the prompt used to pick the cache entry
+// to its first n bytes, so that prompts sharing a system prompt share one
+// entry. It is 1024 bytes by default, and when n is 0 or less.
+func (s *PromptCacheStore) SetPrefixLength(n int) {
+	s.prefixLength = n
+}
+
+// Path returns the session file used for prompt by the model with the given
+// fingerprint.
+func (s *PromptCacheStore) Path(fingerprint, prompt string) string {
+	n := s.prefixLength
+	if n <= 0 {
+		n = defaultPromptCachePrefix
+	}
+	if len(prompt) > n {
+		prompt = prompt[:n]
+	}
+
+	h := sha256.New()
+	io.WriteString(h, fingerprint)
+	h.Write([]byte{0})
+	io.WriteString(h, prompt)
+	return filepath.Join(s.dir, hex.EncodeToString(h.Sum(nil))+promptCacheExt)
+}
+
+// acquire locks the entry for prompt, exclusively if it may be written, and
+// returns its path together with a function that releases the lock, marks
+// the entry as recently used and evicts old entries.
+func (s *PromptCacheStore) acquire(fingerprint, prompt string, write bool) (string, func(), error) {
+	path := s.Path(fingerprint, prompt)
+
+	var lock *os.File
+	for {
+		var err error
+		lock, err = os.OpenFile(path+promptCacheLockExt, os.O_CREATE|os.O_RDWR, 0o644)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to open prompt cache lock: %w", err)
+		}
+		if err := lockFile(lock, write); err != nil {
+			lock.Close()
+			return "", nil, fmt.Errorf("failed to lock prompt cache entry: %w", err)
+		}
+		if lockFileCurrent(lock, path+promptCacheLockExt) {
+			break
+		}
+		// evicted while waiting for the lock, lock the new file instead
+		unlockFile(lock)
+		lock.Close()
+	}
+
+	release := func() {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		unlockFile(lock)
+		lock.Close()
+		s.Evict()
+	}
+	return path, release, nil
+}
+
+// Size returns the total size of the entries in the store.
+func (s *PromptCacheStore) Size() (int64, error) {
+	entries, err := s.entries()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, e := range entries {
+		total += e.Size()
+	}
+	return total, nil
+}
+
+// Evict removes the least recently used entries until the store fits in its
+// budget. Entries that are locked by a running prediction, in this or in
+// another process, are skipped.
+func (s *PromptCacheStore) Evict() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries, err := s.entries()
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	for _, e := range entries {
+		total += e.Size()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().Before(entries[j].ModTime())
+	})
+
+	for _, e := range entries {
+		if total <= s.budget {
+			break
+		}
+		if s.remove(filepath.Join(s.dir, e.Name())) {
+			total -= e.Size()
+		}
+	}
+
+	// lock files of entries that were never written
+	locks, _ := filepath.Glob(filepath.Join(s.dir, "*"+promptCacheExt+promptCacheLockExt))
+	for _, lock := range locks {
+		path := strings.TrimSuffix(lock, promptCacheLockExt)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			s.remove(path)
+		}
+	}
+
+	return nil
+}
+
+// remove removes the entry at path along with its lock file, unless it is
+// locked, and reports whether it did. Processes waiting for the lock notice
+// that its file was removed and lock a new one, see lockFileCurrent.
+func (s *PromptCacheStore) remove(path string) bool {
+	lock, err := os.OpenFile(path+promptCacheLockExt, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return false
+	}
+	defer lock.Close()
+	if ok, _ := tryLockFile(lock, true); !ok {
+		return false
+	}
+	defer unlockFile(lock)
+	if !lockFileCurrent(lock, path+promptCacheLockExt) {
+		return false
+	}
+
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false
+	}
+	os.Remove(path + promptCacheLockExt)
+	return true
+}
+
+// lockFileCurrent reports whether lock is still the file at path, and was
+// not removed by Evict while it was being locked.
+func lockFileCurrent(lock *os.File, path string) bool {
+	held, err := lock.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(path)
+	return err == nil && os.SameFile(held, current)
+}
+
+func (s *PromptCacheStore) entries() ([]os.FileInfo, error) {
+	dirEntries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read prompt cache directory: %w", err)
+	}
+
+	var entries []os.FileInfo
+	for _, d := range dirEntries {
+		if d.IsDir() || !strings.HasSuffix(d.Name(), promptCacheExt) {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, info)
+	}
+	return entries, nil
+}
+
+// Fingerprint identifies the model together with the options that change
+// the layout of its saved state. Prompt caches are only shared between
+// models with the same fingerprint.
+func (l *LLama) Fingerprint() string {
+	return l.fingerprint
+}
+
+// modelFingerprint hashes the content fingerprint of the model with the
+// context options.
+func modelFingerprint(content string, mo ModelOptions) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s/%d/%t", content, mo.ContextSize, mo.F16Memory)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// contentFingerprint hashes the size of the model, its GGUF header with the
+// metadata and the tensor table, and samples of its tensor data. It is the
+// same whether or not the SHA-256 of the model is known.
+func contentFingerprint(r io.ReaderAt, size int64) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d/", size)
+
+	header := min(size, fingerprintHeaderSize)
+	if f, err := gguf.Read(r, size); err == nil {
+		header = f.DataOffset
+	}
+	io.Copy(h, io.NewSectionReader(r, 0, header))
+	// spread over the data, the last sample ending with the file
+	if data := size - header; data > fingerprintSamples*fingerprintSampleSize {
+		for i := int64(0); i < fingerprintSamples; i++ {
+			off := header + i*(data-fingerprintSampleSize)/(fingerprintSamples-1)
+			io.Copy(h, io.NewSectionReader(r, off, fingerprintSampleSize))
+		}
+	} else {
+		io.Copy(h, io.NewSectionReader(r, header, data))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fileFingerprints caches the content fingerprint of the model files loaded
+// by the process, so that loading a model again does not read it again.
+var fileFingerprints sync.Map
+
+type fileFingerprintKey struct {
+	path  string
+	size  int64
+	mtime int64
+}
+
+// fileFingerprint returns the fingerprint of the model file at path.
+func fileFingerprint(path string, mo ModelOptions) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return ""
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	key := fileFingerprintKey{abs, info.Size(), info.ModTime().UnixNano()}
+	content, ok := fileFingerprints.Load(key)
+	if !ok {
+		content, _ = fileFingerprints.LoadOrStore(key, contentFingerprint(f, info.Size()))
+	}
+	return modelFingerprint(content.(string), mo)
+}
+
+func memoryFingerprint(data []byte, mo ModelOptions) string {
+	return modelFingerprint(contentFingerprint(bytes.NewReader(data), int64(len(data))), mo)
+}
@@ -0,0 +1,133 @@
+package llama
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ReloadableModel serves a model that can be replaced while it is in use,
+// for example after its file was swapped for a new quantization. Requests
+// started before a reload finish on the model they started with, which is
+// freed once the last of them releases it.
+type ReloadableModel struct {
+	opts []ModelOption
+
+	// serializes reloads
+	reloadMu sync.Mutex
+
+	mu      sync.RWMutex
+	path    string
+	current *reloadableInstance
+	closed  bool
+	// models replaced by a reload and not freed yet
+	retiring sync.WaitGroup
+}
+
+type reloadableInstance struct {
+	model *LLama
+	users sync.WaitGroup
+}
+
+// NewReloadable loads the model at path, to be reloaded later with the same
+// options.
+func NewReloadable(path string, opts ...ModelOption) (*ReloadableModel, error) {
+	model, err := New(path, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &ReloadableModel{opts: opts, path: path, current: &reloadableInstance{model: model}}, nil
+}
+
+// Acquire returns the model currently served. It is not freed by a reload
+// until release is called.
+func (r *ReloadableModel) Acquire() (model *LLama, release func(), err error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		return nil, nil, ErrClosed
+	}
+	inst := r.current
+	inst.users.Add(1)
+
+	var once sync.Once
+	return inst.model, func() { once.Do(inst.users.Done) }, nil
+}
+
+// Predict runs Predict on the model currently served.
+func (r *ReloadableModel) Predict(text string, opts ...PredictOption) (string, error) {
+	model, release, err := r.Acquire()
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	return model.Predict(text, opts...)
+}
+
+// Reload loads the model file again and switches new requests over to it.
+// While it loads, the previous model keeps serving requests, and keeps doing
+// so if loading fails. Reload returns once the new model is served, the
+// previous one is freed in the background when its last request ends.
+func (r *ReloadableModel) Reload(ctx context.Context) error {
+	r.mu.RLock()
+	path := r.path
+	r.mu.RUnlock()
+
+	return r.ReloadFrom(ctx, path)
+}
+
+// ReloadFrom is like Reload, but loads the model at path, which is then used
+// by later reloads.
+func (r *ReloadableModel) ReloadFrom(ctx context.Context, path string) error {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	model, err := NewWithContext(ctx, path, r.opts...)
+	if err != nil {
+		return fmt.Errorf("failed to reload model, keeping the previous one: %w", err)
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		model.Free()
+		return ErrClosed
+	}
+	old := r.current
+	r.current = &reloadableInstance{model: model}
+	r.path = path
+	r.retiring.Add(1)
+	r.mu.Unlock()
+
+	go r.retire(old)
+	return nil
+}
+
+// retire frees inst once its requests are over.
+func (r *ReloadableModel) retire(inst *reloadableInstance) {
+	defer r.retiring.Done()
+
+	inst.users.Wait()
+	inst.model.Free()
+}
+
+// Close stops serving the model and frees every instance once the requests
+// using them end.
+func (r *ReloadableModel) Close() {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	r.retiring.Add(1)
+	r.mu.Unlock()
+
+	r.retire(r.current)
+	r.retiring.Wait()
+}
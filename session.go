@@ -0,0 +1,186 @@
+package llama
+
+// #include "binding.h"
+// #include <stdlib.h>
+// #include <string.h>
+import "C"
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// Session is an evaluation context on top of a loaded model. Unlike Predict,
+// which starts from an empty context on every call, a session remembers the
+// tokens it has evaluated so far, and every Eval or Predict continues from
+// there. Sessions created from the same model share its weights but have
+// their own KV cache, so they can be used concurrently.
+type Session struct {
+	state unsafe.Pointer
+	model *LLama
+	mu    sync.Mutex
+}
+
+// NewSession creates an empty session on the model, using the context
+// options the model was loaded with. Closing the model frees its sessions.
+func (l *LLama) NewSession() (*Session, error) {
+	done, err := l.use()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	mo := l.options
+	result := C.llama_binding_new_session(l.state,
+		C.int(mo.ContextSize), C.int(mo.Seed),
+		C.bool(mo.F16Memory), C.bool(mo.Embeddings), C.int(mo.NBatch),
+		C.float(mo.FreqRopeBase), C.float(mo.FreqRopeScale),
+		C.bool(mo.Perplexity),
+	)
+	if result == nil {
+		return nil, fmt.Errorf("failed creating session")
+	}
+
+	s := &Session{state: result, model: l}
+	l.addSession(s)
+	return s, nil
+}
+
+// Fork clones the evaluated state of the session, KV cache included, into a
+// new independent session. Both sessions can then be continued and sampled
+// separately without re-evaluating the shared prefix, and freeing one of them
+// does not affect the other.
+func (s *Session) Fork() (*Session, error) {
+	done, err := s.use()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	result := C.llama_binding_fork_session(s.state)
+	if result == nil {
+		return nil, fmt.Errorf("failed forking session")
+	}
+
+	fork := &Session{state: result, model: s.model}
+	s.model.addSession(fork)
+	return fork, nil
+}
+
+// use locks the session for a call, which the model waits for before it is
+// closed. It fails with ErrClosed once the session or its model is freed.
+func (s *Session) use() (done func(), err error) {
+	modelDone, err := s.model.use()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	if s.state == nil {
+		s.mu.Unlock()
+		modelDone()
+		return nil, ErrClosed
+	}
+	return func() {
+		s.mu.Unlock()
+		modelDone()
+	}, nil
+}
+
+// Free releases the context of the session. The model it was created from
+// stays loaded. Freeing a session more than once has no effect.
+func (s *Session) Free() {
+	s.model.removeSession(s)
+	s.free()
+}
+
+func (s *Session) free() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state != nil {
+		C.llama_binding_free_session(s.state)
+		s.state = nil
+	}
+}
+
+// NPast returns the number of tokens evaluated in the session, 0 once it is
+// freed.
+func (s *Session) NPast() int {
+	done, err := s.use()
+	if err != nil {
+		return 0
+	}
+	defer done()
+
+	return int(C.llama_session_n_past(s.state))
+}
+
+// Eval appends text to the session without sampling anything.
+func (s *Session) Eval(text string, opts ...PredictOption) error {
+	done, err := s.use()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	po := NewPredictOptions(opts...)
+
+	params, free := allocatePredictParams(text, po)
+	defer free()
+
+	ret := C.llama_session_eval(params, s.state)
+	if ret != 0 {
+		return fmt.Errorf("inference failed")
+	}
+
+	return nil
+}
+
+// Predict appends text to the session and then samples a continuation. The
+// sampled tokens become part of the session as well.
+func (s *Session) Predict(text string, opts ...PredictOption) (string, error) {
+	done, err := s.use()
+	if err != nil {
+		return "", err
+	}
+	defer done()
+
+	po := NewPredictOptions(opts...)
+
+	if po.TokenCallback != nil {
+		setCallback(s.state, po.TokenCallback)
+		defer setCallback(s.state, nil)
+	}
+
+	if po.Tokens == 0 {
+		po.Tokens = 99999999
+	}
+
+	// Allocate C memory for output to avoid Go GC issues
+	outSize := C.size_t(po.Tokens)
+	outPtr := C.malloc(outSize)
+	if outPtr == nil {
+		return "", fmt.Errorf("failed to allocate memory for output")
+	}
+	defer C.free(outPtr)
+	C.memset(outPtr, 0, outSize)
+
+	params, free := allocatePredictParams(text, po)
+	defer free()
+
+	ret := C.llama_session_predict(params, s.state, (*C.char)(outPtr), outSize, C.bool(po.DebugMode))
+	if ret != 0 {
+		return "", fmt.Errorf("inference failed")
+	}
+	res := C.GoString((*C.char)(outPtr))
+
+	for _, stop := range po.StopPrompts {
+		res = strings.TrimSuffix(res, stop)
+	}
+
+	runtime.KeepAlive(s.model)
+
+	return res, nil
+}
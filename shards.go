@@ -0,0 +1,313 @@
+package llama
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/go-skynet/go-llama.cpp/gguf"
+)
+
+// shardPattern matches the names written by gguf-split, such as
+// model-00001-of-00004.gguf.
+var shardPattern = regexp.MustCompile(`^(.*)-(\d{5})-of-(\d{5})\.gguf$`)
+
+// shardNames returns the names of every shard of the model name belongs to,
+// or nil if name does not follow the shard naming.
+func shardNames(name string) []string {
+	m := shardPattern.FindStringSubmatch(name)
+	if m == nil {
+		return nil
+	}
+	count, _ := strconv.Atoi(m[3])
+	if count < 2 {
+		return nil
+	}
+
+	names := make([]string, count)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s-%05d-of-%05d.gguf", m[1], i+1, count)
+	}
+	return names
+}
+
+// NewFromShards loads a model split into several GGUF files, given in order.
+// The shards are checked against their split metadata and handed to llama.cpp
+// as a single model. New calls it when given one shard of a model whose files
+// follow the model-00001-of-00004.gguf naming.
+func NewFromShards(paths []string, opts ...ModelOption) (*LLama, error) {
+	shards := make([]io.ReaderAt, len(paths))
+	sizes := make([]int64, len(paths))
+	for i, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open shard: %w", err)
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat shard: %w", err)
+		}
+		shards[i], sizes[i] = f, info.Size()
+	}
+
+	mo := NewModelOptions(opts...)
+	model, err := mergeShards(shards, sizes)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkShardSignatures(mo, paths, shards, sizes); err != nil {
+		return nil, err
+	}
+	checks, err := startShardChecksums(mo, paths)
+	if err != nil {
+		return nil, err
+	}
+	return newFromReaderAt(model, model.size, mo, checks)
+}
+
+// NewFromMemoryShards loads a model split into several GGUF buffers, given in
+// order. Unlike NewFromMemory the tensor data is copied out of the buffers,
+// so they can be released once the model is loaded.
+func NewFromMemoryShards(parts [][]byte, opts ...ModelOption) (*LLama, error) {
+	shards := make([]io.ReaderAt, len(parts))
+	sizes := make([]int64, len(parts))
+	for i, part := range parts {
+		shards[i], sizes[i] = bytes.NewReader(part), int64(len(part))
+	}
+
+	return newFromShards(shards, sizes, opts...)
+}
+
+// newFromFSShards opens the shards named names in fsys.
+func newFromFSShards(fsys fs.FS, names []string, opts ...ModelOption) (*LLama, error) {
+	shards := make([]io.ReaderAt, len(names))
+	sizes := make([]int64, len(names))
+	for i, name := range names {
+		f, err := fsys.Open(name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open shard: %w", err)
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat shard: %w", err)
+		}
+		r, err := readerAt(f)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %w", name, err)
+		}
+		shards[i], sizes[i] = r, info.Size()
+	}
+
+	return newFromShards(shards, sizes, opts...)
+}
+
+// newFromShards loads shards that are not files, which have no SHA-256 or
+// signature next to them to verify.
+func newFromShards(shards []io.ReaderAt, sizes []int64, opts ...ModelOption) (*LLama, error) {
+	mo := NewModelOptions(opts...)
+	if mo.ExpectedSHA256 != "" {
+		return nil, errShardChecksum
+	}
+	if mo.VerifySHA256File {
+		return nil, errNoChecksumFile
+	}
+	if len(mo.SignatureKeys) > 0 {
+		return nil, errShardSignature
+	}
+
+	model, err := mergeShards(shards, sizes)
+	if err != nil {
+		return nil, err
+	}
+	return newFromReaderAt(model, model.size, mo, nil)
+}
+
+const (
+	splitNoKey           = "split.no"
+	splitCountKey        = "split.count"
+	splitTensorsCountKey = "split.tensors.count"
+)
+
+// splitInfo returns the split metadata of a shard, -1 for keys it lacks.
+func splitInfo(f *gguf.File) (no, count, tensors int64) {
+	no, count, tensors = -1, -1, -1
+	if v, ok := f.Int(splitNoKey); ok {
+		no = v
+	}
+	if v, ok := f.Int(splitCountKey); ok {
+		count = v
+	}
+	if v, ok := f.Int(splitTensorsCountKey); ok {
+		tensors = v
+	}
+	return no, count, tensors
+}
+
+func alignOffset(off, alignment int64) int64 {
+	return (off + alignment - 1) / alignment * alignment
+}
+
+// shardedModel is a read-only view of several shards as a single GGUF file:
+// a merged header followed by the data section of every shard, each aligned
+// so that tensor offsets only need to be shifted.
+type shardedModel struct {
+	header []byte
+	parts  []shardPart
+	size   int64
+}
+
+type shardPart struct {
+	r io.ReaderAt
+	// offset of the part in the merged file, of its data in the shard
+	off, src int64
+	size     int64
+}
+
+func mergeShards(shards []io.ReaderAt, sizes []int64) (*shardedModel, error) {
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("no shards given")
+	}
+
+	headers := make([]*gguf.File, len(shards))
+	for i := range shards {
+		h, err := gguf.Read(shards[i], sizes[i])
+		if err != nil {
+			return nil, fmt.Errorf("shard %d: %w", i+1, err)
+		}
+		headers[i] = h
+	}
+
+	// check that the shards belong together
+	first := headers[0]
+	_, _, firstTensors := splitInfo(first)
+	nTensors := int64(0)
+	for i, h := range headers {
+		nTensors += int64(len(h.Tensors))
+		no, count, tensors := splitInfo(h)
+		if len(headers) == 1 && count <= 1 {
+			break
+		}
+		if count != int64(len(headers)) {
+			return nil, fmt.Errorf("shard %d: %s is %d, but %d shards were given", i+1, splitCountKey, count, len(headers))
+		}
+		if no != int64(i) {
+			return nil, fmt.Errorf("shard %d: %s is %d, shards must be given in order", i+1, splitNoKey, no)
+		}
+		if tensors != firstTensors {
+			return nil, fmt.Errorf("shard %d: %s does not match the first shard", i+1, splitTensorsCountKey)
+		}
+		if h.Alignment != first.Alignment {
+			return nil, fmt.Errorf("shard %d: alignment does not match the first shard", i+1)
+		}
+		if h.ByteOrder != first.ByteOrder {
+			return nil, fmt.Errorf("shard %d: byte order does not match the first shard", i+1)
+		}
+	}
+	if firstTensors >= 0 && firstTensors != nTensors {
+		return nil, fmt.Errorf("shards hold %d tensors, %s is %d", nTensors, splitTensorsCountKey, firstTensors)
+	}
+
+	m := &shardedModel{}
+	var tensors []gguf.TensorInfo
+	seen := map[string]bool{}
+	base := int64(0)
+	for i, h := range headers {
+		for _, t := range h.Tensors {
+			if seen[t.Name] {
+				return nil, fmt.Errorf("shard %d: duplicate tensor %s", i+1, t.Name)
+			}
+			seen[t.Name] = true
+			t.Offset += uint64(base)
+			tensors = append(tensors, t)
+		}
+
+		size := sizes[i] - h.DataOffset
+		m.parts = append(m.parts, shardPart{r: shards[i], off: base, src: h.DataOffset, size: size})
+		base = alignOffset(base+size, first.Alignment)
+	}
+
+	header, err := mergedHeader(first, tensors)
+	if err != nil {
+		return nil, err
+	}
+	m.header = header
+	for i := range m.parts {
+		m.parts[i].off += int64(len(m.header))
+	}
+	m.size = int64(len(m.header)) + base
+	return m, nil
+}
+
+// mergedHeader encodes the metadata of first without its split keys,
+// followed by tensors, padded to the start of the data section.
+func mergedHeader(first *gguf.File, tensors []gguf.TensorInfo) ([]byte, error) {
+	merged := &gguf.File{Version: first.Version, ByteOrder: first.ByteOrder, Tensors: tensors}
+	for _, kv := range first.KV {
+		switch kv.Key {
+		case splitNoKey, splitCountKey, splitTensorsCountKey:
+			continue
+		}
+		if err := merged.Set(kv.Key, kv.Type, kv.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := gguf.NewWriter(&buf, merged); err != nil {
+		return nil, fmt.Errorf("failed to merge the shard headers: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// ReadAt reads the merged file, padding between shards reads as zeros.
+func (m *shardedModel) ReadAt(p []byte, off int64) (int, error) {
+	if off >= m.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for len(p) > 0 && off < m.size {
+		var chunk int
+		switch i := sort.Search(len(m.parts), func(i int) bool { return m.parts[i].off > off }) - 1; {
+		case off < int64(len(m.header)):
+			chunk = copy(p, m.header[off:])
+		case off < m.parts[i].off+m.parts[i].size:
+			part := m.parts[i]
+			want := min(int64(len(p)), part.off+part.size-off)
+			read, err := part.r.ReadAt(p[:want], part.src+off-part.off)
+			if read < int(want) {
+				if err == nil || errors.Is(err, io.EOF) {
+					err = io.ErrUnexpectedEOF
+				}
+				return n + read, err
+			}
+			chunk = read
+		default:
+			// alignment padding up to the next part or the end
+			next := m.size
+			if i+1 < len(m.parts) {
+				next = m.parts[i+1].off
+			}
+			chunk = int(min(int64(len(p)), next-off))
+			clear(p[:chunk])
+		}
+		p = p[chunk:]
+		off += int64(chunk)
+		n += chunk
+	}
+
+	if len(p) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
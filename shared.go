@@ -0,0 +1,191 @@
+package llama
+
+// #include "binding.h"
+// #include <stdlib.h>
+import "C"
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+)
+
+// SharedModel is a model file copied into shared memory, so that processes on
+// the same host attaching to it with NewFromSharedFile or NewFromShared map
+// the same physical pages for the weights instead of each loading a private
+// copy.
+type SharedModel struct {
+	file *os.File
+	size int64
+	// file published under a name, removed by Close
+	path string
+}
+
+// PublishModel copies the model at path into an anonymous shared memory file
+// (a memfd on Linux). Child processes attach to it by inheriting File, for
+// example through exec.Cmd.ExtraFiles. Where memfd is not supported, the
+// model is published like PublishModelNamed with a generated name.
+func PublishModel(path string) (*SharedModel, error) {
+	name := C.CString("llama:" + filepath.Base(path))
+	defer C.free(unsafe.Pointer(name))
+
+	fd, err := C.llama_binding_memfd_create(name)
+	if fd < 0 {
+		if err != nil && os.Getenv("LLAMA_DEBUG") != "" {
+			fmt.Printf("PublishModel: memfd_create failed (%v), using a shared memory file\n", err)
+		}
+		return publishModelFile(path, "")
+	}
+	s := &SharedModel{file: os.NewFile(uintptr(fd), "memfd:"+filepath.Base(path))}
+	if err := s.copyFrom(path); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// PublishModelNamed copies the model at path into a shared memory file
+// called name, in /dev/shm where available. Any process on the host can
+// attach to it with NewFromShared(name) until Close removes it. An existing
+// model published under the same name is replaced, processes attached to it
+// keep using the previous copy.
+func PublishModelNamed(path, name string) (*SharedModel, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return nil, fmt.Errorf("invalid shared model name %q", name)
+	}
+	return publishModelFile(path, name)
+}
+
+func publishModelFile(path, name string) (*SharedModel, error) {
+	pattern := "llama-" + filepath.Base(path) + "-*"
+	if name != "" {
+		pattern = "." + name + "-*"
+	}
+	f, err := os.CreateTemp(sharedMemoryDir(), pattern)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create shared model: %w", err)
+	}
+	s := &SharedModel{file: f, path: f.Name()}
+	if err := s.copyFrom(path); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if name != "" {
+		// rename only once complete, so that nobody attaches to a partial copy
+		target := filepath.Join(sharedMemoryDir(), name)
+		if err := os.Rename(s.path, target); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("failed to publish shared model: %w", err)
+		}
+		s.path = target
+	}
+	return s, nil
+}
+
+// createMemoryFile creates an anonymous file in memory: a memfd where
+// supported, otherwise a file in sharedMemoryDir removed once closed.
+func createMemoryFile(name string) (f *os.File, remove func(), err error) {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+
+	if fd, _ := C.llama_binding_memfd_create(cname); fd >= 0 {
+		return os.NewFile(uintptr(fd), "memfd:"+name), func() {}, nil
+	}
+	f, err = os.CreateTemp(sharedMemoryDir(), "llama-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() { os.Remove(f.Name()) }, nil
+}
+
+func (s *SharedModel) copyFrom(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open model: %w", err)
+	}
+	defer src.Close()
+
+	n, err := io.Copy(s.file, src)
+	if err != nil {
+		return fmt.Errorf("failed to copy model to shared memory: %w", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("model data is empty")
+	}
+	s.size = n
+	return nil
+}
+
+// File is the shared memory file holding the model, to be passed on to the
+// processes attaching to it.
+func (s *SharedModel) File() *os.File {
+	return s.file
+}
+
+// Path is the path of the shared memory file, empty for an anonymous one.
+func (s *SharedModel) Path() string {
+	return s.path
+}
+
+// Size is the size of the model in bytes.
+func (s *SharedModel) Size() int64 {
+	return s.size
+}
+
+// Load attaches the current process to the shared model.
+func (s *SharedModel) Load(opts ...ModelOption) (*LLama, error) {
+	return NewFromSharedFile(s.file, opts...)
+}
+
+// Close closes the shared memory file and removes it if it was published
+// under a name. Models attached to it keep their mapping, the memory is
+// freed once the last of them is closed.
+func (s *SharedModel) Close() error {
+	err := s.file.Close()
+	if s.path != "" {
+		if rerr := os.Remove(s.path); rerr != nil && !os.IsNotExist(rerr) && err == nil {
+			err = rerr
+		}
+		s.path = ""
+	}
+	return err
+}
+
+// NewFromShared attaches to the model published by PublishModelNamed as name.
+func NewFromShared(name string, opts ...ModelOption) (*LLama, error) {
+	f, err := os.Open(filepath.Join(sharedMemoryDir(), name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open shared model: %w", err)
+	}
+	defer f.Close()
+
+	return NewFromSharedFile(f, opts...)
+}
+
+// NewFromSharedFile maps the model in f read-only and loads it without
+// copying the weights, see SharedModel. f can be closed once the model is
+// loaded.
+func NewFromSharedFile(f *os.File, opts ...ModelOption) (*LLama, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat shared model: %w", err)
+	}
+	if info.Size() == 0 {
+		return nil, fmt.Errorf("shared model is empty")
+	}
+
+	addr, data, err := mmapModel(int(f.Fd()), 0, int(info.Size()))
+	if err != nil {
+		return nil, err
+	}
+	ll, err := NewFromMMap(addr, len(data), opts...)
+	if err != nil {
+		unmapModel(data)
+		return nil, err
+	}
+	// The model owns the mapping and releases it when closed
+	ll.unmap = func() error { return unmapModel(data) }
+	return ll, nil
+}
@@ -0,0 +1,86 @@
+package llama
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-skynet/go-llama.cpp/pack"
+)
+
+// ErrSignatureInvalid is returned when a model required to be signed with
+// SetRequireSignature has no signature by one of the trusted keys.
+var ErrSignatureInvalid = pack.ErrSignatureInvalid
+
+var errShardSignature = fmt.Errorf("%w: a model split in shards is signed shard by shard, in the files next to them", ErrSignatureInvalid)
+
+// checkSignature verifies the model read from model when mo requires a
+// signature, against the one set with SetSignature or else the one in the
+// file at sigPath, if any.
+func checkSignature(mo ModelOptions, model io.Reader, sigPath string) error {
+	if len(mo.SignatureKeys) == 0 {
+		return nil
+	}
+	sig := mo.Signature
+	if sig == nil {
+		if sigPath == "" {
+			return fmt.Errorf("%w: the model has no signature, see SetSignature", ErrSignatureInvalid)
+		}
+		var err error
+		if sig, err = pack.ReadSignature(sigPath); err != nil {
+			return err
+		}
+	}
+	return pack.VerifySignature(loadReader(mo, model), sig, mo.SignatureKeys...)
+}
+
+// checkFileSignature verifies the size bytes of the model file at path, read
+// from f which is then loaded, against the signature next to it.
+func checkFileSignature(mo ModelOptions, f io.ReaderAt, size int64, path string) error {
+	return checkSignature(mo, bufio.NewReaderSize(io.NewSectionReader(f, 0, size), 1<<20), path+pack.SignatureExt)
+}
+
+// checkShardSignatures verifies every shard of a model, opened from paths,
+// against the signature next to it, when mo requires a signature. Each shard
+// is signed on its own, so a single signature set with SetSignature does not
+// apply.
+func checkShardSignatures(mo ModelOptions, paths []string, shards []io.ReaderAt, sizes []int64) error {
+	if len(mo.SignatureKeys) == 0 {
+		return nil
+	}
+	if mo.Signature != nil {
+		return errShardSignature
+	}
+	for i, path := range paths {
+		if err := checkFileSignature(mo, shards[i], sizes[i], path); err != nil {
+			return fmt.Errorf("shard %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// newFromSignedFile loads the model file at path from the descriptor its
+// signature is checked over, so that the file can not be replaced between
+// the check and the load. llama.cpp then reads the model rather than
+// mapping it.
+func newFromSignedFile(path string, mo ModelOptions) (*LLama, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading model from %s - %w", path, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed loading model from %s - %w", path, err)
+	}
+	if err := checkFileSignature(mo, f, info.Size(), path); err != nil {
+		return nil, fmt.Errorf("failed loading model from %s - %w", path, err)
+	}
+	check, err := startFileChecksum(mo, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading model from %s - %w", path, err)
+	}
+	return newFromReaderAt(f, info.Size(), mo, checksumChecks{check})
+}
@@ -0,0 +1,539 @@
+package llama
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// workerFlag is the argument NewWorker runs the program with, which
+// RunWorker looks for.
+const workerFlag = "-llama-worker"
+
+// ErrWorkerCrashed is returned by the calls running in a worker process when
+// it dies. The next call starts a new worker.
+var ErrWorkerCrashed = errors.New("inference worker crashed")
+
+// Time to wait before restarting a crashed worker, doubled on every crash of
+// a worker that did not live longer than workerMaxBackoff.
+const (
+	workerMinBackoff = 100 * time.Millisecond
+	workerMaxBackoff = 30 * time.Second
+)
+
+// workerRequest and workerResponse are exchanged as JSON lines, over pipes
+// of their own since llama.cpp writes to stdout.
+type workerRequest struct {
+	ID      uint64
+	Method  string
+	Text    string          `json:",omitempty"`
+	Path    string          `json:",omitempty"`
+	Model   *ModelOptions   `json:",omitempty"`
+	Predict *PredictOptions `json:",omitempty"`
+	// stream the generated tokens before the response, each of them waits
+	// for a "next" request telling whether to continue
+	Stream   bool `json:",omitempty"`
+	Continue bool `json:",omitempty"`
+}
+
+type workerResponse struct {
+	ID uint64
+	// set on the last response to a request, the others carry a token
+	Done       bool      `json:",omitempty"`
+	Token      string    `json:",omitempty"`
+	Text       string    `json:",omitempty"`
+	Embeddings []float32 `json:",omitempty"`
+	Count      int32     `json:",omitempty"`
+	Tokens     []int32   `json:",omitempty"`
+	Error      string    `json:",omitempty"`
+}
+
+// Worker hosts a model in a child process, so that an assertion or a crash
+// in llama.cpp kills the worker instead of the whole program. The child is
+// the program itself, run again with a flag that RunWorker looks for, so
+// programs using workers must call RunWorker at the start of main. Worker
+// processes are not supported on Windows.
+type Worker struct {
+	path string
+	opts ModelOptions
+
+	// held while a worker is started, so that only one is
+	startMu sync.Mutex
+	mu      sync.Mutex
+	proc    *workerProcess
+	backoff time.Duration
+	closed  bool
+	// closed by Close, ends the wait before restarting a worker
+	closing chan struct{}
+}
+
+// errWorkerOption is returned for options holding functions or values that
+// can not be sent to a worker process.
+var errWorkerOption = errors.New("option is not supported by workers")
+
+// NewWorker starts a worker process and loads the model in it. SetLoadProgress
+// and SetModelKey are not supported.
+func NewWorker(model string, opts ...ModelOption) (*Worker, error) {
+	mo := NewModelOptions(opts...)
+	if mo.LoadProgress != nil {
+		return nil, fmt.Errorf("%w: SetLoadProgress", errWorkerOption)
+	}
+	if mo.ModelKey != nil {
+		return nil, fmt.Errorf("%w: SetModelKey", errWorkerOption)
+	}
+
+	w := &Worker{path: model, opts: mo, closing: make(chan struct{})}
+	if _, err := w.process(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// process returns the running worker process, starting a new one if the
+// previous one died.
+func (w *Worker) process() (*workerProcess, error) {
+	w.startMu.Lock()
+	defer w.startMu.Unlock()
+
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil, ErrClosed
+	}
+	var wait time.Duration
+	if w.proc != nil {
+		if !w.proc.exited() {
+			proc := w.proc
+			w.mu.Unlock()
+			return proc, nil
+		}
+		if w.proc.exitedAt.Sub(w.proc.startedAt) > workerMaxBackoff {
+			w.backoff = workerMinBackoff
+		} else {
+			w.backoff = min(max(2*w.backoff, workerMinBackoff), workerMaxBackoff)
+		}
+		wait = time.Until(w.proc.exitedAt.Add(w.backoff))
+	}
+	w.mu.Unlock()
+
+	// Close and Process do not wait for the backoff or the model to load
+	if wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-w.closing:
+			return nil, ErrClosed
+		}
+	}
+	proc, err := startWorker(w.path, w.opts)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		if proc != nil {
+			proc.stop()
+		}
+		return nil, ErrClosed
+	}
+	// a worker that failed to load the model is kept for the backoff
+	w.proc = proc
+	return proc, err
+}
+
+// workerPredictOptions returns the options of a call to the worker, refusing the
+// ones that can not be sent to it. The token callback is called in the
+// parent as the tokens arrive.
+func workerPredictOptions(opts []PredictOption) (PredictOptions, error) {
+	po := NewPredictOptions(opts...)
+	switch {
+	case po.PromptCacheStore != nil:
+		return po, fmt.Errorf("%w: SetPromptCacheStore", errWorkerOption)
+	case po.ContextOverflowHook != nil:
+		return po, fmt.Errorf("%w: SetContextOverflowHook", errWorkerOption)
+	case po.ContextShiftCallback != nil:
+		return po, fmt.Errorf("%w: SetContextShiftCallback", errWorkerOption)
+	}
+	return po, nil
+}
+
+// Process returns the current worker process, or nil if none is running.
+func (w *Worker) Process() *os.Process {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.proc == nil || w.proc.exited() {
+		return nil
+	}
+	return w.proc.cmd.Process
+}
+
+// Predict runs Predict in the worker. A token callback set in opts is called
+// as the tokens arrive from the worker.
+func (w *Worker) Predict(text string, opts ...PredictOption) (string, error) {
+	po, err := workerPredictOptions(opts)
+	if err != nil {
+		return "", err
+	}
+	p, err := w.process()
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := p.call(workerRequest{Method: "predict", Text: text, Predict: &po}, po.TokenCallback)
+	return resp.Text, err
+}
+
+// Embeddings runs Embeddings in the worker.
+func (w *Worker) Embeddings(text string, opts ...PredictOption) ([]float32, error) {
+	po, err := workerPredictOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	p, err := w.process()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := p.call(workerRequest{Method: "embeddings", Text: text, Predict: &po}, nil)
+	return resp.Embeddings, err
+}
+
+// TokenizeString runs TokenizeString in the worker.
+func (w *Worker) TokenizeString(text string, opts ...PredictOption) (int32, []int32, error) {
+	po, err := workerPredictOptions(opts)
+	if err != nil {
+		return 0, nil, err
+	}
+	p, err := w.process()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	resp, err := p.call(workerRequest{Method: "tokenize", Text: text, Predict: &po}, nil)
+	return resp.Count, resp.Tokens, err
+}
+
+// Close stops the worker process once its running calls return.
+func (w *Worker) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	close(w.closing)
+	if w.proc != nil {
+		w.proc.stop()
+	}
+	return nil
+}
+
+type workerProcess struct {
+	cmd      *exec.Cmd
+	requests io.WriteCloser
+	sendMu   sync.Mutex
+	enc      *json.Encoder
+
+	mu      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan workerResponse
+	// closed once the process exited, err and exitedAt are set by then
+	done      chan struct{}
+	err       error
+	startedAt time.Time
+	exitedAt  time.Time
+}
+
+func startWorker(path string, opts ModelOptions) (*workerProcess, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start worker: %w", err)
+	}
+	reqR, reqW, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start worker: %w", err)
+	}
+	respR, respW, err := os.Pipe()
+	if err != nil {
+		reqR.Close()
+		reqW.Close()
+		return nil, fmt.Errorf("failed to start worker: %w", err)
+	}
+
+	cmd := exec.Command(exe, workerFlag)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{reqR, respW}
+	err = cmd.Start()
+	reqR.Close()
+	respW.Close()
+	if err != nil {
+		reqW.Close()
+		respR.Close()
+		return nil, fmt.Errorf("failed to start worker: %w", err)
+	}
+
+	p := &workerProcess{
+		cmd:       cmd,
+		requests:  reqW,
+		enc:       json.NewEncoder(reqW),
+		pending:   map[uint64]chan workerResponse{},
+		done:      make(chan struct{}),
+		startedAt: time.Now(),
+	}
+	go p.read(respR)
+
+	if _, err := p.call(workerRequest{Method: "load", Path: path, Model: &opts}, nil); err != nil {
+		p.stop()
+		return p, err
+	}
+	return p, nil
+}
+
+// read dispatches the responses of the worker until it exits.
+func (p *workerProcess) read(r io.ReadCloser) {
+	dec := json.NewDecoder(r)
+	for {
+		var resp workerResponse
+		if err := dec.Decode(&resp); err != nil {
+			break
+		}
+		p.mu.Lock()
+		ch := p.pending[resp.ID]
+		p.mu.Unlock()
+		if ch != nil {
+			ch <- resp
+		}
+	}
+	r.Close()
+	p.requests.Close()
+
+	err := p.cmd.Wait()
+	if err == nil {
+		err = errors.New("worker exited")
+	}
+
+	p.mu.Lock()
+	p.err = fmt.Errorf("%w: %v", ErrWorkerCrashed, err)
+	p.exitedAt = time.Now()
+	p.pending = nil
+	p.mu.Unlock()
+	close(p.done)
+}
+
+func (p *workerProcess) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (p *workerProcess) send(req workerRequest) error {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+
+	return p.enc.Encode(req)
+}
+
+// call sends req and waits for its response, passing the tokens streamed
+// before it to token when it is not nil.
+func (p *workerProcess) call(req workerRequest, token func(string) bool) (workerResponse, error) {
+	ch := make(chan workerResponse, 16)
+	p.mu.Lock()
+	if p.pending == nil {
+		p.mu.Unlock()
+		return workerResponse{}, p.err
+	}
+	p.nextID++
+	req.ID = p.nextID
+	p.pending[req.ID] = ch
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.pending, req.ID)
+		p.mu.Unlock()
+	}()
+
+	req.Stream = token != nil
+	if err := p.send(req); err != nil {
+		<-p.done
+		return workerResponse{}, p.err
+	}
+
+	for {
+		var resp workerResponse
+		select {
+		case resp = <-ch:
+		case <-p.done:
+			// responses read before the worker exited come first
+			select {
+			case resp = <-ch:
+			default:
+				return workerResponse{}, p.err
+			}
+		}
+
+		if !resp.Done {
+			p.send(workerRequest{ID: req.ID, Method: "next", Continue: token(resp.Token)})
+			continue
+		}
+		if resp.Error != "" {
+			return resp, workerError(resp.Error)
+		}
+		return resp, nil
+	}
+}
+
+// stop closes the requests of the worker, which makes it exit once its calls
+// return, and kills it if it does not.
+func (p *workerProcess) stop() {
+	p.requests.Close()
+	select {
+	case <-p.done:
+	case <-time.After(10 * time.Second):
+		p.cmd.Process.Kill()
+		<-p.done
+	}
+}
+
+// workerError turns an error sent by the worker back into the sentinel error
+// it was, if it was one.
+func workerError(msg string) error {
+	for _, err := range []error{ErrContextFull, ErrClosed, ErrLoadCanceled} {
+		if msg == err.Error() {
+			return err
+		}
+	}
+	return errors.New(msg)
+}
+
+// RunWorker serves as a worker and exits when the program was started by
+// NewWorker, and returns right away otherwise. It must be called at the start
+// of main, before flags are parsed.
+func RunWorker() {
+	if len(os.Args) != 2 || os.Args[1] != workerFlag {
+		return
+	}
+
+	if err := serveWorker(os.NewFile(3, "requests"), os.NewFile(4, "responses")); err != nil {
+		fmt.Fprintf(os.Stderr, "llama worker: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func serveWorker(r io.Reader, w io.Writer) error {
+	dec := json.NewDecoder(r)
+	enc := json.NewEncoder(w)
+	var sendMu sync.Mutex
+	send := func(resp workerResponse) {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		enc.Encode(resp)
+	}
+
+	var (
+		model   *LLama
+		running sync.WaitGroup
+		nextMu  sync.Mutex
+		next    = map[uint64]chan bool{}
+		// closed once the parent is gone, nobody answers tokens anymore
+		quit = make(chan struct{})
+	)
+	for {
+		var req workerRequest
+		if err := dec.Decode(&req); err != nil {
+			close(quit)
+			running.Wait()
+			if model != nil {
+				model.Close()
+			}
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+
+		switch req.Method {
+		case "load":
+			resp := workerResponse{ID: req.ID, Done: true}
+			if model != nil || req.Model == nil {
+				resp.Error = "invalid load request"
+			} else {
+				mo := *req.Model
+				var err error
+				if model, err = New(req.Path, func(p *ModelOptions) { *p = mo }); err != nil {
+					resp.Error = err.Error()
+				}
+			}
+			send(resp)
+		case "next":
+			nextMu.Lock()
+			if ch := next[req.ID]; ch != nil {
+				ch <- req.Continue
+			}
+			nextMu.Unlock()
+		default:
+			if model == nil || req.Predict == nil {
+				send(workerResponse{ID: req.ID, Done: true, Error: "invalid request"})
+				continue
+			}
+			ch := make(chan bool, 1)
+			nextMu.Lock()
+			next[req.ID] = ch
+			nextMu.Unlock()
+
+			running.Add(1)
+			go func(req workerRequest) {
+				defer running.Done()
+				send(serveWorkerCall(model, req, func(token string) bool {
+					send(workerResponse{ID: req.ID, Token: token})
+					select {
+					case more := <-ch:
+						return more
+					case <-quit:
+						return false
+					}
+				}))
+
+				nextMu.Lock()
+				delete(next, req.ID)
+				nextMu.Unlock()
+			}(req)
+		}
+	}
+}
+
+// serveWorkerCall runs req on the model, passing the generated tokens to
+// token if the request streams them.
+func serveWorkerCall(model *LLama, req workerRequest, token func(string) bool) workerResponse {
+	po := *req.Predict
+	if req.Stream {
+		po.TokenCallback = token
+	}
+	opt := func(p *PredictOptions) { *p = po }
+
+	resp := workerResponse{ID: req.ID, Done: true}
+	var err error
+	switch req.Method {
+	case "predict":
+		resp.Text, err = model.Predict(req.Text, opt)
+	case "embeddings":
+		resp.Embeddings, err = model.Embeddings(req.Text, opt)
+	case "tokenize":
+		resp.Count, resp.Tokens, err = model.TokenizeString(req.Text, opt)
+	default:
+		err = fmt.Errorf("unknown method %q", req.Method)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}